@@ -0,0 +1,427 @@
+package rbtree
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// OpenBlob opens tree which stores variable sized values in a separate
+// blob file, indexing only the small BlobRef handles.
+func OpenBlob[K EntryItem](fileName string, opts *Options) (*BlobTree[K], error) {
+	blobFile := fmt.Sprintf("%s.blob", fileName)
+	if opts.CreateDir {
+		if err := os.MkdirAll(filepath.Dir(blobFile), 0775); err != nil {
+			return nil, errors.Wrap(err, "failed to create blob directory")
+		}
+	}
+
+	f, err := os.OpenFile(blobFile, os.O_CREATE|os.O_RDWR, opts.fileMode())
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open blob file")
+	}
+
+	stat, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, errors.Wrap(err, "failed to stat blob file")
+	}
+
+	bt := &BlobTree[K]{
+		mu:   &sync.Mutex{},
+		file: f,
+		size: uint64(stat.Size()),
+	}
+
+	bt.tree, err = Open[K, *BlobRef](fileName, opts)
+	if err != nil {
+		_ = bt.Close()
+		return nil, errors.Wrap(err, "failed to open blob index")
+	}
+
+	// freelists order keys by their own encoding, independent of opts
+	freeOpts := &Options{
+		PageSize:  opts.PageSize,
+		FileMode:  opts.FileMode,
+		CreateDir: opts.CreateDir,
+		KeyOnly:   true,
+	}
+
+	bt.free, err = Open[*blobExtent, *DummyVal](fmt.Sprintf("%s.blobfree", fileName), freeOpts)
+	if err != nil {
+		_ = bt.Close()
+		return nil, errors.Wrap(err, "failed to open blob freelist")
+	}
+
+	bt.spans, err = Open[*blobSpan, *DummyVal](fmt.Sprintf("%s.blobspan", fileName), freeOpts)
+	if err != nil {
+		_ = bt.Close()
+		return nil, errors.Wrap(err, "failed to open blob freelist by offset")
+	}
+
+	return bt, nil
+}
+
+type BlobTree[K EntryItem] struct {
+	mu    *sync.Mutex
+	file  *os.File
+	size  uint64                          // blob file size, values are appended here
+	tree  *RBTree[K, *BlobRef]            // key => value location in blob file
+	free  *RBTree[*blobExtent, *DummyVal] // free blob file extents ordered by length
+	spans *RBTree[*blobSpan, *DummyVal]   // the same extents ordered by offset
+}
+
+// Tree returns underlying index of blob handles
+func (bt *BlobTree[K]) Tree() *RBTree[K, *BlobRef] {
+	return bt.tree
+}
+
+func (bt *BlobTree[K]) Insert(key K, val []byte) error {
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+
+	ref, err := bt.write(val)
+	if err != nil {
+		return errors.Wrap(err, "failed to write blob")
+	}
+
+	if err := bt.tree.InsertMem(&Entry[K, *BlobRef]{Key: key, Val: ref}); err != nil {
+		if releaseErr := bt.release(ref); releaseErr != nil {
+			return errors.Wrap(releaseErr, "failed to release blob")
+		}
+		return err
+	}
+	return bt.writeAll()
+}
+
+func (bt *BlobTree[K]) Get(key K) ([]byte, error) {
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+
+	e, err := bt.tree.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	return bt.read(e.Val)
+}
+
+func (bt *BlobTree[K]) Delete(key K) error {
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+
+	e, err := bt.tree.Get(key)
+	if err != nil {
+		return err
+	}
+
+	ref := *e.Val
+	if err := bt.tree.DeleteMem(key); err != nil {
+		return err
+	}
+
+	if err := bt.release(&ref); err != nil {
+		return errors.Wrap(err, "failed to release blob")
+	}
+	return bt.writeAll()
+}
+
+func (bt *BlobTree[K]) WriteAll() error {
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+
+	return bt.writeAll()
+}
+
+func (bt *BlobTree[K]) Close() error {
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+
+	var err error
+	if bt.tree != nil {
+		err = bt.tree.Close()
+	}
+	if bt.free != nil {
+		if e := bt.free.Close(); err == nil {
+			err = e
+		}
+	}
+	if bt.spans != nil {
+		if e := bt.spans.Close(); err == nil {
+			err = e
+		}
+	}
+	if e := bt.file.Close(); err == nil && !errors.Is(e, os.ErrClosed) {
+		err = e
+	}
+	return errors.Wrap(err, "failed to close BlobTree")
+}
+
+func (bt *BlobTree[K]) Remove() {
+	bt.tree.Remove()
+	bt.free.Remove()
+	bt.spans.Remove()
+	bt.file.Close()
+	os.Remove(bt.file.Name())
+}
+
+// writeAll makes blob data durable before flushing trees referencing it
+func (bt *BlobTree[K]) writeAll() error {
+	if err := bt.file.Sync(); err != nil {
+		return errors.Wrap(err, "failed to sync blob file")
+	}
+	if err := bt.free.WriteAll(); err != nil {
+		return errors.Wrap(err, "failed to write blob freelist")
+	}
+	if err := bt.spans.WriteAll(); err != nil {
+		return errors.Wrap(err, "failed to write blob freelist by offset")
+	}
+	return errors.Wrap(bt.tree.WriteAll(), "failed to write blob index")
+}
+
+func (bt *BlobTree[K]) read(ref *BlobRef) ([]byte, error) {
+	buf := make([]byte, ref.Length)
+	if _, err := bt.file.ReadAt(buf, int64(ref.Offset)); err != nil {
+		return nil, errors.Wrap(err, "failed to read blob")
+	}
+	return buf, nil
+}
+
+func (bt *BlobTree[K]) write(val []byte) (*BlobRef, error) {
+	ref, err := bt.alloc(uint32(len(val)))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to alloc blob")
+	}
+
+	if _, err := bt.file.WriteAt(val, int64(ref.Offset)); err != nil {
+		return nil, errors.Wrap(err, "failed to write blob")
+	}
+	return ref, nil
+}
+
+// alloc takes best fitting free extent, or appends to the end of blob file
+func (bt *BlobTree[K]) alloc(length uint32) (*BlobRef, error) {
+	if length == 0 {
+		return &BlobRef{}, nil
+	}
+
+	bt.free.mu.RLock()
+	ptr, err := bt.free.get(&blobExtent{length: length})
+	var ext blobExtent
+	if (err == nil || err == ErrNotFound) && ptr != bt.free.meta.nullPtr {
+		ext = *bt.free.fetch(ptr).entry.Key
+	}
+	bt.free.mu.RUnlock()
+
+	if err != nil && err != ErrNotFound {
+		return nil, errors.Wrap(err, "failed to find free extent")
+	} else if ptr == bt.free.meta.nullPtr {
+		ref := &BlobRef{Offset: bt.size, Length: length}
+		bt.size += uint64(length)
+		return ref, nil
+	}
+
+	if err := bt.take(ext); err != nil {
+		return nil, errors.Wrap(err, "failed to take free extent")
+	}
+
+	if ext.length > length {
+		rest := blobExtent{length: ext.length - length, offset: ext.offset + uint64(length)}
+		if err := bt.put(rest); err != nil {
+			return nil, errors.Wrap(err, "failed to split free extent")
+		}
+	}
+
+	return &BlobRef{Offset: ext.offset, Length: length}, nil
+}
+
+// release returns blob to freelist merging it with adjacent free extents,
+// extent at the end of blob file is truncated instead
+func (bt *BlobTree[K]) release(ref *BlobRef) error {
+	if ref.Length == 0 {
+		return nil
+	}
+
+	ext := blobExtent{length: ref.Length, offset: ref.Offset}
+	prev, next, err := bt.neighbours(ext)
+	if err != nil {
+		return errors.Wrap(err, "failed to find adjacent free extents")
+	}
+
+	if prev != nil && prev.offset+uint64(prev.length) == ext.offset && uint64(prev.length)+uint64(ext.length) <= math.MaxUint32 {
+		if err := bt.take(*prev); err != nil {
+			return errors.Wrap(err, "failed to merge previous free extent")
+		}
+		ext = blobExtent{length: prev.length + ext.length, offset: prev.offset}
+	}
+
+	if next != nil && ext.offset+uint64(ext.length) == next.offset && uint64(ext.length)+uint64(next.length) <= math.MaxUint32 {
+		if err := bt.take(*next); err != nil {
+			return errors.Wrap(err, "failed to merge next free extent")
+		}
+		ext.length += next.length
+	}
+
+	if ext.offset+uint64(ext.length) == bt.size {
+		if err := bt.file.Truncate(int64(ext.offset)); err != nil {
+			return errors.Wrap(err, "failed to truncate blob file")
+		}
+		bt.size = ext.offset
+		return nil
+	}
+	return bt.put(ext)
+}
+
+// neighbours returns free extents right before and after ext by offset
+func (bt *BlobTree[K]) neighbours(ext blobExtent) (prev, next *blobExtent, err error) {
+	bt.spans.mu.RLock()
+	defer bt.spans.mu.RUnlock()
+
+	span := &blobSpan{offset: ext.offset}
+	ptr, err := bt.spans.floor(span)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to find previous extent")
+	} else if ptr != bt.spans.meta.nullPtr {
+		k := bt.spans.fetch(ptr).entry.Key
+		prev = &blobExtent{length: k.length, offset: k.offset}
+	}
+
+	ptr, err = bt.spans.get(span)
+	if err != nil && err != ErrNotFound {
+		return nil, nil, errors.Wrap(err, "failed to find next extent")
+	} else if ptr != bt.spans.meta.nullPtr {
+		k := bt.spans.fetch(ptr).entry.Key
+		next = &blobExtent{length: k.length, offset: k.offset}
+	}
+	return prev, next, nil
+}
+
+// take removes free extent from both freelists
+func (bt *BlobTree[K]) take(ext blobExtent) error {
+	if err := bt.free.DeleteMem(&ext); err != nil {
+		return err
+	}
+	return bt.spans.DeleteMem(&blobSpan{offset: ext.offset, length: ext.length})
+}
+
+// put adds free extent to both freelists
+func (bt *BlobTree[K]) put(ext blobExtent) error {
+	err := bt.free.InsertMem(&Entry[*blobExtent, *DummyVal]{Key: &ext, Val: &DummyVal{}})
+	if err != nil {
+		return err
+	}
+	return bt.spans.InsertMem(&Entry[*blobSpan, *DummyVal]{
+		Key: &blobSpan{offset: ext.offset, length: ext.length},
+		Val: &DummyVal{},
+	})
+}
+
+type BlobRef struct {
+	Offset uint64
+	Length uint32
+}
+
+func (r *BlobRef) New() EntryItem {
+	return &BlobRef{}
+}
+
+func (r *BlobRef) Copy() EntryItem {
+	cp := *r
+	return &cp
+}
+
+func (r *BlobRef) Size() int {
+	return 12
+}
+
+func (r *BlobRef) IsNil() bool {
+	return r == nil
+}
+
+func (r *BlobRef) MarshalBinary() ([]byte, error) {
+	buf := make([]byte, r.Size())
+	bin.PutUint64(buf[0:8], r.Offset)
+	bin.PutUint32(buf[8:12], r.Length)
+	return buf, nil
+}
+
+func (r *BlobRef) UnmarshalBinary(d []byte) error {
+	r.Offset = bin.Uint64(d[0:8])
+	r.Length = bin.Uint32(d[8:12])
+	return nil
+}
+
+// blobExtent is free region of blob file, ordered by length then offset
+type blobExtent struct {
+	length uint32
+	offset uint64
+}
+
+func (e *blobExtent) New() EntryItem {
+	return &blobExtent{}
+}
+
+func (e *blobExtent) Copy() EntryItem {
+	cp := *e
+	return &cp
+}
+
+func (e *blobExtent) Size() int {
+	return 12
+}
+
+func (e *blobExtent) IsNil() bool {
+	return e == nil
+}
+
+func (e *blobExtent) MarshalBinary() ([]byte, error) {
+	buf := make([]byte, e.Size())
+	bin.PutUint32(buf[0:4], e.length)
+	bin.PutUint64(buf[4:12], e.offset)
+	return buf, nil
+}
+
+func (e *blobExtent) UnmarshalBinary(d []byte) error {
+	e.length = bin.Uint32(d[0:4])
+	e.offset = bin.Uint64(d[4:12])
+	return nil
+}
+
+// blobSpan is free region of blob file, ordered by offset
+type blobSpan struct {
+	offset uint64
+	length uint32
+}
+
+func (e *blobSpan) New() EntryItem {
+	return &blobSpan{}
+}
+
+func (e *blobSpan) Copy() EntryItem {
+	cp := *e
+	return &cp
+}
+
+func (e *blobSpan) Size() int {
+	return 12
+}
+
+func (e *blobSpan) IsNil() bool {
+	return e == nil
+}
+
+func (e *blobSpan) MarshalBinary() ([]byte, error) {
+	buf := make([]byte, e.Size())
+	bin.PutUint64(buf[0:8], e.offset)
+	bin.PutUint32(buf[8:12], e.length)
+	return buf, nil
+}
+
+func (e *blobSpan) UnmarshalBinary(d []byte) error {
+	e.offset = bin.Uint64(d[0:8])
+	e.length = bin.Uint32(d[8:12])
+	return nil
+}
@@ -0,0 +1,168 @@
+package rbtree
+
+import (
+	"math/bits"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// BulkLoad builds balanced tree from entries sorted by tree key ordering
+// without duplicates, ErrNotSorted is returned otherwise. Tree must be
+// empty. Changes are written to disk.
+func (tree *RBTree[K, V]) BulkLoad(entries []*Entry[K, V]) (err error) {
+	if tree.onOp != nil {
+		defer tree.observe(OpInsert, time.Now(), &err)
+	}
+
+	return tree.bulkLoadSorted(entries)
+}
+
+// bulkLoadSorted is BulkLoad not reported to Options.OnOp
+func (tree *RBTree[K, V]) bulkLoadSorted(entries []*Entry[K, V]) (err error) {
+	var prev orderKey[K]
+	for i, e := range entries {
+		if eSize := e.Size(); eSize != int(tree.meta.nodeKeySize + tree.meta.nodeValSize) {
+			return errors.Wrapf(
+				ErrInvalidKeySize, "bulk load entry size missmatch, required:'%v', got:'%v'",
+				tree.meta.nodeKeySize + tree.meta.nodeValSize, eSize,
+			)
+		}
+
+		key, err := tree.prepare(e.Key)
+		if err != nil {
+			return errors.Wrap(err, "failed to prepare entry key")
+		}
+		if i > 0 && tree.compareOrder(prev, key) >= 0 {
+			return errors.Wrapf(ErrNotSorted, "index:'%v', key:'%v'", i, e.Key)
+		}
+		prev = key
+	}
+
+	tree.mu.Lock()
+	defer tree.unlock(&err)
+
+	if err := tree.bulkLoad(entries); err != nil {
+		return err
+	}
+	return tree.persist()
+}
+
+// BulkLoadUnsorted sorts entries by tree key ordering and builds balanced
+// tree from them, which is faster than inserting one by one. Entries with
+// equal keys are merged by onDup, ErrKeyAlreadyExists is returned when onDup
+// is nil. Tree must be empty. Changes are written to disk.
+func (tree *RBTree[K, V]) BulkLoadUnsorted(
+	entries []*Entry[K, V],
+	onDup func(a, b *Entry[K, V]) *Entry[K, V],
+) (err error) {
+	if tree.onOp != nil {
+		defer tree.observe(OpInsert, time.Now(), &err)
+	}
+
+	keys := make([]orderKey[K], len(entries))
+	for i, e := range entries {
+		if eSize := e.Size(); eSize != int(tree.meta.nodeKeySize + tree.meta.nodeValSize) {
+			return errors.Wrapf(
+				ErrInvalidKeySize, "bulk load entry size missmatch, required:'%v', got:'%v'",
+				tree.meta.nodeKeySize + tree.meta.nodeValSize, eSize,
+			)
+		}
+
+		if keys[i], err = tree.prepare(e.Key); err != nil {
+			return errors.Wrap(err, "failed to prepare entry key")
+		}
+	}
+
+	order := make([]int, len(entries))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return tree.compareOrder(keys[order[i]], keys[order[j]]) < 0
+	})
+
+	sorted := make([]*Entry[K, V], 0, len(entries))
+	for i, idx := range order {
+		if i > 0 && tree.compareOrder(keys[order[i-1]], keys[idx]) == 0 {
+			if onDup == nil {
+				return errors.Wrapf(ErrKeyAlreadyExists, "key:'%v'", entries[idx].Key)
+			}
+			sorted[len(sorted)-1] = onDup(sorted[len(sorted)-1], entries[idx])
+			continue
+		}
+		sorted = append(sorted, entries[idx])
+	}
+
+	tree.mu.Lock()
+	defer tree.unlock(&err)
+
+	if err := tree.bulkLoad(sorted); err != nil {
+		return err
+	}
+	return tree.persist()
+}
+
+// bulkLoad builds perfectly balanced tree from sorted unique entries.
+// Nodes of the deepest level are red when it is not full, so every path
+// has the same number of black nodes.
+func (tree *RBTree[K, V]) bulkLoad(entries []*Entry[K, V]) error {
+	if tree.readOnly {
+		return ErrReadOnly
+	}
+	if tree.meta.count != 0 {
+		return errors.Wrapf(ErrNotEmpty, "count:'%v'", tree.meta.count)
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+
+	redDepth := bits.Len(uint(len(entries))) - 1
+	var build func(lo, hi, depth int, parent uint32) (uint32, error)
+	build = func(lo, hi, depth int, parent uint32) (uint32, error) {
+		if lo > hi {
+			return tree.meta.nullPtr, nil
+		}
+
+		mid := (lo + hi) / 2
+		ptr, err := tree.alloc()
+		if err != nil {
+			return 0, errors.Wrap(err, "failed to alloc 1 node")
+		}
+
+		n := tree.fetch(ptr)
+		n.markDirty()
+		n.parent = parent
+		n.clearTombstone()
+		n.setEntry(entries[mid].Copy())
+		if depth == redDepth && depth > 0 {
+			n.setRed()
+		} else {
+			n.setBlack()
+		}
+
+		if n.left, err = build(lo, mid-1, depth+1, ptr); err != nil {
+			return 0, err
+		}
+		if n.right, err = build(mid+1, hi, depth+1, ptr); err != nil {
+			return 0, err
+		}
+		if mid == len(entries)-1 {
+			tree.maxPtr = ptr
+		}
+		tree.resize(ptr)
+		return ptr, nil
+	}
+
+	root, err := build(0, len(entries)-1, 0, tree.meta.nullPtr)
+	if err != nil {
+		return err
+	}
+
+	tree.meta.dirty = true
+	tree.meta.rootPtr = root
+	tree.meta.count = uint32(len(entries))
+	tree.meta.seq += uint64(len(entries))
+	return nil
+}
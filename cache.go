@@ -0,0 +1,231 @@
+package rbtree
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// number of independently locked page cache shards
+const cacheShards = 16
+
+// pageCache is page cache sharded by page id, so readers touching different
+// pages don't serialize on a single lock
+type pageCache[K, V EntryItem] struct {
+	shards [cacheShards]cacheShard[K, V]
+
+	dirtyMu sync.Mutex
+	dirty   map[uint32]*page[K, V] // pages changed since the last flush
+
+	max       int           // evict least recently used pages above it, 0 for no limit
+	clock     atomic.Uint64 // stamps page accesses for LRU ordering
+	hits      atomic.Uint64
+	misses    atomic.Uint64
+	evictions atomic.Uint64
+}
+
+// CacheStats are page cache counters since tree was opened
+type CacheStats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	Pages     int // pages currently cached
+}
+
+type cacheShard[K, V EntryItem] struct {
+	mu    sync.Mutex
+	pages map[uint32]*page[K, V]
+}
+
+// newPageCache creates cache with room for expectedPages pages
+func newPageCache[K, V EntryItem](expectedPages, maxPages int) *pageCache[K, V] {
+	c := &pageCache[K, V]{dirty: map[uint32]*page[K, V]{}, max: maxPages}
+	if maxPages > 0 {
+		expectedPages = min(expectedPages, maxPages)
+	}
+	perShard := max(0, (expectedPages + cacheShards - 1) / cacheShards)
+	for i := range c.shards {
+		c.shards[i].pages = make(map[uint32]*page[K, V], perShard)
+	}
+	return c
+}
+
+func (c *pageCache[K, V]) shard(id uint32) *cacheShard[K, V] {
+	return &c.shards[id%cacheShards]
+}
+
+func (c *pageCache[K, V]) get(id uint32) (*page[K, V], bool) {
+	s := c.shard(id)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, ok := s.pages[id]
+	if !ok {
+		c.misses.Add(1)
+		return nil, false
+	}
+	c.hits.Add(1)
+	c.touch(p)
+	return p, true
+}
+
+// touch marks page as the most recently used one
+func (c *pageCache[K, V]) touch(p *page[K, V]) {
+	if c.max > 0 {
+		p.used.Store(c.clock.Add(1))
+	}
+}
+
+// add caches page unless page with same id is already cached and returns
+// the cached one
+func (c *pageCache[K, V]) add(p *page[K, V]) *page[K, V] {
+	s := c.shard(p.id)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if cached, ok := s.pages[p.id]; ok {
+		return cached
+	}
+	s.pages[p.id] = p
+	c.touch(p)
+	return p
+}
+
+func (c *pageCache[K, V]) remove(id uint32) {
+	s := c.shard(id)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.pages, id)
+	c.markClean(id)
+}
+
+func (c *pageCache[K, V]) markDirty(p *page[K, V]) {
+	c.dirtyMu.Lock()
+	defer c.dirtyMu.Unlock()
+
+	c.dirty[p.id] = p
+}
+
+func (c *pageCache[K, V]) markClean(id uint32) {
+	c.dirtyMu.Lock()
+	defer c.dirtyMu.Unlock()
+
+	delete(c.dirty, id)
+}
+
+// hasDirty reports whether any page changed since it was last cleaned
+func (c *pageCache[K, V]) hasDirty() bool {
+	c.dirtyMu.Lock()
+	defer c.dirtyMu.Unlock()
+
+	return len(c.dirty) != 0
+}
+
+// dirtyPages returns pages changed since they were last cleaned, sorted by
+// id so flushes write file sequentially and in reproducible order
+func (c *pageCache[K, V]) dirtyPages() []*page[K, V] {
+	c.dirtyMu.Lock()
+	defer c.dirtyMu.Unlock()
+
+	pages := make([]*page[K, V], 0, len(c.dirty))
+	for _, p := range c.dirty {
+		pages = append(pages, p)
+	}
+	sort.Slice(pages, func(i, j int) bool {
+		return pages[i].id < pages[j].id
+	})
+	return pages
+}
+
+// removeIf removes every page for which fn returns true and returns number
+// of removed pages
+func (c *pageCache[K, V]) removeIf(fn func(p *page[K, V]) bool) int {
+	n := 0
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mu.Lock()
+		for id, p := range s.pages {
+			if fn(p) {
+				delete(s.pages, id)
+				n++
+			}
+		}
+		s.mu.Unlock()
+	}
+	return n
+}
+
+// clear removes all pages, dirty ones included
+func (c *pageCache[K, V]) clear() {
+	c.removeIf(func(p *page[K, V]) bool {
+		return true
+	})
+
+	c.dirtyMu.Lock()
+	defer c.dirtyMu.Unlock()
+
+	clear(c.dirty)
+}
+
+// evict removes least recently used clean pages for which keep returns
+// false, until at most 7/8 of max pages are cached, so eviction runs once
+// per several misses rather than on each of them. Dirty pages stay until
+// they are written. Returns number of removed pages.
+func (c *pageCache[K, V]) evict(keep func(p *page[K, V]) bool) int {
+	if c.max <= 0 {
+		return 0
+	}
+	n := c.len()
+	if n <= c.max {
+		return 0
+	}
+
+	candidates := []*page[K, V]{}
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mu.Lock()
+		for _, p := range s.pages {
+			if !p.isDirty() && !keep(p) {
+				candidates = append(candidates, p)
+			}
+		}
+		s.mu.Unlock()
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].used.Load() < candidates[j].used.Load()
+	})
+
+	removed := 0
+	for _, p := range candidates[:min(len(candidates), n - c.max + c.max / 8)] {
+		s := c.shard(p.id)
+		s.mu.Lock()
+		if s.pages[p.id] == p {
+			delete(s.pages, p.id)
+			removed++
+		}
+		s.mu.Unlock()
+	}
+	c.evictions.Add(uint64(removed))
+	return removed
+}
+
+func (c *pageCache[K, V]) stats() CacheStats {
+	return CacheStats{
+		Hits:      c.hits.Load(),
+		Misses:    c.misses.Load(),
+		Evictions: c.evictions.Load(),
+		Pages:     c.len(),
+	}
+}
+
+func (c *pageCache[K, V]) len() int {
+	n := 0
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mu.Lock()
+		n += len(s.pages)
+		s.mu.Unlock()
+	}
+	return n
+}
@@ -0,0 +1,59 @@
+package rbtree
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// Clone writes pending changes and copies tree file to newFileName (suffix
+// is added like with Open), then opens the copy with the same options. The
+// copy is independent of tree. Existing destination file is not overwritten,
+// error wrapping os.ErrExist is returned instead.
+func (tree *RBTree[K, V]) Clone(newFileName string) (*RBTree[K, V], error) {
+	if err := tree.copyTo(tree.opts.indexFile(newFileName)); err != nil {
+		return nil, err
+	}
+
+	clone, err := Open[K, V](newFileName, &tree.opts)
+	return clone, errors.Wrap(err, "failed to open clone")
+}
+
+func (tree *RBTree[K, V]) copyTo(dstFile string) (err error) {
+	tree.mu.Lock()
+	defer tree.unlock(&err)
+
+	if err := tree.writeAll(); err != nil {
+		return errors.Wrap(err, "failed to write all")
+	}
+
+	if tree.opts.CreateDir {
+		if err := os.MkdirAll(filepath.Dir(dstFile), 0775); err != nil {
+			return errors.Wrap(err, "failed to create clone directory")
+		}
+	}
+	f, err := os.OpenFile(dstFile, os.O_WRONLY | os.O_CREATE | os.O_EXCL, tree.opts.fileMode())
+	if err != nil {
+		return errors.Wrap(err, "failed to create clone file")
+	}
+
+	buf := make([]byte, tree.pager.PageSize())
+	for id := uint64(0); id < tree.pager.Count() && err == nil; id++ {
+		if err = tree.pager.ReadAt(buf, id * uint64(len(buf))); err != nil {
+			err = errors.Wrapf(err, "failed to read page:'%v'", id)
+		} else if _, err = f.Write(buf); err != nil {
+			err = errors.Wrapf(err, "failed to write page:'%v'", id)
+		}
+	}
+	if err == nil {
+		err = errors.Wrap(f.Sync(), "failed to sync clone file")
+	}
+	if closeErr := f.Close(); err == nil && closeErr != nil {
+		err = errors.Wrap(closeErr, "failed to close clone file")
+	}
+	if err != nil {
+		_ = os.Remove(dstFile)
+	}
+	return err
+}
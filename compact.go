@@ -0,0 +1,133 @@
+package rbtree
+
+import (
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/vahagz/pager"
+)
+
+// Compact rebuilds tree densely, so space left by deletes and tombstones is
+// reclaimed and file shrinks to minimal size. Live entries are bulk loaded
+// into '<file>.compact' which then replaces tree file by rename, crash
+// leaves either old or compacted file. Writers are blocked while it runs,
+// snapshots taken before are released.
+func (tree *RBTree[K, V]) Compact() (err error) {
+	if tree.onOp != nil {
+		defer tree.observe(OpCompact, time.Now(), &err)
+	}
+
+	tree.mu.Lock()
+	defer tree.unlock(&err)
+
+	if tree.readOnly {
+		return ErrReadOnly
+	}
+	if err := tree.writeAll(); err != nil {
+		return errors.Wrap(err, "failed to write all")
+	}
+
+	entries := make([]*Entry[K, V], 0, tree.meta.count - tree.meta.tombstones)
+	_, err = tree.scan(ScanOpts[K]{}, 0, nil, func(e *Entry[K, V]) (bool, error) {
+		entries = append(entries, e.Copy())
+		return false, nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to collect entries")
+	}
+
+	_, mem := tree.pager.(memPager)
+	tmpFile := tree.file + ".compact"
+	p, err := tree.compactTo(tmpFile, mem, entries)
+	if err != nil {
+		if !mem {
+			_ = os.Remove(tmpFile)
+		}
+		return err
+	}
+
+	meta := &metadata{}
+	tree.io.pageReads.Add(1)
+	if err := p.Unmarshal(0, meta); err != nil {
+		p.Remove()
+		return errors.Wrap(err, "failed to unmarshal compacted meta")
+	}
+
+	// pager keeps compacted file open, so it is never reopened by name
+	// and tree can not end up on the replaced file
+	if !mem {
+		if err := os.Rename(tmpFile, tree.file); err != nil {
+			p.Remove()
+			return errors.Wrap(err, "failed to replace tree file")
+		}
+		p = movedPager{p.(*pager.Pager), tree.file}
+	}
+
+	tree.releaseSnapshots()
+	_ = tree.pager.Close()
+	tree.pager = p
+	tree.pages.clear()
+	tree.maxPtr = 0
+	tree.uncommitted = false
+	tree.meta = meta
+	tree.setLayout()
+	return nil
+}
+
+// compactTo bulk loads entries into new tree stored in file, or in memory
+// if mem is set, and returns its pager, still open, with all pages written
+func (tree *RBTree[K, V]) compactTo(file string, mem bool, entries []*Entry[K, V]) (pageStore, error) {
+	var p pageStore
+	if mem {
+		mp, err := pager.Open(pager.InMemoryFileName, tree.pager.PageSize(), 0)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to open in-memory pager")
+		}
+		p = memPager{mp}
+	} else {
+		// file may be left by interrupted Compact
+		_ = os.Remove(file)
+		fp, err := pager.Open(file, tree.pager.PageSize(), tree.opts.fileMode())
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to create compacted tree file")
+		}
+		p = fp
+	}
+
+	opts := tree.opts
+	opts.ReadOnly = false
+	opts.WAL = false
+	opts.AsyncWrites = false
+	opts.NoAutoSync = false
+	opts.VerifyOnOpen = false
+	opts.OnOp = nil
+	dest, err := newTree[K, V](file, nil, nil, p, &opts)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open compacted tree")
+	}
+	if err := dest.load(entries); err != nil {
+		_ = dest.CloseNoFlush()
+		return nil, errors.Wrap(err, "failed to load compacted tree")
+	}
+	dest.meta.createdAt = tree.meta.createdAt
+	dest.meta.seq = tree.meta.seq
+	dest.meta.dirty = true
+	if err := dest.WriteAll(); err != nil {
+		_ = dest.CloseNoFlush()
+		return nil, errors.Wrap(err, "failed to write compacted tree")
+	}
+	if err := dest.fsync(); err != nil {
+		_ = dest.CloseNoFlush()
+		return nil, errors.Wrap(err, "failed to fsync compacted tree file")
+	}
+	return p, nil
+}
+
+// load bulk loads sorted entries, equal keys allowed
+func (tree *RBTree[K, V]) load(entries []*Entry[K, V]) (err error) {
+	tree.mu.Lock()
+	defer tree.unlock(&err)
+
+	return tree.bulkLoad(entries)
+}
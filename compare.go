@@ -0,0 +1,46 @@
+package rbtree
+
+import "github.com/pkg/errors"
+
+// orderKey is key prepared for repeated comparisons, it holds marshaled key
+// unless tree orders typed keys with Options.Compare
+type orderKey[K EntryItem] struct {
+	key K
+	raw []byte
+}
+
+// prepare returns key ready for compareOrder
+func (tree *RBTree[K, V]) prepare(key K) (orderKey[K], error) {
+	if tree.compareKeys != nil {
+		return orderKey[K]{key: key}, nil
+	}
+
+	raw, err := key.MarshalBinary()
+	if err != nil {
+		return orderKey[K]{}, errors.Wrap(err, "failed to marshal key")
+	}
+	return orderKey[K]{key: key, raw: raw}, nil
+}
+
+// nodeKey is prepare for key of node n, using its cached marshaled key
+func (tree *RBTree[K, V]) nodeKey(n *node[K, V]) (orderKey[K], error) {
+	if raw := n.cachedKey(); raw != nil && tree.compareKeys == nil {
+		return orderKey[K]{key: n.entry.Key, raw: raw}, nil
+	}
+	return tree.prepare(n.entry.Key)
+}
+
+// customOrder reports whether keys are ordered by Options.Compare or
+// Options.CompareBytes instead of bytes.Compare of marshaled keys
+func (tree *RBTree[K, V]) customOrder() bool {
+	return tree.compareKeys != nil || tree.opts.CompareBytes != nil
+}
+
+// compareOrder compares prepared keys with Options.Compare, or their
+// marshaled forms with Options.CompareBytes
+func (tree *RBTree[K, V]) compareOrder(a, b orderKey[K]) int {
+	if tree.compareKeys != nil {
+		return tree.compareKeys(a.key, b.key)
+	}
+	return tree.compare(a.raw, b.raw)
+}
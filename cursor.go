@@ -0,0 +1,303 @@
+package rbtree
+
+import (
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/vahagz/rbtree/pkg/stack"
+)
+
+// cursor walks tree in order keeping path from root to current node, so it
+// uses O(height) memory. Caller must hold tree lock while using cursor.
+type cursor[K, V EntryItem] struct {
+	tree *RBTree[K, V]
+	path stack.Stack[uint32]
+}
+
+// cursorPaths reuses cursor path stacks between scans
+var cursorPaths = sync.Pool{
+	New: func() any {
+		return stack.New[uint32](0)
+	},
+}
+
+// newCursor takes path stack from pool, release returns it
+func (tree *RBTree[K, V]) newCursor() *cursor[K, V] {
+	return &cursor[K, V]{
+		tree: tree,
+		path: cursorPaths.Get().(stack.Stack[uint32]),
+	}
+}
+
+// release returns cursor path to pool, cursor must not be used after it
+func (c *cursor[K, V]) release() {
+	c.path.Clear()
+	cursorPaths.Put(c.path)
+	c.path = nil
+}
+
+// valid reports whether cursor points to a node
+func (c *cursor[K, V]) valid() bool {
+	return c.path.Size() > 0
+}
+
+func (c *cursor[K, V]) ptr() uint32 {
+	return c.path.Top()
+}
+
+func (c *cursor[K, V]) node() *node[K, V] {
+	return c.tree.fetch(c.path.Top())
+}
+
+func (c *cursor[K, V]) reset() {
+	c.path.Clear()
+}
+
+// first moves cursor to the smallest entry
+func (c *cursor[K, V]) first() bool {
+	c.reset()
+	if c.tree.meta.rootPtr == c.tree.meta.nullPtr {
+		return false
+	}
+
+	c.path.Push(c.tree.meta.rootPtr)
+	c.descendLeft()
+	return true
+}
+
+// last moves cursor to the greatest entry
+func (c *cursor[K, V]) last() bool {
+	c.reset()
+	if c.tree.meta.rootPtr == c.tree.meta.nullPtr {
+		return false
+	}
+
+	c.path.Push(c.tree.meta.rootPtr)
+	c.descendRight()
+	return true
+}
+
+// seek moves cursor to the smallest entry greater or equal to key
+func (c *cursor[K, V]) seek(key K) (bool, error) {
+	searchingKey, err := c.tree.prepare(key)
+	if err != nil {
+		return false, errors.Wrap(err, "failed to prepare searching key")
+	}
+
+	c.reset()
+	tree := c.tree
+	depth := 0 // path length to the last node greater or equal to key
+	for ptr := tree.meta.rootPtr; ptr != tree.meta.nullPtr; {
+		n := tree.fetch(ptr)
+		k, err := tree.nodeKey(n)
+		if err != nil {
+			return false, errors.Wrap(err, "failed to prepare entry key")
+		}
+
+		// with duplicates search continues to the first equal key
+		c.path.Push(ptr)
+		cmp := tree.compareOrder(k, searchingKey)
+		if cmp < 0 {
+			ptr = n.right
+		} else if cmp > 0 || tree.allowDups {
+			depth = c.path.Size()
+			ptr = n.left
+		} else {
+			return true, nil
+		}
+	}
+
+	for c.path.Size() > depth {
+		c.path.Pop()
+	}
+	return c.valid(), nil
+}
+
+// seekFloor moves cursor to the greatest entry less or equal to key
+func (c *cursor[K, V]) seekFloor(key K) (bool, error) {
+	searchingKey, err := c.tree.prepare(key)
+	if err != nil {
+		return false, errors.Wrap(err, "failed to prepare searching key")
+	}
+
+	c.reset()
+	tree := c.tree
+	depth := 0 // path length to the last node less or equal to key
+	for ptr := tree.meta.rootPtr; ptr != tree.meta.nullPtr; {
+		n := tree.fetch(ptr)
+		k, err := tree.nodeKey(n)
+		if err != nil {
+			return false, errors.Wrap(err, "failed to prepare entry key")
+		}
+
+		// with duplicates search continues to the last equal key
+		c.path.Push(ptr)
+		cmp := tree.compareOrder(k, searchingKey)
+		if cmp < 0 || cmp == 0 && tree.allowDups {
+			depth = c.path.Size()
+			ptr = n.right
+		} else if cmp > 0 {
+			ptr = n.left
+		} else {
+			return true, nil
+		}
+	}
+
+	for c.path.Size() > depth {
+		c.path.Pop()
+	}
+	return c.valid(), nil
+}
+
+// at moves cursor to node at ptr, rebuilding path from parent pointers
+func (c *cursor[K, V]) at(ptr uint32) bool {
+	c.reset()
+	depth := 0
+	for p := ptr; p != c.tree.meta.nullPtr; p = c.tree.fetch(p).parent {
+		depth++
+	}
+
+	path := make([]uint32, depth)
+	for p := ptr; p != c.tree.meta.nullPtr; p = c.tree.fetch(p).parent {
+		depth--
+		path[depth] = p
+	}
+	for _, p := range path {
+		c.path.Push(p)
+	}
+	return c.valid()
+}
+
+// next moves cursor to in-order successor, cursor becomes invalid at the end
+func (c *cursor[K, V]) next() bool {
+	tree := c.tree
+	if right := c.node().right; right != tree.meta.nullPtr {
+		c.path.Push(right)
+		c.descendLeft()
+		return true
+	}
+
+	for {
+		child := c.path.Pop()
+		if c.path.Size() == 0 {
+			return false
+		}
+		if tree.fetch(c.path.Top()).left == child {
+			return true
+		}
+	}
+}
+
+// prev moves cursor to in-order predecessor, cursor becomes invalid at the
+// beginning
+func (c *cursor[K, V]) prev() bool {
+	tree := c.tree
+	if left := c.node().left; left != tree.meta.nullPtr {
+		c.path.Push(left)
+		c.descendRight()
+		return true
+	}
+
+	for {
+		child := c.path.Pop()
+		if c.path.Size() == 0 {
+			return false
+		}
+		if tree.fetch(c.path.Top()).right == child {
+			return true
+		}
+	}
+}
+
+// step moves cursor to the next entry in given direction
+func (c *cursor[K, V]) step(reverse bool) bool {
+	if reverse {
+		return c.prev()
+	}
+	return c.next()
+}
+
+func (c *cursor[K, V]) descendRight() {
+	for right := c.node().right; right != c.tree.meta.nullPtr; right = c.node().right {
+		c.path.Push(right)
+	}
+}
+
+func (c *cursor[K, V]) descendLeft() {
+	for left := c.node().left; left != c.tree.meta.nullPtr; left = c.node().left {
+		c.path.Push(left)
+	}
+}
+
+// finger resolves ascending sequence of keys, continuing each search from
+// the path of the previous one instead of descending from root
+type finger[K, V EntryItem] struct {
+	tree *RBTree[K, V]
+	path stack.Stack[fingerFrame]
+}
+
+type fingerFrame struct {
+	ptr   uint32
+	upper uint32 // nearest ancestor greater than node, bounds node subtree
+}
+
+func (tree *RBTree[K, V]) newFinger() *finger[K, V] {
+	return &finger[K, V]{
+		tree: tree,
+		path: stack.New[fingerFrame](tree.height()),
+	}
+}
+
+func (f *finger[K, V]) reset() {
+	f.path.Clear()
+}
+
+// find returns pointer to node with given prepared key or nullPtr, key must
+// not be less than the key of previous call unless finger was reset
+func (f *finger[K, V]) find(key orderKey[K]) (uint32, error) {
+	tree := f.tree
+	for f.path.Size() > 0 {
+		upper := f.path.Top().upper
+		if upper == tree.meta.nullPtr {
+			break
+		}
+
+		k, err := tree.nodeKey(tree.fetch(upper))
+		if err != nil {
+			return 0, errors.Wrap(err, "failed to prepare entry key")
+		}
+
+		if tree.compareOrder(key, k) < 0 {
+			break
+		}
+		f.path.Pop()
+	}
+
+	if f.path.Size() == 0 {
+		if tree.meta.rootPtr == tree.meta.nullPtr {
+			return tree.meta.nullPtr, nil
+		}
+		f.path.Push(fingerFrame{tree.meta.rootPtr, tree.meta.nullPtr})
+	}
+
+	for {
+		frame := f.path.Top()
+		n := tree.fetch(frame.ptr)
+		k, err := tree.nodeKey(n)
+		if err != nil {
+			return 0, errors.Wrap(err, "failed to prepare entry key")
+		}
+
+		child := fingerFrame{n.right, frame.upper}
+		if cmp := tree.compareOrder(k, key); cmp == 0 {
+			return frame.ptr, nil
+		} else if cmp > 0 {
+			child = fingerFrame{n.left, frame.ptr}
+		}
+
+		if child.ptr == tree.meta.nullPtr {
+			return tree.meta.nullPtr, nil
+		}
+		f.path.Push(child)
+	}
+}
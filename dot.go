@@ -0,0 +1,52 @@
+package rbtree
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// WriteDOT writes tree as Graphviz digraph, nodes are labeled with key and
+// value and filled with their color, tombstones are dashed
+func (tree *RBTree[K, V]) WriteDOT(w io.Writer) (err error) {
+	tree.mu.RLock()
+	defer tree.runlockErr(&err)
+
+	if _, err := fmt.Fprintln(w, "digraph rbtree {\n\tnode [style=filled, fontcolor=white];"); err != nil {
+		return errors.Wrap(err, "failed to write header")
+	}
+
+	c := tree.newCursor()
+	defer c.release()
+	for ok := c.first(); ok; ok = c.next() {
+		n := c.node()
+		color, style := "black", "filled"
+		if n.isRed() {
+			color = "red"
+		}
+		if n.isTombstone() {
+			style = "filled,dashed"
+		}
+
+		label := fmt.Sprintf("%v\n%v", n.entry.Key, n.entry.Val)
+		if _, err := fmt.Fprintf(w, "\tn%d [label=%q, fillcolor=%s, style=%q];\n", c.ptr(), label, color, style); err != nil {
+			return errors.Wrap(err, "failed to write node")
+		}
+
+		for _, child := range []struct {
+			ptr  uint32
+			side string
+		}{{n.left, "L"}, {n.right, "R"}} {
+			if child.ptr == tree.meta.nullPtr {
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "\tn%d -> n%d [label=%s];\n", c.ptr(), child.ptr, child.side); err != nil {
+				return errors.Wrap(err, "failed to write edge")
+			}
+		}
+	}
+
+	_, err = fmt.Fprintln(w, "}")
+	return errors.Wrap(err, "failed to write footer")
+}
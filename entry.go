@@ -1,6 +1,7 @@
 package rbtree
 
 import (
+	"cmp"
 	"encoding"
 
 	"github.com/pkg/errors"
@@ -20,6 +21,14 @@ type EntryItem interface {
 	encoding.BinaryUnmarshaler
 }
 
+// KeyComparer is implemented by keys which can be ordered without
+// marshaling. CompareTo must return the same sign as bytes.Compare of
+// marshaled keys, point lookups then skip marshaling entirely. It is not
+// used when Options.Compare or Options.CompareBytes is set.
+type KeyComparer[K any] interface {
+	CompareTo(other K) int
+}
+
 func (e *Entry[K, V]) new() *Entry[K, V] {
 	return &Entry[K, V]{
 		Key: e.Key.New().(K),
@@ -80,3 +89,12 @@ func (v *DummyVal) Size() int {return 0}
 func (v *DummyVal) IsNil() bool {return v == nil}
 func (v *DummyVal) MarshalBinary() ([]byte, error) {return nil, nil}
 func (v *DummyVal) UnmarshalBinary([]byte) error {return nil}
+
+type Uint64 uint64
+func (k *Uint64) New() EntryItem {return new(Uint64)}
+func (k *Uint64) Copy() EntryItem {cp := *k; return &cp}
+func (k *Uint64) Size() int {return 8}
+func (k *Uint64) IsNil() bool {return k == nil}
+func (k *Uint64) MarshalBinary() ([]byte, error) {buf := make([]byte, 8); bin.PutUint64(buf, uint64(*k)); return buf, nil}
+func (k *Uint64) UnmarshalBinary(d []byte) error {*k = Uint64(bin.Uint64(d)); return nil}
+func (k *Uint64) CompareTo(other *Uint64) int {return cmp.Compare(*k, *other)}
@@ -7,4 +7,23 @@ var ErrNotFound = errors.New("not found")
 var ErrNodeFetch = errors.New("failed to fetch node")
 var ErrInvalidPointer = errors.New("invalid pointer")
 var ErrInvalidKeySize = errors.New("invalid key size")
-var ErrKeyAlreadyExists = errors.New("key already exists")
\ No newline at end of file
+var ErrKeyAlreadyExists = errors.New("key already exists")
+var ErrCorrupted = errors.New("tree is corrupted")
+var ErrInvalidColor = errors.New("invalid node color")
+var ErrLocked = errors.New("tree is locked by another Open")
+var ErrReadOnly = errors.New("tree is opened read-only")
+var ErrNullPtrDelete = errors.New("refusing to delete null node")
+var ErrIncompatibleFormat = errors.New("tree file format is incompatible")
+var ErrTypeMismatch = errors.New("key or value size differs from tree file")
+var ErrTombstonesMismatch = errors.New("tombstones option differs from tree file")
+var ErrFileTooLarge = errors.New("tree file reached maximum size")
+var ErrNotEmpty = errors.New("tree is not empty")
+var ErrSnapshotReleased = errors.New("snapshot is released")
+var ErrUnsupported = errors.New("operation is not supported by tree options")
+var ErrSelfMerge = errors.New("tree can not be merged into itself")
+var ErrNotSorted = errors.New("entries are not sorted")
+var ErrIncompleteFlush = errors.New("last flush did not complete")
+var ErrCallbackPanic = errors.New("callback panicked")
+var ErrInvalidCompare = errors.New("Options.Compare does not match key type")
+var ErrChecksumMismatch = errors.New("page checksum mismatch")
+var ErrZeroValueSize = errors.New("value size is zero, set Options.KeyOnly for trees without values")
@@ -0,0 +1,172 @@
+package rbtree
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// exportHeaderSize is size of export stream header: seq, count, key size
+// and value size, followed by count marshaled entries in ascending order
+const exportHeaderSize = 16
+
+// importPrealloc bounds number of entries Import allocates room for ahead
+const importPrealloc = 1 << 16
+
+// ExportLatest flushes tree and writes all entries to w, returned seq is
+// the Seq the written state corresponds to. Writers are blocked while
+// export runs.
+func (tree *RBTree[K, V]) ExportLatest(w io.Writer) (seq uint64, err error) {
+	tree.mu.Lock()
+	defer tree.unlock(&err)
+
+	if err := tree.writeAll(); err != nil {
+		return 0, errors.Wrap(err, "failed to write all")
+	}
+
+	return tree.meta.seq, tree.export(w)
+}
+
+// Export writes all entries to w in ascending order, in the stream format
+// of ExportLatest. Unlike copying the tree file, the stream carries no free
+// space and does not depend on page layout. Import restores it.
+func (tree *RBTree[K, V]) Export(w io.Writer) (err error) {
+	tree.mu.RLock()
+	defer tree.runlockErr(&err)
+
+	return tree.export(w)
+}
+
+// Import reads stream written by Export or ExportLatest and bulk loads its
+// entries into tree, which must be empty. ErrTypeMismatch is returned if
+// stream key or value size differs from tree's, ErrCorrupted if header seq
+// is less than its count.
+func (tree *RBTree[K, V]) Import(r io.Reader) (err error) {
+	if tree.onOp != nil {
+		defer tree.observe(OpInsert, time.Now(), &err)
+	}
+
+	br := bufio.NewReader(r)
+
+	header := make([]byte, exportHeaderSize)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return errors.Wrap(err, "failed to read export header")
+	}
+	seq, count := bin.Uint64(header[0:8]), bin.Uint32(header[8:12])
+	kSize, vSize := bin.Uint16(header[12:14]), bin.Uint16(header[14:16])
+	if kSize != tree.meta.nodeKeySize || vSize != tree.meta.nodeValSize {
+		return errors.Wrapf(
+			ErrTypeMismatch, "stream key size:'%v', val size:'%v', tree key size:'%v', val size:'%v'",
+			kSize, vSize, tree.meta.nodeKeySize, tree.meta.nodeValSize,
+		)
+	}
+	// every entry took at least one change to insert
+	if seq < uint64(count) {
+		return errors.Wrapf(ErrCorrupted, "export header seq:'%v' is less than count:'%v'", seq, count)
+	}
+
+	var k K
+	var v V
+	// count is not trusted before entries are read, so it only bounds
+	// preallocation
+	entries := make([]*Entry[K, V], 0, min(count, importPrealloc))
+	buf := make([]byte, kSize + vSize)
+	for i := uint32(0); i < count; i++ {
+		if _, err := io.ReadFull(br, buf); err != nil {
+			return errors.Wrapf(err, "failed to read entry:'%v'", i)
+		}
+
+		e := &Entry[K, V]{k.New().(K), v.New().(V)}
+		if err := e.UnmarshalBinary(buf); err != nil {
+			return errors.Wrapf(err, "failed to unmarshal entry:'%v'", i)
+		}
+		entries = append(entries, e)
+	}
+
+	return errors.Wrap(tree.bulkLoadSorted(entries), "failed to bulk load entries")
+}
+
+// ExportJSON streams entries to w as JSON array of {"key": ..., "value": ...}
+// objects in ascending order. keyFn and valFn render keys and values into
+// JSON friendly values, nil fn marshals them as they are.
+func (tree *RBTree[K, V]) ExportJSON(w io.Writer, keyFn func(K) any, valFn func(V) any) (err error) {
+	tree.mu.RLock()
+	defer tree.runlockErr(&err)
+
+	type jsonEntry struct {
+		Key   any `json:"key"`
+		Value any `json:"value"`
+	}
+
+	bw := bufio.NewWriter(w)
+	if err := bw.WriteByte('['); err != nil {
+		return errors.Wrap(err, "failed to write json")
+	}
+	n := 0
+	_, err = tree.scan(ScanOpts[K]{}, 0, nil, func(e *Entry[K, V]) (bool, error) {
+		je := jsonEntry{Key: e.Key, Value: e.Val}
+		if keyFn != nil {
+			je.Key = keyFn(e.Key)
+		}
+		if valFn != nil {
+			je.Value = valFn(e.Val)
+		}
+
+		buf, err := json.Marshal(je)
+		if err != nil {
+			return true, errors.Wrapf(err, "failed to marshal entry, key:'%v'", e.Key)
+		}
+		if n > 0 {
+			buf = append([]byte{','}, buf...)
+		}
+		n++
+		_, err = bw.Write(buf)
+		return false, errors.Wrap(err, "failed to write json")
+	})
+	if err != nil {
+		return err
+	}
+	if err := bw.WriteByte(']'); err != nil {
+		return errors.Wrap(err, "failed to write json")
+	}
+	return errors.Wrap(bw.Flush(), "failed to flush json")
+}
+
+// Seq returns number of entry changes made since tree was created, every
+// insert, delete and revived tombstone advances it
+func (tree *RBTree[K, V]) Seq() uint64 {
+	tree.mu.RLock()
+	defer tree.runlock()
+
+	return tree.meta.seq
+}
+
+func (tree *RBTree[K, V]) export(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+
+	header := make([]byte, exportHeaderSize)
+	bin.PutUint64(header[0:8], tree.meta.seq)
+	bin.PutUint32(header[8:12], tree.meta.count - tree.meta.tombstones)
+	bin.PutUint16(header[12:14], tree.meta.nodeKeySize)
+	bin.PutUint16(header[14:16], tree.meta.nodeValSize)
+	if _, err := bw.Write(header); err != nil {
+		return errors.Wrap(err, "failed to write export header")
+	}
+
+	_, err := tree.scan(ScanOpts[K]{}, 0, nil, func(e *Entry[K, V]) (bool, error) {
+		buf, err := e.MarshalBinary()
+		if err != nil {
+			return true, errors.Wrap(err, "failed to marshal entry")
+		}
+
+		_, err = bw.Write(buf)
+		return false, errors.Wrap(err, "failed to write entry")
+	})
+	if err != nil {
+		return err
+	}
+	return errors.Wrap(bw.Flush(), "failed to flush export")
+}
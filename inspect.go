@@ -0,0 +1,59 @@
+package rbtree
+
+import (
+	"io"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// FileInfo describes tree file without opening it as a tree
+type FileInfo struct {
+	PageSize    uint16
+	NodeKeySize uint16 // marshaled key size, K.Size() of tree
+	NodeValSize uint16 // marshaled value size, V.Size() of tree
+	Count       int    // live entries, tombstones excluded
+	Tombstones  bool   // file was created with Options.Tombstones
+	CreatedAt   time.Time
+	ModifiedAt  time.Time
+}
+
+// Inspect reads metadata of tree file named as in Open with default options,
+// caller does not need to know K and V. Use InspectFile for trees opened
+// with FileSuffix or ExactFileName. File is opened read-only and is not locked, so metadata of a tree open
+// elsewhere may be behind its in-memory state.
+func Inspect(fileName string) (FileInfo, error) {
+	return InspectFile((&Options{}).indexFile(fileName))
+}
+
+// InspectFile is Inspect taking full path of tree file
+func InspectFile(path string) (FileInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return FileInfo{}, errors.Wrap(err, "failed to open tree file")
+	}
+	defer f.Close()
+
+	buf := make([]byte, metadataSize)
+	if _, err := io.ReadFull(f, buf); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return FileInfo{}, errors.Wrap(ErrCorrupted, "file is shorter than metadata")
+	} else if err != nil {
+		return FileInfo{}, errors.Wrap(err, "failed to read metadata")
+	}
+
+	meta := &metadata{}
+	if err := meta.UnmarshalBinary(buf); err != nil {
+		return FileInfo{}, errors.Wrap(err, "failed to unmarshal metadata")
+	}
+
+	return FileInfo{
+		PageSize:    meta.pageSize,
+		NodeKeySize: meta.nodeKeySize,
+		NodeValSize: meta.nodeValSize,
+		Count:       int(meta.count - meta.tombstones),
+		Tombstones:  meta.hasFlag(META_TOMBSTONES),
+		CreatedAt:   unixNanoTime(meta.createdAt),
+		ModifiedAt:  unixNanoTime(meta.modifiedAt),
+	}, nil
+}
@@ -0,0 +1,162 @@
+package rbtree
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+)
+
+// Iterator returns pull-based iterator over all entries, see
+// IteratorContext. Iterator holds tree read lock until Close is called.
+func (tree *RBTree[K, V]) Iterator() *Iterator[K, V] {
+	var start K
+	return tree.IteratorContext(context.Background(), start)
+}
+
+// IteratorContext returns pull-based iterator over entries greater or equal
+// to start in ascending order, or over all entries when start is nil.
+// Iterator holds tree read lock until Close is called, so Close must always
+// be called. Iteration stops with ctx.Err() when ctx is done.
+func (tree *RBTree[K, V]) IteratorContext(ctx context.Context, start K) *Iterator[K, V] {
+	tree.mu.RLock()
+
+	return &Iterator[K, V]{
+		ctx:    ctx,
+		tree:   tree,
+		cursor: tree.newCursor(),
+		start:  start,
+	}
+}
+
+type Iterator[K, V EntryItem] struct {
+	ctx     context.Context
+	tree    *RBTree[K, V]
+	cursor  *cursor[K, V]
+	start   K
+	entry   *Entry[K, V]
+	started bool
+	before  bool // cursor moved past the smallest entry
+	closed  bool
+	err     error
+}
+
+// Seek repositions iterator, so Next moves it to the smallest entry greater
+// or equal to key and Prev to the greatest entry less than key
+func (it *Iterator[K, V]) Seek(key K) {
+	it.entry = nil
+	it.start = key
+	it.started = false
+	it.before = false
+}
+
+// Next moves iterator to the next entry and reports whether there is one
+func (it *Iterator[K, V]) Next() bool {
+	defer it.catch()
+	if !it.ready() {
+		return false
+	}
+
+	if !it.started {
+		it.started = true
+		if it.start.IsNil() {
+			it.cursor.first()
+		} else if _, err := it.cursor.seek(it.start); err != nil {
+			it.err = errors.Wrap(err, "failed to seek start key")
+			return false
+		}
+	} else if it.cursor.valid() {
+		it.cursor.next()
+	} else if it.before {
+		it.cursor.first()
+	}
+
+	return it.settle(false)
+}
+
+// Prev moves iterator to the previous entry and reports whether there is
+// one. After the end is reached Prev returns the greatest entry.
+func (it *Iterator[K, V]) Prev() bool {
+	defer it.catch()
+	if !it.ready() {
+		return false
+	}
+
+	if !it.started {
+		it.started = true
+		if it.start.IsNil() {
+			it.cursor.last()
+		} else if ok, err := it.cursor.seek(it.start); err != nil {
+			it.err = errors.Wrap(err, "failed to seek start key")
+			return false
+		} else if ok {
+			it.cursor.prev()
+		} else {
+			it.cursor.last()
+		}
+	} else if it.cursor.valid() {
+		it.cursor.prev()
+	} else if !it.before {
+		it.cursor.last()
+	}
+
+	return it.settle(true)
+}
+
+// catch stores failed fetch as iterator error
+func (it *Iterator[K, V]) catch() {
+	if r := recover(); r != nil {
+		it.err = fetchFailure(r)
+		it.entry = nil
+	}
+}
+
+// ready reports whether iterator may move
+func (it *Iterator[K, V]) ready() bool {
+	it.entry = nil
+	if it.closed || it.err != nil {
+		return false
+	}
+
+	if err := it.ctx.Err(); err != nil {
+		it.err = err
+		return false
+	}
+	return true
+}
+
+// settle skips tombstones in given direction and sets current entry
+func (it *Iterator[K, V]) settle(reverse bool) bool {
+	for it.cursor.valid() && it.cursor.node().isTombstone() {
+		it.cursor.step(reverse)
+	}
+
+	if !it.cursor.valid() {
+		it.before = reverse
+		return false
+	}
+
+	it.entry = it.cursor.node().entry
+	return true
+}
+
+// Entry returns current entry, it is valid until the next call to Next or
+// Close and must not be modified.
+func (it *Iterator[K, V]) Entry() *Entry[K, V] {
+	return it.entry
+}
+
+func (it *Iterator[K, V]) Err() error {
+	return it.err
+}
+
+// Close releases tree read lock, it is safe to call Close multiple times
+func (it *Iterator[K, V]) Close() {
+	if it.closed {
+		return
+	}
+
+	it.closed = true
+	it.entry = nil
+	it.cursor.release()
+	it.tree.runlock()
+}
@@ -0,0 +1,14 @@
+//go:build !unix
+
+package rbtree
+
+import "os"
+
+// lockFile is no-op on platforms without flock
+func lockFile(fileName string, mode os.FileMode, shared bool) (*os.File, error) {
+	return nil, nil
+}
+
+func unlockFile(f *os.File) error {
+	return nil
+}
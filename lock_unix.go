@@ -0,0 +1,41 @@
+//go:build unix
+
+package rbtree
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// lockFile takes advisory lock on file, exclusive or shared, failing with
+// ErrLocked instead of blocking when it conflicts with lock of other Open
+func lockFile(fileName string, mode os.FileMode, shared bool) (*os.File, error) {
+	f, err := os.OpenFile(fileName, os.O_CREATE|os.O_RDWR, mode)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open lock file")
+	}
+
+	how := syscall.LOCK_EX
+	if shared {
+		how = syscall.LOCK_SH
+	}
+
+	if err := syscall.Flock(int(f.Fd()), how|syscall.LOCK_NB); err != nil {
+		_ = f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, ErrLocked
+		}
+		return nil, errors.Wrap(err, "failed to lock file")
+	}
+	return f, nil
+}
+
+func unlockFile(f *os.File) error {
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_UN); err != nil {
+		_ = f.Close()
+		return errors.Wrap(err, "failed to unlock file")
+	}
+	return f.Close()
+}
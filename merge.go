@@ -0,0 +1,88 @@
+package rbtree
+
+import (
+	"time"
+	"unsafe"
+
+	"github.com/pkg/errors"
+)
+
+// MergeFrom inserts entries of other into tree in one pass under tree write
+// lock, writing changes to disk once at the end. When key exists in both,
+// onConflict gets copies of both entries and value of returned entry is
+// stored, nil keeps existing one. Nil onConflict fails on first conflict
+// with ErrKeyAlreadyExists. merged is number of entries inserted or updated.
+// Merging tree into itself fails with ErrSelfMerge.
+func (tree *RBTree[K, V]) MergeFrom(
+	other *RBTree[K, V],
+	onConflict func(existing, incoming *Entry[K, V]) *Entry[K, V],
+) (merged int, err error) {
+	if tree.onOp != nil {
+		defer tree.observe(OpInsert, time.Now(), &err)
+	}
+
+	if other == tree {
+		return 0, ErrSelfMerge
+	} else if other.meta.nodeKeySize != tree.meta.nodeKeySize || other.meta.nodeValSize != tree.meta.nodeValSize {
+		return 0, errors.Wrapf(
+			ErrTypeMismatch, "other key size:'%v', val size:'%v', tree key size:'%v', val size:'%v'",
+			other.meta.nodeKeySize, other.meta.nodeValSize, tree.meta.nodeKeySize, tree.meta.nodeValSize,
+		)
+	}
+
+	merged, err = tree.mergeMem(other, onConflict)
+	if merged > 0 {
+		if persistErr := tree.persist(); err == nil {
+			err = persistErr
+		}
+	}
+	return merged, err
+}
+
+func (tree *RBTree[K, V]) mergeMem(
+	other *RBTree[K, V],
+	onConflict func(existing, incoming *Entry[K, V]) *Entry[K, V],
+) (merged int, err error) {
+	// locks are taken in address order, so concurrent a.MergeFrom(b) and
+	// b.MergeFrom(a) do not deadlock
+	if uintptr(unsafe.Pointer(other)) < uintptr(unsafe.Pointer(tree)) {
+		other.mu.RLock()
+		defer other.runlockErr(&err)
+		tree.mu.Lock()
+		defer tree.unlock(&err)
+	} else {
+		tree.mu.Lock()
+		defer tree.unlock(&err)
+		other.mu.RLock()
+		defer other.runlockErr(&err)
+	}
+
+	if tree.readOnly {
+		return 0, ErrReadOnly
+	}
+
+	_, err = other.scan(ScanOpts[K]{}, 0, nil, func(e *Entry[K, V]) (bool, error) {
+		err := tree.insertEntry(e)
+		if err != ErrKeyAlreadyExists {
+			if err == nil {
+				merged++
+			}
+			return err != nil, errors.Wrapf(err, "failed to insert entry, key:'%v'", e.Key)
+		} else if onConflict == nil {
+			return true, errors.Wrapf(err, "key:'%v'", e.Key)
+		}
+
+		existing, err := tree.lookup(e.Key)
+		if err != nil {
+			return true, errors.Wrapf(err, "failed to get existing entry, key:'%v'", e.Key)
+		}
+		if resolved := onConflict(existing.Copy(), e.Copy()); resolved != nil {
+			if err := tree.updateVal(e.Key, resolved.Val); err != nil {
+				return true, errors.Wrapf(err, "failed to update entry, key:'%v'", e.Key)
+			}
+			merged++
+		}
+		return false, nil
+	})
+	return merged, err
+}
@@ -1,6 +1,24 @@
 package rbtree
 
-const metadataSize = 22
+import "github.com/pkg/errors"
+
+const metadataSize = 64
+
+// metaMagic marks page 0 of tree files, files written before it have zeros
+const metaMagic uint32 = 0x52425452 // "RBTR"
+
+// metaVersion is format version written to new files, files with greater
+// version are refused
+const metaVersion byte = 1
+
+type metaFlag byte
+
+const (
+	META_TOMBSTONES  metaFlag = 0b00000001 // nodes carry deletion stamp
+	META_GENERATIONS metaFlag = 0b00000010 // pages end with generation they were written in
+	META_SIZES       metaFlag = 0b00000100 // nodes carry number of live entries in their subtree
+	META_CHECKSUMS   metaFlag = 0b00001000 // pages carry CRC32 of their content
+)
 
 type metadata struct {
 	dirty bool
@@ -12,6 +30,18 @@ type metadata struct {
 	rootPtr     uint32
 	nullPtr     uint32
 	count       uint32
+	createdAt   int64 // unix nanos
+	modifiedAt  int64 // unix nanos of the last metadata write
+	tombstones  uint32 // number of nodes marked deleted, included in count
+	flags       metaFlag // layout options fixed when tree is created
+	seq         uint64 // number of entry changes since creation
+	generation  uint64 // last flush whose pages were all written
+	magic       uint32 // metaMagic, zero in files written before it
+	version     byte
+}
+
+func (m *metadata) hasFlag(f metaFlag) bool {
+	return m.flags&f != 0
 }
 
 func (m *metadata) MarshalBinary() ([]byte, error) {
@@ -23,6 +53,14 @@ func (m *metadata) MarshalBinary() ([]byte, error) {
 	bin.PutUint32(buf[10:14], m.rootPtr)
 	bin.PutUint32(buf[14:18], m.nullPtr)
 	bin.PutUint32(buf[18:22], m.count)
+	bin.PutUint64(buf[22:30], uint64(m.createdAt))
+	bin.PutUint64(buf[30:38], uint64(m.modifiedAt))
+	bin.PutUint32(buf[38:42], m.tombstones)
+	buf[42] = byte(m.flags)
+	bin.PutUint64(buf[43:51], m.seq)
+	bin.PutUint64(buf[51:59], m.generation)
+	bin.PutUint32(buf[59:63], metaMagic)
+	buf[63] = metaVersion
 	return buf, nil
 }
 
@@ -34,5 +72,31 @@ func (m *metadata) UnmarshalBinary(d []byte) error {
 	m.rootPtr = bin.Uint32(d[10:14])
 	m.nullPtr = bin.Uint32(d[14:18])
 	m.count = bin.Uint32(d[18:22])
+	m.createdAt = int64(bin.Uint64(d[22:30]))
+	m.modifiedAt = int64(bin.Uint64(d[30:38]))
+	m.tombstones = bin.Uint32(d[38:42])
+	m.flags = metaFlag(d[42])
+	m.seq = bin.Uint64(d[43:51])
+	m.generation = bin.Uint64(d[51:59])
+	m.magic = bin.Uint32(d[59:63])
+	m.version = d[63]
+	return nil
+}
+
+// checkFormat returns ErrIncompatibleFormat if file can't be read with given
+// page size and ErrTypeMismatch if its key or value size differs
+func (m *metadata) checkFormat(pageSize, keySize, valSize uint16) error {
+	if m.magic != 0 && m.magic != metaMagic {
+		return errors.Wrapf(ErrIncompatibleFormat, "not a tree file, magic:'%#x'", m.magic)
+	} else if m.version > metaVersion {
+		return errors.Wrapf(ErrIncompatibleFormat, "version:'%v', supported:'%v'", m.version, metaVersion)
+	} else if m.pageSize != pageSize {
+		return errors.Wrapf(ErrIncompatibleFormat, "file page size:'%v', opened with:'%v'", m.pageSize, pageSize)
+	} else if m.nodeKeySize != keySize || m.nodeValSize != valSize {
+		return errors.Wrapf(
+			ErrTypeMismatch, "file key/value sizes:'%v/%v', opened with:'%v/%v'",
+			m.nodeKeySize, m.nodeValSize, keySize, valSize,
+		)
+	}
 	return nil
 }
@@ -4,6 +4,12 @@ import "github.com/pkg/errors"
 
 const nodeFixedSize = 13
 
+// size of deletion stamp following every node in trees with tombstones
+const tombstoneSize = 8
+
+// size of subtree size following entry of every node in trees with META_SIZES
+const subtreeSizeSize = 4
+
 func newNode[K, V EntryItem](ptr uint32, e *Entry[K, V]) *node[K, V] {
 	return &node[K, V]{
 		dirty: true,
@@ -18,23 +24,56 @@ type flagVaue byte
 const (
 	FV_COLOR_BLACK flagVaue = 0b00000000
 	FV_COLOR_RED   flagVaue = 0b00000001
+	FV_TOMBSTONE   flagVaue = 0b00000010
 )
 
 type flagType byte
 
 const (
-	FT_COLOR flagType = 0
+	FT_COLOR     flagType = 0
+	FT_TOMBSTONE flagType = 1
 )
 
 type node[K, V EntryItem] struct {
 	dirty bool
 	ptr   uint32
+	page  *page[K, V] // page holding node, notified when node gets dirty
+
+	left      uint32
+	right     uint32
+	parent    uint32
+	entry     *Entry[K, V]
+	flags     flagVaue
+	deletedAt int64 // unix nanos, set for tombstones
+	size      uint32 // live entries in subtree, kept in trees with META_SIZES
+	rawKey    []byte // marshaled key of rawFor, so comparisons skip marshaling
+	rawFor    *Entry[K, V]
+}
+
+func (n *node[K, V]) markDirty() {
+	n.dirty = true
+	if n.page != nil {
+		n.page.markDirty()
+	}
+}
+
+// setEntry replaces node entry caching its marshaled key
+func (n *node[K, V]) setEntry(e *Entry[K, V]) {
+	n.markDirty()
+	n.entry = e
+	n.rawFor = nil
+	if raw, err := e.Key.MarshalBinary(); err == nil {
+		n.rawKey, n.rawFor = raw, e
+	}
+}
 
-	left   uint32
-	right  uint32
-	parent uint32
-	entry  *Entry[K, V]
-	flags  flagVaue
+// cachedKey returns marshaled key of node entry or nil if it was changed
+// after caching
+func (n *node[K, V]) cachedKey() []byte {
+	if n.rawFor != n.entry {
+		return nil
+	}
+	return n.rawKey
 }
 
 func (n *node[K, V]) isBlack() bool {
@@ -46,17 +85,31 @@ func (n *node[K, V]) isRed() bool {
 }
 
 func (n *node[K, V]) setBlack() {
-	n.dirty = true
+	n.markDirty()
 	n.setFlag(FT_COLOR, FV_COLOR_BLACK)
 }
 
 func (n *node[K, V]) setRed() {
-	n.dirty = true
+	n.markDirty()
 	n.setFlag(FT_COLOR, FV_COLOR_RED)
 }
 
+func (n *node[K, V]) isTombstone() bool {
+	return n.getFlag(FT_TOMBSTONE) == FV_TOMBSTONE
+}
+
+func (n *node[K, V]) setTombstone(deletedAt int64) {
+	n.setFlag(FT_TOMBSTONE, FV_TOMBSTONE)
+	n.deletedAt = deletedAt
+}
+
+func (n *node[K, V]) clearTombstone() {
+	n.setFlag(FT_TOMBSTONE, 0)
+	n.deletedAt = 0
+}
+
 func (n *node[K, V]) setFlag(ft flagType, fv flagVaue) {
-	n.dirty = true
+	n.markDirty()
 	mask := ^(byte(1) << ft)
 	mask &= byte(n.flags)
 	n.flags = flagVaue(mask) | fv
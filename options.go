@@ -1,5 +1,161 @@
 package rbtree
 
+import (
+	"os"
+	"time"
+)
+
+// operation names passed to Options.OnOp
+const (
+	OpInsert   = "insert"
+	OpGet      = "get"
+	OpDelete   = "delete"
+	OpUpdate   = "update"
+	OpScan     = "scan"
+	OpWriteAll = "writeAll"
+	OpCompact  = "compact"
+)
+
+// AllocStrategy decides which slot a newly inserted node takes
+type AllocStrategy int
+
+const (
+	// AllocSequential places new node in the next free slot
+	AllocSequential AllocStrategy = iota
+
+	// AllocNearParent moves new node to its parent's page when that page
+	// holds a node whose own parent is elsewhere, so traversals touch fewer
+	// pages at the cost of a few extra writes per insert
+	AllocNearParent
+)
+
+// levels passed to Options.Logger
+const (
+	LogDebug = "debug"
+	LogError = "error"
+)
+
 type Options struct {
 	PageSize uint16
+
+	// FileMode of created tree file, 0664 if zero
+	FileMode os.FileMode
+
+	// FileSuffix appended to file name passed to Open, ".idx" if empty
+	FileSuffix string
+
+	// ExactFileName uses file name passed to Open as is, without suffix
+	ExactFileName bool
+
+	// CreateDir creates missing parent directories of tree file
+	CreateDir bool
+
+	// CompareBytes orders keys by their marshaled form, bytes.Compare is used
+	// when nil. Must be the same every time the file is opened.
+	CompareBytes func(a, b []byte) int
+
+	// Compare orders typed keys directly, it must be func(a, b K) int for
+	// key type K of opened tree, Open fails with ErrInvalidCompare otherwise.
+	// Takes precedence over CompareBytes and must be the same every time the
+	// file is opened.
+	Compare any
+
+	// KeyOnly must be set for trees with zero size values (like Set), Open
+	// otherwise fails with ErrZeroValueSize to catch misdefined V
+	KeyOnly bool
+
+	// ReadOnly opens existing tree for reading only, changing operations fail
+	// with ErrReadOnly and nothing is written to file. Any number of read-only
+	// Opens of a file may coexist, but not with a writing one.
+	ReadOnly bool
+
+	// IgnoreIncompleteFlush opens tree even if its last flush did not
+	// complete, instead of failing with ErrIncompleteFlush. Tree may be
+	// inconsistent then, it is meant for salvaging entries with Repair.
+	IgnoreIncompleteFlush bool
+
+	// VerifyChecksums checks every page read from file against its CRC32,
+	// corrupted page then fails with ErrChecksumMismatch. Checksums are
+	// always written, files created before them are not verified.
+	VerifyChecksums bool
+
+	// WAL logs every flush to '<fileName>.wal' before writing tree file and
+	// fsyncs both, so flush interrupted by crash is redone by the next Open.
+	// Flushes are slower, Open replays log left by crash before reading tree.
+	WAL bool
+
+	// VerifyOnOpen runs Validate before returning from Open, which visits
+	// every node and is expensive for large trees
+	VerifyOnOpen bool
+
+	// AllowDuplicates lets Insert add keys already present, equal keys are
+	// kept in insertion order. Get returns the first of them, GetAll all of
+	// them and Delete removes the first one. Scans visit every duplicate.
+	AllowDuplicates bool
+
+	// Tombstones makes Delete mark entries deleted instead of removing them.
+	// Tombstones are hidden from reads, listed by ScanTombstones and removed
+	// by PurgeTombstones. Every node then takes 8 more bytes, so the option
+	// is fixed when tree file is created.
+	Tombstones bool
+
+	// ExpectedPages presizes page cache for that many pages, so warming up
+	// a large tree doesn't grow it repeatedly
+	ExpectedPages int
+
+	// MaxCachedPages bounds page cache, least recently used clean pages are
+	// evicted when an operation ends with more pages cached. Dirty pages are
+	// kept until written. No limit if zero.
+	MaxCachedPages int
+
+	// AsyncWrites makes Insert, Delete and other writing operations return
+	// once tree is changed in memory, writing to disk is done in background.
+	// Reads always see completed writes. Close waits for pending writes.
+	AsyncWrites bool
+
+	// NoAutoSync makes Insert, Delete and other writing operations behave
+	// like their *Mem variants, changes are written by Sync, WriteAll or
+	// Close only. NoCache still writes through when operation ends.
+	NoAutoSync bool
+
+	// NoCache keeps pages in memory only while an operation runs. Changes
+	// are written through when the operation ends, reads go to the file
+	// (and OS page cache) every time. Saves memory at the cost of speed.
+	NoCache bool
+
+	// StrictBatch makes InsertBatch fail with ErrKeyAlreadyExists on the
+	// first existing key instead of skipping it
+	StrictBatch bool
+
+	// AllocStrategy used to place inserted nodes, AllocSequential if zero
+	AllocStrategy AllocStrategy
+
+	// Logger receives debug messages about page cache misses and evictions,
+	// flushes and rebalancing, and errors of modifying operations. kv holds
+	// alternating keys and values.
+	Logger func(level, msg string, kv ...any)
+
+	// OnOp is called at the end of operation with its name, elapsed time and
+	// returned error. Reported are Get, GetAll, GetMany, scans, operations
+	// writing changes to disk (single, batch and range inserts, updates and
+	// deletes, pops, Clear, BulkLoad, Import, MergeFrom, PurgeTombstones,
+	// Compact) and WriteAll, Sync and FlushN. InsertMem, DeleteMem and
+	// other in-memory variants are not reported.
+	OnOp func(op string, dur time.Duration, err error)
+}
+
+func (opts *Options) indexFile(fileName string) string {
+	if opts.ExactFileName {
+		return fileName
+	} else if opts.FileSuffix == "" {
+		return fileName + ".idx"
+	}
+	return fileName + opts.FileSuffix
+}
+
+func (opts *Options) fileMode() os.FileMode {
+	if opts.FileMode == 0 {
+		return 0664
+	}
+	return opts.FileMode
 }
@@ -1,41 +1,163 @@
 package rbtree
 
+import (
+	"hash/crc32"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// pageTrailerSize is size of generation stored at the end of every page of
+// trees with META_GENERATIONS flag
+const pageTrailerSize = 8
+
+// checksumSize is size of CRC32 stored before generation trailer in trees
+// with META_CHECKSUMS flag
+const checksumSize = 4
+
 type page[K, V EntryItem] struct {
 	dirty       bool
 	id          uint32
 	size        uint16
 	nodeNullPtr uint32
 	entry       *Entry[K, V]
+	tombstones  bool // nodes are followed by deletion stamp
+	cache       *pageCache[K, V] // tracks dirty pages, may be nil
+	generations bool // page ends with generation trailer
+	generation  uint64 // flush generation page was last written in
+	sizes       bool // nodes carry subtree size after entry
+	checksums   bool // page carries CRC32 of the rest of its bytes
+	verify      bool // checksum is verified on read
+	used        atomic.Uint64 // page cache clock of the last access
 
 	nodes []*node[K, V]
 }
 
+func (p *page[K, V]) isDirty() bool {
+	return p.dirty
+}
+
+func (p *page[K, V]) markDirty() {
+	if p.dirty {
+		return
+	}
+
+	p.dirty = true
+	if p.cache != nil {
+		p.cache.markDirty(p)
+	}
+}
+
+func (p *page[K, V]) clean() {
+	p.dirty = false
+	for _, n := range p.nodes {
+		n.dirty = false
+	}
+	if p.cache != nil {
+		p.cache.markClean(p.id)
+	}
+}
+
 func (p *page[K, V]) MarshalBinary() ([]byte, error) {
 	buf := make([]byte, p.size)
+	nodeSize := p.nodeSize()
 	for i, n := range p.nodes {
 		if b, err := n.MarshalBinary(); err != nil {
 			return nil, err
 		} else {
-			copy(buf[i*len(b):(i+1)*len(b)], b)
+			copy(buf[i*nodeSize:], b)
 		}
+
+		if p.sizes {
+			bin.PutUint32(buf[i*nodeSize+nodeFixedSize+p.entry.Size():], n.size)
+		}
+		if p.tombstones {
+			bin.PutUint64(buf[(i+1)*nodeSize-tombstoneSize:], uint64(n.deletedAt))
+		}
+	}
+	if p.generations {
+		bin.PutUint64(buf[len(buf)-pageTrailerSize:], p.generation)
+	}
+	if p.checksums {
+		off := p.checksumOffset()
+		bin.PutUint32(buf[off:], checksum(buf, off))
 	}
 	return buf, nil
 }
 
 func (p *page[K, V]) UnmarshalBinary(d []byte) error {
+	if p.checksums && p.verify {
+		off := p.checksumOffset()
+		// pages allocated but never written are all zeros
+		if sum := bin.Uint32(d[off:]); sum != checksum(d, off) && (sum != 0 || !zeroed(d)) {
+			return errors.Wrapf(ErrChecksumMismatch, "page:'%v'", p.id)
+		}
+	}
+
 	pageOffset := p.id * uint32(p.size)
-	nodeSize := nodeFixedSize + p.entry.Size()
+	nodeSize := p.nodeSize()
+	keySize := p.entry.Key.Size()
+	rawKeys := make([]byte, len(p.nodes) * keySize)
 	for i := range p.nodes {
 		e := p.entry.new()
 		n := newNode(pageOffset+uint32(i*nodeSize), e)
 		n.dirty = false
+		n.page = p
 
 		err := n.UnmarshalBinary(d[i*nodeSize : (i+1)*nodeSize])
 		if err != nil {
 			return err
 		}
 
+		n.rawKey = rawKeys[i*keySize : (i+1)*keySize : (i+1)*keySize]
+		n.rawFor = e
+		copy(n.rawKey, d[i*nodeSize+nodeFixedSize:])
+
+		if p.sizes {
+			n.size = bin.Uint32(d[i*nodeSize+nodeFixedSize+p.entry.Size():])
+		}
+		if p.tombstones {
+			n.deletedAt = int64(bin.Uint64(d[(i+1)*nodeSize-tombstoneSize:]))
+		}
+
 		p.nodes[i] = n
 	}
+	if p.generations {
+		p.generation = bin.Uint64(d[len(d)-pageTrailerSize:])
+	}
 	return nil
 }
+
+// checksumOffset returns position of CRC32 in page
+func (p *page[K, V]) checksumOffset() int {
+	if p.generations {
+		return int(p.size) - pageTrailerSize - checksumSize
+	}
+	return int(p.size) - checksumSize
+}
+
+// checksum returns CRC32 of page bytes except the checksum at off
+func checksum(d []byte, off int) uint32 {
+	sum := crc32.ChecksumIEEE(d[:off])
+	return crc32.Update(sum, crc32.IEEETable, d[off+checksumSize:])
+}
+
+func zeroed(d []byte) bool {
+	for _, b := range d {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (p *page[K, V]) nodeSize() int {
+	size := nodeFixedSize + p.entry.Size()
+	if p.sizes {
+		size += subtreeSizeSize
+	}
+	if p.tombstones {
+		size += tombstoneSize
+	}
+	return size
+}
@@ -17,6 +17,7 @@ type Stack[T interface{}] interface {
 	Pop() T
 	Top() T
 	Size() int
+	Clear()
 }
 
 func New[T interface{}](initialSize int) Stack[T] {
@@ -62,3 +63,11 @@ func (s *stack[T]) Size() int {
 
 	return len(s.s)
 }
+
+// Clear removes all values keeping allocated capacity
+func (s *stack[T]) Clear() {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	s.s = s.s[:0]
+}
@@ -0,0 +1,102 @@
+package tsindex
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	"github.com/vahagz/rbtree"
+)
+
+// TimeIndex is a time-series index over rbtree keyed by uint64 timestamps.
+// Only one value is stored per timestamp.
+type TimeIndex[V rbtree.EntryItem] struct {
+	tree *rbtree.RBTree[*rbtree.Uint64, V]
+}
+
+func Open[V rbtree.EntryItem](fileName string, opts *rbtree.Options) (*TimeIndex[V], error) {
+	tree, err := rbtree.Open[*rbtree.Uint64, V](fileName, opts)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open time index")
+	}
+	return &TimeIndex[V]{tree}, nil
+}
+
+// Tree returns underlying tree
+func (idx *TimeIndex[V]) Tree() *rbtree.RBTree[*rbtree.Uint64, V] {
+	return idx.tree
+}
+
+func (idx *TimeIndex[V]) Add(ts uint64, v V) error {
+	return idx.tree.Insert(&rbtree.Entry[*rbtree.Uint64, V]{
+		Key: key(ts),
+		Val: v,
+	})
+}
+
+// Between calls fn for every entry with timestamp in [from, to] in ascending order
+func (idx *TimeIndex[V]) Between(from, to uint64, fn func(ts uint64, v V) (bool, error)) error {
+	it := idx.tree.IteratorContext(context.Background(), key(from))
+	defer it.Close()
+
+	for it.Next() {
+		ts := uint64(*it.Entry().Key)
+		if ts > to {
+			return nil
+		}
+
+		if stop, err := fn(ts, it.Entry().Val); stop || err != nil {
+			return err
+		}
+	}
+	return errors.Wrap(it.Err(), "failed to iterate entries")
+}
+
+func (idx *TimeIndex[V]) Oldest() (uint64, V, error) {
+	e, err := idx.tree.Min()
+	if err != nil {
+		var val V
+		return 0, val, err
+	}
+	return uint64(*e.Key), e.Val, nil
+}
+
+func (idx *TimeIndex[V]) Latest() (uint64, V, error) {
+	e, err := idx.tree.Max()
+	if err != nil {
+		var val V
+		return 0, val, err
+	}
+	return uint64(*e.Key), e.Val, nil
+}
+
+// ExpireBefore deletes all entries with timestamp less than ts and returns
+// number of deleted entries.
+func (idx *TimeIndex[V]) ExpireBefore(ts uint64) (int, error) {
+	expired := []*rbtree.Uint64{}
+	err := idx.tree.Scan(nil, func(k *rbtree.Uint64, v V) (bool, error) {
+		if uint64(*k) >= ts {
+			return true, nil
+		}
+		expired = append(expired, key(uint64(*k)))
+		return false, nil
+	})
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to scan expired entries")
+	}
+
+	for i, k := range expired {
+		if err := idx.tree.DeleteMem(k); err != nil {
+			return i, errors.Wrap(err, "failed to delete expired entry")
+		}
+	}
+	return len(expired), errors.Wrap(idx.tree.WriteAll(), "failed to write all")
+}
+
+func (idx *TimeIndex[V]) Close() error {
+	return idx.tree.Close()
+}
+
+func key(ts uint64) *rbtree.Uint64 {
+	k := rbtree.Uint64(ts)
+	return &k
+}
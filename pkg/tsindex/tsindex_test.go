@@ -0,0 +1,126 @@
+package tsindex
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vahagz/rbtree"
+)
+
+func openTestIndex(t *testing.T, timestamps ...uint64) *TimeIndex[*rbtree.Uint64] {
+	t.Helper()
+
+	idx, err := Open[*rbtree.Uint64](
+		path.Join(t.TempDir(), "tsindex_test"),
+		&rbtree.Options{PageSize: uint16(os.Getpagesize())},
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() { idx.Close() })
+
+	for _, ts := range timestamps {
+		require.NoError(t, idx.Add(ts, key(ts*10)))
+	}
+	return idx
+}
+
+func TestAdd(t *testing.T) {
+	idx := openTestIndex(t, 5)
+	require.ErrorIs(t, idx.Add(5, key(0)), rbtree.ErrKeyAlreadyExists)
+	require.Equal(t, 1, idx.Tree().Count())
+}
+
+func TestBetween(t *testing.T) {
+	idx := openTestIndex(t, 50, 10, 40, 20, 30)
+
+	tests := []struct {
+		name     string
+		from, to uint64
+		limit    int
+		expected []uint64
+	}{
+		{"all", 0, 100, 0, []uint64{10, 20, 30, 40, 50}},
+		{"inclusive bounds", 20, 40, 0, []uint64{20, 30, 40}},
+		{"bounds between keys", 15, 45, 0, []uint64{20, 30, 40}},
+		{"single", 30, 30, 0, []uint64{30}},
+		{"empty", 31, 39, 0, []uint64{}},
+		{"after last", 51, 100, 0, []uint64{}},
+		{"stop early", 0, 100, 2, []uint64{10, 20}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := []uint64{}
+			require.NoError(t, idx.Between(tt.from, tt.to, func(ts uint64, v *rbtree.Uint64) (bool, error) {
+				require.Equal(t, ts*10, uint64(*v))
+				got = append(got, ts)
+				return len(got) == tt.limit, nil
+			}))
+			require.Equal(t, tt.expected, got)
+		})
+	}
+}
+
+func TestOldestLatest(t *testing.T) {
+	tests := []struct {
+		name           string
+		timestamps     []uint64
+		oldest, latest uint64
+		err            error
+	}{
+		{"empty", nil, 0, 0, rbtree.ErrNotFound},
+		{"single", []uint64{7}, 7, 7, nil},
+		{"unordered", []uint64{30, 10, 50, 20}, 10, 50, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			idx := openTestIndex(t, tt.timestamps...)
+
+			ts, v, err := idx.Oldest()
+			require.ErrorIs(t, err, tt.err)
+			if tt.err == nil {
+				require.Equal(t, tt.oldest, ts)
+				require.Equal(t, tt.oldest*10, uint64(*v))
+			}
+
+			ts, v, err = idx.Latest()
+			require.ErrorIs(t, err, tt.err)
+			if tt.err == nil {
+				require.Equal(t, tt.latest, ts)
+				require.Equal(t, tt.latest*10, uint64(*v))
+			}
+		})
+	}
+}
+
+func TestExpireBefore(t *testing.T) {
+	tests := []struct {
+		name      string
+		before    uint64
+		deleted   int
+		remaining []uint64
+	}{
+		{"nothing", 10, 0, []uint64{10, 20, 30}},
+		{"some", 25, 2, []uint64{30}},
+		{"all", 31, 3, []uint64{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			idx := openTestIndex(t, 10, 20, 30)
+
+			deleted, err := idx.ExpireBefore(tt.before)
+			require.NoError(t, err)
+			require.Equal(t, tt.deleted, deleted)
+
+			got := []uint64{}
+			require.NoError(t, idx.Between(0, 100, func(ts uint64, v *rbtree.Uint64) (bool, error) {
+				got = append(got, ts)
+				return false, nil
+			}))
+			require.Equal(t, tt.remaining, got)
+		})
+	}
+}
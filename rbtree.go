@@ -4,63 +4,435 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"io"
 	"math"
+	"os"
+	"path/filepath"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/vahagz/pager"
-	"github.com/vahagz/rbtree/pkg/stack"
 )
 
 var bin = binary.BigEndian
 
+// Open opens tree stored in '<fileName>.idx' (see Options.FileSuffix). While
+// tree is open it holds
+// exclusive lock on '<fileName>.lock', so second Open of the same file fails
+// with ErrLocked. Trees opened with Options.ReadOnly share the lock with each
+// other, but not with a writer.
 func Open[K, V EntryItem](fileName string, opts *Options) (*RBTree[K, V], error) {
-	pagerFile := fmt.Sprintf("%s.idx", fileName)
-	p, err := pager.Open(pagerFile, int(opts.PageSize), 0664)
+	pagerFile := opts.indexFile(fileName)
+	if opts.CreateDir {
+		if err := os.MkdirAll(filepath.Dir(pagerFile), 0775); err != nil {
+			return nil, errors.Wrap(err, "failed to create rbtree directory")
+		}
+	}
+
+	var v V
+	if v.Size() == 0 && !opts.KeyOnly {
+		return nil, ErrZeroValueSize
+	}
+
+	fileMode := opts.fileMode()
+
+	if opts.ReadOnly {
+		if _, err := os.Stat(pagerFile); err != nil {
+			return nil, errors.Wrap(err, "failed to open read-only rbtree")
+		}
+	}
+
+	lock, err := lockFile(fmt.Sprintf("%s.lock", fileName), fileMode, opts.ReadOnly)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to lock rbtree")
+	}
+
+	var w *wal
+	if opts.WAL && !opts.ReadOnly {
+		if w, err = openWAL(fmt.Sprintf("%s.wal", fileName), fileMode); err == nil {
+			if err = w.replay(pagerFile, int(opts.PageSize), fileMode); err != nil {
+				_ = w.close()
+			}
+		}
+		if err != nil {
+			if lock != nil {
+				_ = unlockFile(lock)
+			}
+			return nil, errors.Wrap(err, "failed to recover rbtree from wal")
+		}
+	}
+
+	p, err := pager.Open(pagerFile, int(opts.PageSize), fileMode)
 	if err != nil {
+		if w != nil {
+			_ = w.close()
+		}
+		if lock != nil {
+			_ = unlockFile(lock)
+		}
 		return nil, errors.Wrap(err, "failed to Open rbtree")
 	}
+	if opts.ReadOnly {
+		return newTree[K, V](pagerFile, lock, w, readOnlyPager{p}, opts)
+	}
+	return newTree[K, V](pagerFile, lock, w, p, opts)
+}
 
-	var k K
+// OpenMem opens empty tree kept in memory only, nothing is written to file
+// system. Close and Remove release the memory, data is lost after them.
+func OpenMem[K, V EntryItem](opts *Options) (*RBTree[K, V], error) {
 	var v V
+	if v.Size() == 0 && !opts.KeyOnly {
+		return nil, ErrZeroValueSize
+	}
+
+	p, err := pager.Open(pager.InMemoryFileName, int(opts.PageSize), 0)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open in-memory pager")
+	}
+	return newTree[K, V](pager.InMemoryFileName, nil, nil, memPager{p}, opts)
+}
+
+// newTree opens tree on top of opened pager, p and w are closed and lock
+// released if it fails
+func newTree[K, V EntryItem](file string, lock *os.File, w *wal, p pageStore, opts *Options) (*RBTree[K, V], error) {
 	tree := &RBTree[K, V]{
-		file:     pagerFile,
+		file:     file,
+		lock:     lock,
+		wal:      w,
 		mu:       &sync.RWMutex{},
 		pager:    p,
-		pages:    map[uint32]*page[K, V]{},
-		degree:   opts.PageSize / uint16(nodeFixedSize + k.Size() + v.Size()),
-		nodeSize: uint16(nodeFixedSize + k.Size() + v.Size()),
+		pages:    newPageCache[K, V](opts.ExpectedPages, opts.MaxCachedPages),
 		meta:     &metadata{},
+		compare:  bytes.Compare,
+		opts:     *opts,
+	}
+
+	tree.onOp = opts.OnOp
+	tree.tombstones = opts.Tombstones
+	tree.noCache = opts.NoCache
+	tree.verifySums = opts.VerifyChecksums
+	tree.allocStrategy = opts.AllocStrategy
+	tree.strictBatch = opts.StrictBatch
+	tree.noAutoSync = opts.NoAutoSync
+	tree.allowDups = opts.AllowDuplicates
+	tree.readOnly = opts.ReadOnly
+	tree.logger = opts.Logger
+	if opts.CompareBytes != nil {
+		tree.compare = opts.CompareBytes
+	}
+	if opts.Compare != nil {
+		compareKeys, ok := opts.Compare.(func(a, b K) int)
+		if !ok {
+			_ = p.Close()
+			if w != nil {
+				_ = w.close()
+			}
+			if lock != nil {
+				_ = unlockFile(lock)
+			}
+			return nil, errors.Wrapf(ErrInvalidCompare, "type:'%T'", opts.Compare)
+		}
+		tree.compareKeys = compareKeys
 	}
 
 	if err := tree.open(opts); err != nil {
-		_ = tree.Close()
+		_ = tree.CloseNoFlush()
 		return nil, errors.Wrap(err, "failed to open tree")
 	}
 
+	if opts.VerifyOnOpen {
+		if err := tree.validate(1).Err(); err != nil {
+			_ = tree.CloseNoFlush()
+			return nil, errors.Wrap(err, "failed to verify tree")
+		}
+	}
+
+	tree.approxCount.Store(int64(tree.meta.count - tree.meta.tombstones))
+	if opts.AsyncWrites {
+		tree.flushCh = make(chan struct{}, 1)
+		tree.flushDone = make(chan struct{})
+		go tree.flushLoop()
+	}
+
 	return tree, nil
 }
 
 type RBTree[K, V EntryItem] struct {
-	file     string
-	mu       *sync.RWMutex
-	pager    *pager.Pager
-	pages    map[uint32]*page[K, V] // node cache to avoid IO
-	meta     *metadata              // metadata about tree structure
-	degree   uint16                 // number of nodes per page
-	nodeSize uint16
+	file          string
+	lock          *os.File               // held while tree is open to prevent double Open
+	mu            *sync.RWMutex
+	pager         pageStore
+	pages         *pageCache[K, V]       // node cache to avoid IO
+	meta          *metadata              // metadata about tree structure
+	degree        uint16                 // number of nodes per page
+	nodeSize      uint16
+	compare       func(a, b []byte) int  // ordering of marshaled keys
+	compareKeys   func(a, b K) int       // ordering of typed keys, nil unless Options.Compare is set
+	verifySums    bool                   // pages read from file are checked against their checksum
+	onOp          func(op string, dur time.Duration, err error)
+	maxPtr        uint32                 // node with the greatest key, 0 if not known yet
+	tombstones    bool                   // Delete marks nodes deleted instead of removing them
+	allocStrategy AllocStrategy
+	noCache       bool                   // pages are dropped when lock is released
+	logger        func(level, msg string, kv ...any)
+	rotations     int                    // rotations done so far, for logging
+	flushCh       chan struct{}          // requests background flush in AsyncWrites mode
+	flushDone     chan struct{}          // closed when background flushing stopped
+	stopFlush     sync.Once
+	flushErr      error                  // last background flush error
+	approxCount   atomic.Int64           // Count mirror updated on unlock
+	uncommitted   bool                   // pages were written after the last meta write
+	strictBatch   bool                   // InsertBatch fails on existing key
+	opts          Options                // options tree was opened with, for Clone
+	io            ioStats
+	noAutoSync    bool                   // writing operations leave flushing to Sync
+	wal           *wal                   // logs flushes when Options.WAL is set
+	allowDups     bool                   // equal keys are inserted next to each other
+	readOnly      bool                   // changes fail with ErrReadOnly
+	snapMu        sync.Mutex
+	snapshots     map[*snapshotStore]struct{} // live snapshots, see preserve
 }
 
-func (tree *RBTree[K, V]) Insert(e *Entry[K, V]) error {
+func (tree *RBTree[K, V]) Insert(e *Entry[K, V]) (err error) {
+	if tree.onOp != nil {
+		defer tree.observe(OpInsert, time.Now(), &err)
+	}
+
 	if err := tree.InsertMem(e); err != nil {
 		return err
 	}
-	return errors.Wrap(tree.writeAll(), "failed to write all")
+	return tree.persist()
 }
 
-func (tree *RBTree[K, V]) InsertMem(e *Entry[K, V]) error {
+func (tree *RBTree[K, V]) InsertMem(e *Entry[K, V]) (err error) {
 	tree.mu.Lock()
-	defer tree.mu.Unlock()
+	defer tree.unlock(&err)
+
+	if tree.readOnly {
+		return ErrReadOnly
+	}
+	return tree.insertEntry(e)
+}
+
+// insertEntry adds entry or revives its tombstone, caller holds write lock
+func (tree *RBTree[K, V]) insertEntry(e *Entry[K, V]) error {
+	eSize := e.Size()
+	if eSize != int(tree.meta.nodeKeySize + tree.meta.nodeValSize) {
+		return errors.Wrapf(
+			ErrInvalidKeySize, "insert entry size missmatch, required:'%v', got:'%v'",
+			tree.meta.nodeKeySize + tree.meta.nodeValSize, eSize,
+		)
+	}
+
+	// keys greater than current maximum are appended without descending
+	appendMax, err := tree.greaterThanMax(e.Key)
+	if err != nil {
+		return errors.Wrap(err, "failed to compare with max key")
+	}
+
+	if !appendMax && !tree.allowDups {
+		if ptr, err := tree.get(e.Key); err != nil && err != ErrNotFound {
+			return errors.Wrap(err, "failed to check key existence")
+		} else if err == nil && tree.fetch(ptr).isTombstone() {
+			tree.revive(ptr, e)
+			return nil
+		} else if err == nil {
+			return ErrKeyAlreadyExists
+		}
+	}
+
+	n, err := tree.alloc()
+	if err != nil {
+		return errors.Wrap(err, "failed to alloc 1 node")
+	}
+
+	tree.fetch(n).left = tree.meta.nullPtr
+	tree.fetch(n).right = tree.meta.nullPtr
+	tree.fetch(n).setRed()
+	tree.fetch(n).clearTombstone()
+	tree.fetch(n).setEntry(e.Copy())
+	if appendMax {
+		tree.insertMax(n)
+		return nil
+	}
+	return errors.Wrap(tree.insert(n), "failed to insert node")
+}
+
+// InsertBatch inserts entries under a single lock and writes them to disk
+// once. Existing keys are skipped, or fail with ErrKeyAlreadyExists if
+// Options.StrictBatch is set. Entries inserted before a failure are kept.
+func (tree *RBTree[K, V]) InsertBatch(entries []*Entry[K, V]) (inserted int, err error) {
+	if tree.onOp != nil {
+		defer tree.observe(OpInsert, time.Now(), &err)
+	}
+
+	inserted, err = tree.insertBatchMem(entries)
+	if inserted > 0 {
+		if persistErr := tree.persist(); err == nil {
+			err = persistErr
+		}
+	}
+	return inserted, err
+}
+
+func (tree *RBTree[K, V]) insertBatchMem(entries []*Entry[K, V]) (inserted int, err error) {
+	tree.mu.Lock()
+	defer tree.unlock(&err)
+
+	if tree.readOnly {
+		return 0, ErrReadOnly
+	}
+
+	for i, e := range entries {
+		if err := tree.insertEntry(e); err == ErrKeyAlreadyExists && !tree.strictBatch {
+			continue
+		} else if err != nil {
+			return inserted, errors.Wrapf(err, "failed to insert entry %v of batch", i)
+		}
+		inserted++
+	}
+	return inserted, nil
+}
+
+// Update overwrites value of existing key, ErrNotFound is returned if key is
+// absent. Tree shape and count are not changed.
+func (tree *RBTree[K, V]) Update(e *Entry[K, V]) (err error) {
+	if tree.onOp != nil {
+		defer tree.observe(OpUpdate, time.Now(), &err)
+	}
+
+	if err := tree.updateMem(e); err != nil {
+		return err
+	}
+	return tree.persist()
+}
+
+func (tree *RBTree[K, V]) updateMem(e *Entry[K, V]) (err error) {
+	tree.mu.Lock()
+	defer tree.unlock(&err)
+
+	if tree.readOnly {
+		return ErrReadOnly
+	}
+
+	if e.Key.Size() != int(tree.meta.nodeKeySize) || e.Val.Size() != int(tree.meta.nodeValSize) {
+		return errors.Wrapf(
+			ErrInvalidKeySize, "update entry size missmatch, required:'%v', got:'%v'",
+			tree.meta.nodeKeySize + tree.meta.nodeValSize, e.Size(),
+		)
+	}
+	return tree.updateVal(e.Key, e.Val)
+}
+
+// UpdateValue overwrites value of existing key like Update, without building
+// an entry. Only value size is checked, ErrNotFound is returned if key is
+// absent.
+func (tree *RBTree[K, V]) UpdateValue(key K, val V) (err error) {
+	if tree.onOp != nil {
+		defer tree.observe(OpUpdate, time.Now(), &err)
+	}
+
+	if err := tree.updateValueMem(key, val); err != nil {
+		return err
+	}
+	return tree.persist()
+}
+
+func (tree *RBTree[K, V]) updateValueMem(key K, val V) (err error) {
+	tree.mu.Lock()
+	defer tree.unlock(&err)
+
+	if tree.readOnly {
+		return ErrReadOnly
+	}
+
+	if vSize := val.Size(); vSize != int(tree.meta.nodeValSize) {
+		return errors.Wrapf(
+			ErrInvalidKeySize, "update value size missmatch, required:'%v', got:'%v'",
+			tree.meta.nodeValSize, vSize,
+		)
+	}
+	return tree.updateVal(key, val)
+}
+
+// updateVal sets value of live key, caller holds write lock
+func (tree *RBTree[K, V]) updateVal(key K, val V) error {
+	ptr, err := tree.get(key)
+	if err != nil && err != ErrNotFound {
+		return errors.Wrap(err, "failed to find key")
+	} else if err == ErrNotFound || ptr == tree.meta.nullPtr || tree.fetch(ptr).isTombstone() {
+		return ErrNotFound
+	}
+
+	tree.setVal(ptr, val)
+	return nil
+}
+
+// Upsert updates value of existing key or inserts entry if key is absent,
+// created reports which one happened. Changes are flushed once.
+func (tree *RBTree[K, V]) Upsert(e *Entry[K, V]) (created bool, err error) {
+	if tree.onOp != nil {
+		defer tree.observe(OpUpdate, time.Now(), &err)
+	}
+
+	if created, err = tree.upsertMem(e); err != nil {
+		return created, err
+	}
+	return created, tree.persist()
+}
+
+func (tree *RBTree[K, V]) upsertMem(e *Entry[K, V]) (created bool, err error) {
+	tree.mu.Lock()
+	defer tree.unlock(&err)
+
+	if tree.readOnly {
+		return false, ErrReadOnly
+	}
+
+	if e.Key.Size() != int(tree.meta.nodeKeySize) || e.Val.Size() != int(tree.meta.nodeValSize) {
+		return false, errors.Wrapf(
+			ErrInvalidKeySize, "upsert entry size missmatch, required:'%v', got:'%v'",
+			tree.meta.nodeKeySize + tree.meta.nodeValSize, e.Size(),
+		)
+	}
+
+	ptr, err := tree.get(e.Key)
+	if err != nil && err != ErrNotFound {
+		return false, errors.Wrap(err, "failed to find key")
+	} else if err == nil && ptr != tree.meta.nullPtr && !tree.fetch(ptr).isTombstone() {
+		tree.setVal(ptr, e.Val)
+		return false, nil
+	}
+
+	if err := tree.insertEntry(e); err != nil {
+		return false, errors.Wrap(err, "failed to insert entry")
+	}
+	return true, nil
+}
+
+// setVal replaces value of node at ptr in place
+func (tree *RBTree[K, V]) setVal(ptr uint32, val V) {
+	n := tree.fetch(ptr)
+	n.entry.Val = val.Copy().(V)
+	n.markDirty()
+	tree.meta.seq++
+}
+
+// InsertRaw places entry as a leaf with given color (FV_COLOR_BLACK or
+// FV_COLOR_RED) without rebalancing. It is meant for tools rebuilding exact
+// tree shape, caller is responsible for red-black invariants, which can be
+// checked with Validate. Changes are not written until WriteAll.
+func (tree *RBTree[K, V]) InsertRaw(e *Entry[K, V], color byte) (err error) {
+	tree.mu.Lock()
+	defer tree.unlock(&err)
+
+	if tree.readOnly {
+		return ErrReadOnly
+	}
 
 	eSize := e.Size()
 	if eSize != int(tree.meta.nodeKeySize + tree.meta.nodeValSize) {
@@ -70,6 +442,10 @@ func (tree *RBTree[K, V]) InsertMem(e *Entry[K, V]) error {
 		)
 	}
 
+	if flagVaue(color) != FV_COLOR_BLACK && flagVaue(color) != FV_COLOR_RED {
+		return errors.Wrapf(ErrInvalidColor, "color:'%v'", color)
+	}
+
 	if _, err := tree.get(e.Key); err != nil && err != ErrNotFound {
 		return errors.Wrap(err, "failed to check key existence")
 	} else if err == nil {
@@ -83,14 +459,25 @@ func (tree *RBTree[K, V]) InsertMem(e *Entry[K, V]) error {
 
 	tree.fetch(n).left = tree.meta.nullPtr
 	tree.fetch(n).right = tree.meta.nullPtr
-	tree.fetch(n).setRed()
-	tree.fetch(n).entry = e.Copy()
-	tree.insert(n)
+	tree.fetch(n).setFlag(FT_COLOR, flagVaue(color))
+	tree.fetch(n).clearTombstone()
+	tree.fetch(n).setEntry(e.Copy())
+	if err := tree.link(n); err != nil {
+		return errors.Wrap(err, "failed to link node")
+	}
+	tree.resizeUp(n)
+
+	tree.meta.dirty = true
+	tree.meta.count++
+	tree.meta.seq++
 	return nil
 }
 
-func (tree *RBTree[K, V]) Get(key K) (*Entry[K, V], error) {
-	var e *Entry[K, V]
+func (tree *RBTree[K, V]) Get(key K) (e *Entry[K, V], err error) {
+	if tree.onOp != nil {
+		defer tree.observe(OpGet, time.Now(), &err)
+	}
+
 	kSize := key.Size()
 	if kSize != int(tree.meta.nodeKeySize) {
 		return e, errors.Wrapf(
@@ -100,196 +487,1628 @@ func (tree *RBTree[K, V]) Get(key K) (*Entry[K, V], error) {
 	}
 
 	tree.mu.RLock()
-	defer tree.mu.RUnlock()
+	defer tree.runlockErr(&err)
+
+	return tree.lookup(key)
+}
+
+// GetMany looks up keys under one read lock. Copies of entries and lookup
+// errors are returned aligned with keys, ErrNotFound for absent ones.
+func (tree *RBTree[K, V]) GetMany(keys []K) ([]*Entry[K, V], []error) {
+	if tree.onOp != nil {
+		defer tree.observe(OpGet, time.Now(), new(error))
+	}
+
+	entries := make([]*Entry[K, V], len(keys))
+	errs := make([]error, len(keys))
+
+	tree.mu.RLock()
+	defer tree.runlock()
+
+	for i, key := range keys {
+		if kSize := key.Size(); kSize != int(tree.meta.nodeKeySize) {
+			errs[i] = errors.Wrapf(
+				ErrInvalidKeySize, "key size missmatch, required:'%v', got:'%v'",
+				tree.meta.nodeKeySize, kSize,
+			)
+			continue
+		}
+
+		entries[i], errs[i] = tree.lookupCopy(key)
+	}
+	return entries, errs
+}
 
+// lookup returns entry of live node with given key, read lock must be held
+func (tree *RBTree[K, V]) lookup(key K) (*Entry[K, V], error) {
 	ptr, err := tree.get(key)
 	if err != nil && err != ErrNotFound {
-		return e, errors.Wrap(err, "failed to find key")
-	} else if ptr == tree.meta.nullPtr {
-		return e, ErrNotFound
+		return nil, errors.Wrap(err, "failed to find key")
+	} else if ptr == tree.meta.nullPtr || err == nil && tree.fetch(ptr).isTombstone() {
+		return nil, ErrNotFound
 	}
 	return tree.fetch(ptr).entry, err
 }
 
-func (tree *RBTree[K, V]) Delete(key K) error {
-	if err := tree.DeleteMem(key); err != nil {
-		return err
+// lookupCopy is lookup returning copy of entry, failed fetch is returned as
+// error instead of panicking
+func (tree *RBTree[K, V]) lookupCopy(key K) (e *Entry[K, V], err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			e, err = nil, fetchFailure(r)
+		}
+	}()
+
+	if e, err = tree.lookup(key); err != nil {
+		return nil, err
 	}
-	return errors.Wrap(tree.writeAll(), "failed to write all")
+	return e.Copy(), nil
 }
 
-func (tree *RBTree[K, V]) DeleteMem(key K) error {
-	tree.mu.Lock()
-	defer tree.mu.Unlock()
+// GetAll returns entries with key in insertion order, for trees opened with
+// Options.AllowDuplicates. ErrNotFound is returned if there are none.
+func (tree *RBTree[K, V]) GetAll(key K) (entries []*Entry[K, V], err error) {
+	if tree.onOp != nil {
+		defer tree.observe(OpGet, time.Now(), &err)
+	}
 
 	kSize := key.Size()
 	if kSize != int(tree.meta.nodeKeySize) {
-		return errors.Wrapf(
-			ErrInvalidKeySize, "delete entry size missmatch, required:'%v', got:'%v'",
+		return nil, errors.Wrapf(
+			ErrInvalidKeySize, "key size missmatch, required:'%v', got:'%v'",
 			tree.meta.nodeKeySize, kSize,
 		)
 	}
 
-	ptr, err := tree.get(key)
+	tree.mu.RLock()
+	defer tree.runlockErr(&err)
+
+	searchingKey, err := tree.prepare(key)
 	if err != nil {
-		return errors.Wrapf(err, "failed to find key to delete => %v", key)
+		return nil, err
 	}
 
-	tree.fetch(ptr).entry.Key = key
-	tree.delete(ptr)
-	return nil
+	c := tree.newCursor()
+	defer c.release()
+	ok, err := c.seek(key)
+	for ; ok && err == nil; ok = c.next() {
+		k, err := tree.nodeKey(c.node())
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to prepare entry key")
+		} else if tree.compareOrder(k, searchingKey) != 0 {
+			break
+		}
+		if !c.node().isTombstone() {
+			entries = append(entries, c.node().entry)
+		}
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to seek key")
+	} else if len(entries) == 0 {
+		return nil, ErrNotFound
+	}
+	return entries, nil
 }
 
-func (tree *RBTree[K, V]) Scan(key K, scanFn func(key K, val V) (bool, error)) error {
+// Has reports whether key exists without copying its entry
+func (tree *RBTree[K, V]) Has(key K) (has bool, err error) {
+	kSize := key.Size()
+	if kSize != int(tree.meta.nodeKeySize) {
+		return false, errors.Wrapf(
+			ErrInvalidKeySize, "key size missmatch, required:'%v', got:'%v'",
+			tree.meta.nodeKeySize, kSize,
+		)
+	}
+
+	tree.mu.RLock()
+	defer tree.runlockErr(&err)
+
+	ptr, err := tree.get(key)
+	if err == ErrNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, errors.Wrap(err, "failed to find key")
+	}
+	return ptr != tree.meta.nullPtr && !tree.fetch(ptr).isTombstone(), nil
+}
+
+// Min returns entry with the smallest key or ErrNotFound if tree is empty
+func (tree *RBTree[K, V]) Min() (e *Entry[K, V], err error) {
+	tree.mu.RLock()
+	defer tree.runlockErr(&err)
+
 	if tree.meta.rootPtr == tree.meta.nullPtr {
-		return nil
+		return nil, ErrNotFound
 	}
-	
+
+	ptr := tree.minimum(tree.meta.rootPtr)
+	for ptr != tree.meta.nullPtr && tree.fetch(ptr).isTombstone() {
+		ptr = tree.successor(ptr)
+	}
+	if ptr == tree.meta.nullPtr {
+		return nil, ErrNotFound
+	}
+	return tree.fetch(ptr).entry, nil
+}
+
+// Max returns entry with the greatest key or ErrNotFound if tree is empty
+func (tree *RBTree[K, V]) Max() (e *Entry[K, V], err error) {
 	tree.mu.RLock()
-	defer tree.mu.RUnlock()
+	defer tree.runlockErr(&err)
 
-	curr := tree.meta.rootPtr
-	if !key.IsNil() {
-		var err error
-		curr, err = tree.get(key)
-		if err != nil && err != ErrNotFound {
-			return errors.Wrap(err, "failed to find key")
-		}
+	if tree.meta.rootPtr == tree.meta.nullPtr {
+		return nil, ErrNotFound
 	}
 
-	s := stack.New[uint32](tree.height())
-	for curr != 0 && curr != tree.meta.nullPtr || s.Size() > 0 {
-		for curr != 0 && curr != tree.meta.nullPtr {
-			s.Push(curr)
-			if tree.fetch(curr).left == tree.meta.nullPtr {
-				break
-			}
+	ptr := tree.maximum(tree.meta.rootPtr)
+	for ptr != tree.meta.nullPtr && tree.fetch(ptr).isTombstone() {
+		ptr = tree.predecessor(ptr)
+	}
+	if ptr == tree.meta.nullPtr {
+		return nil, ErrNotFound
+	}
+	return tree.fetch(ptr).entry, nil
+}
+
+// Ceiling returns entry with the smallest key greater or equal to key
+func (tree *RBTree[K, V]) Ceiling(key K) (*Entry[K, V], error) {
+	return tree.neighbor(key, tree.get, tree.successor)
+}
 
-			curr = tree.fetch(curr).left
+// Floor returns entry with the greatest key less or equal to key
+func (tree *RBTree[K, V]) Floor(key K) (*Entry[K, V], error) {
+	return tree.neighbor(key, tree.floor, tree.predecessor)
+}
+
+// Higher returns entry with the smallest key strictly greater than key
+func (tree *RBTree[K, V]) Higher(key K) (*Entry[K, V], error) {
+	return tree.neighbor(key, func(key K) (uint32, error) {
+		ptr, err := tree.get(key)
+		if err == nil && ptr != tree.meta.nullPtr {
+			return tree.successor(ptr), nil
 		}
+		return ptr, err
+	}, tree.successor)
+}
 
-		curr = s.Pop()
-		e := tree.fetch(curr).entry
-		stop, err := scanFn(e.Key, e.Val)
-		if stop || err != nil {
-			return err
+// Lower returns entry with the greatest key strictly less than key
+func (tree *RBTree[K, V]) Lower(key K) (*Entry[K, V], error) {
+	return tree.neighbor(key, func(key K) (uint32, error) {
+		ptr, err := tree.floor(key)
+		if err != nil || ptr == tree.meta.nullPtr {
+			return ptr, err
 		}
 
-		if tree.fetch(curr).right == tree.meta.nullPtr {
-			curr = 0
-		} else {
-			curr = tree.fetch(curr).right
+		k, err := tree.nodeKey(tree.fetch(ptr))
+		if err != nil {
+			return 0, errors.Wrap(err, "failed to prepare entry key")
 		}
+		searchingKey, err := tree.prepare(key)
+		if err != nil {
+			return 0, err
+		}
+		if tree.compareOrder(k, searchingKey) == 0 {
+			return tree.predecessor(ptr), nil
+		}
+		return ptr, nil
+	}, tree.predecessor)
+}
+
+// neighbor returns entry of node found by find, moving with step past
+// tombstones. ErrNotFound is returned if there is no such node.
+func (tree *RBTree[K, V]) neighbor(
+	key K,
+	find func(key K) (uint32, error),
+	step func(ptr uint32) uint32,
+) (e *Entry[K, V], err error) {
+	kSize := key.Size()
+	if kSize != int(tree.meta.nodeKeySize) {
+		return nil, errors.Wrapf(
+			ErrInvalidKeySize, "key size missmatch, required:'%v', got:'%v'",
+			tree.meta.nodeKeySize, kSize,
+		)
 	}
 
-	return nil
-}
+	tree.mu.RLock()
+	defer tree.runlockErr(&err)
 
-func (tree *RBTree[K, V]) Count() int {
-	return int(tree.meta.count)
+	ptr, err := find(key)
+	if err != nil && err != ErrNotFound {
+		return nil, errors.Wrap(err, "failed to find key")
+	}
+	for ptr != tree.meta.nullPtr && tree.fetch(ptr).isTombstone() {
+		ptr = step(ptr)
+	}
+	if ptr == tree.meta.nullPtr {
+		return nil, ErrNotFound
+	}
+	return tree.fetch(ptr).entry, nil
 }
 
-func (tree *RBTree[K, V]) Print(count int) error {
+// Select returns k-th smallest entry (0 based) or ErrNotFound if tree has
+// at most k entries
+func (tree *RBTree[K, V]) Select(k int) (e *Entry[K, V], err error) {
 	tree.mu.RLock()
-	defer tree.mu.RUnlock()
+	defer tree.runlockErr(&err)
+
+	ptr := tree.selectPtr(k)
+	if ptr == tree.meta.nullPtr {
+		return nil, ErrNotFound
+	}
+	return tree.fetch(ptr).entry, nil
+}
+
+// Rank returns number of entries with keys less than key
+func (tree *RBTree[K, V]) Rank(key K) (rank int, err error) {
+	kSize := key.Size()
+	if kSize != int(tree.meta.nodeKeySize) {
+		return 0, errors.Wrapf(
+			ErrInvalidKeySize, "key size missmatch, required:'%v', got:'%v'",
+			tree.meta.nodeKeySize, kSize,
+		)
+	}
+
+	tree.mu.RLock()
+	defer tree.runlockErr(&err)
+
+	return tree.rank(key)
+}
+
+// CountRange returns number of entries with keys in [lo, hi] without
+// visiting them, 0 is returned when lo is greater than hi
+func (tree *RBTree[K, V]) CountRange(lo, hi K) (count int, err error) {
+	for _, key := range []K{lo, hi} {
+		if kSize := key.Size(); kSize != int(tree.meta.nodeKeySize) {
+			return 0, errors.Wrapf(
+				ErrInvalidKeySize, "key size missmatch, required:'%v', got:'%v'",
+				tree.meta.nodeKeySize, kSize,
+			)
+		}
+	}
+
+	tree.mu.RLock()
+	defer tree.runlockErr(&err)
+
+	from, err := tree.rank(lo)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to rank lower bound")
+	}
+	to, err := tree.rank(hi)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to rank upper bound")
+	}
+
+	ptr, err := tree.get(hi)
+	if err != nil && err != ErrNotFound {
+		return 0, errors.Wrap(err, "failed to find upper bound")
+	} else if err == nil && ptr != tree.meta.nullPtr && !tree.fetch(ptr).isTombstone() {
+		to++
+	}
+
+	if to < from {
+		return 0, nil
+	}
+	return to - from, nil
+}
+
+// selectPtr returns pointer to k-th smallest live node or nullPtr. Trees
+// created before subtree sizes were kept are walked in order.
+func (tree *RBTree[K, V]) selectPtr(k int) uint32 {
+	if k < 0 || k >= int(tree.meta.count - tree.meta.tombstones) {
+		return tree.meta.nullPtr
+	}
+
+	if !tree.meta.hasFlag(META_SIZES) {
+		c := tree.newCursor()
+		defer c.release()
+		for ok := c.first(); ok; ok = c.next() {
+			if c.node().isTombstone() {
+				continue
+			} else if k == 0 {
+				return c.ptr()
+			}
+			k--
+		}
+		return tree.meta.nullPtr
+	}
+
+	ptr := tree.meta.rootPtr
+	for ptr != tree.meta.nullPtr {
+		n := tree.fetch(ptr)
+		left := int(tree.fetch(n.left).size)
+		if k < left {
+			ptr = n.left
+			continue
+		}
+
+		k -= left
+		if !n.isTombstone() {
+			if k == 0 {
+				return ptr
+			}
+			k--
+		}
+		ptr = n.right
+	}
+	return ptr
+}
+
+// rank counts live nodes with keys less than key
+func (tree *RBTree[K, V]) rank(key K) (int, error) {
+	searchingKey, err := tree.prepare(key)
+	if err != nil {
+		return 0, err
+	}
+
+	rank := 0
+	if !tree.meta.hasFlag(META_SIZES) {
+		c := tree.newCursor()
+		defer c.release()
+		for ok := c.first(); ok; ok = c.next() {
+			k, err := tree.nodeKey(c.node())
+			if err != nil {
+				return 0, errors.Wrap(err, "failed to prepare entry key")
+			}
+			if tree.compareOrder(k, searchingKey) >= 0 {
+				break
+			}
+			if !c.node().isTombstone() {
+				rank++
+			}
+		}
+		return rank, nil
+	}
+
+	ptr := tree.meta.rootPtr
+	for ptr != tree.meta.nullPtr {
+		n := tree.fetch(ptr)
+		k, err := tree.nodeKey(n)
+		if err != nil {
+			return 0, errors.Wrap(err, "failed to prepare entry key")
+		}
+
+		if tree.compareOrder(k, searchingKey) < 0 {
+			rank += int(tree.fetch(n.left).size)
+			if !n.isTombstone() {
+				rank++
+			}
+			ptr = n.right
+		} else {
+			ptr = n.left
+		}
+	}
+	return rank, nil
+}
+
+// HasMulti reports presence of every key under one read lock. Keys sorted in
+// ascending order are resolved without descending from root for each key.
+func (tree *RBTree[K, V]) HasMulti(keys []K) (has []bool, err error) {
+	for _, key := range keys {
+		if kSize := key.Size(); kSize != int(tree.meta.nodeKeySize) {
+			return nil, errors.Wrapf(
+				ErrInvalidKeySize, "key size missmatch, required:'%v', got:'%v'",
+				tree.meta.nodeKeySize, kSize,
+			)
+		}
+	}
+
+	tree.mu.RLock()
+	defer tree.runlockErr(&err)
+
+	has = make([]bool, len(keys))
+	f := tree.newFinger()
+	var prev orderKey[K]
+	for i, key := range keys {
+		k, err := tree.prepare(key)
+		if err != nil {
+			return nil, err
+		}
+
+		if i > 0 && tree.compareOrder(k, prev) < 0 {
+			f.reset()
+		}
+		prev = k
+
+		ptr, err := f.find(k)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to find key")
+		}
+		has[i] = ptr != tree.meta.nullPtr && !tree.fetch(ptr).isTombstone()
+	}
+	return has, nil
+}
+
+func (tree *RBTree[K, V]) Delete(key K) (err error) {
+	if tree.onOp != nil {
+		defer tree.observe(OpDelete, time.Now(), &err)
+	}
+
+	if err := tree.DeleteMem(key); err != nil {
+		return err
+	}
+	return tree.persist()
+}
+
+func (tree *RBTree[K, V]) DeleteMem(key K) (err error) {
+	tree.mu.Lock()
+	defer tree.unlock(&err)
+
+	if tree.readOnly {
+		return ErrReadOnly
+	}
+	return tree.deleteKey(key)
+}
+
+// Clear removes all entries keeping tree open, file is truncated to meta
+// and null node. Changes are written to disk.
+func (tree *RBTree[K, V]) Clear() (err error) {
+	if tree.onOp != nil {
+		defer tree.observe(OpDelete, time.Now(), &err)
+	}
+
+	if err := tree.clearMem(); err != nil {
+		return err
+	}
+	return tree.persist()
+}
+
+func (tree *RBTree[K, V]) clearMem() (err error) {
+	tree.mu.Lock()
+	defer tree.unlock(&err)
+
+	if tree.readOnly {
+		return ErrReadOnly
+	}
+
+	for id := uint64(1); id < tree.pager.Count(); id++ {
+		tree.preserve(id)
+	}
+	if err := tree.pager.Free(int(tree.pager.Count()) - 1); err != nil {
+		return errors.Wrap(err, "failed to free data pages")
+	}
+	tree.pages.clear()
+	tree.maxPtr = 0
+
+	tree.meta.seq += uint64(tree.meta.count)
+	tree.meta.count = 0
+	tree.meta.tombstones = 0
+	tree.meta.top = uint32(tree.meta.pageSize)
+	tree.meta.dirty = true
+
+	nullNode, err := tree.alloc()
+	if err != nil {
+		return errors.Wrap(err, "failed to alloc null node")
+	}
+	tree.fetch(nullNode).setBlack()
+	tree.meta.nullPtr = nullNode
+	tree.meta.rootPtr = nullNode
+	return nil
+}
+
+// GetAndDelete removes key and returns copy of its entry, ErrNotFound is
+// returned if key is absent. Changes are written to disk like with Delete.
+func (tree *RBTree[K, V]) GetAndDelete(key K) (e *Entry[K, V], err error) {
+	if tree.onOp != nil {
+		defer tree.observe(OpDelete, time.Now(), &err)
+	}
+
+	if e, err = tree.getAndDeleteMem(key); err != nil {
+		return nil, err
+	}
+	return e, tree.persist()
+}
+
+func (tree *RBTree[K, V]) getAndDeleteMem(key K) (e *Entry[K, V], err error) {
+	kSize := key.Size()
+	if kSize != int(tree.meta.nodeKeySize) {
+		return nil, errors.Wrapf(
+			ErrInvalidKeySize, "delete entry size missmatch, required:'%v', got:'%v'",
+			tree.meta.nodeKeySize, kSize,
+		)
+	}
+
+	tree.mu.Lock()
+	defer tree.unlock(&err)
+
+	if tree.readOnly {
+		return nil, ErrReadOnly
+	}
+
+	ptr, err := tree.get(key)
+	if err == nil && tree.fetch(ptr).isTombstone() {
+		err = ErrNotFound
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to find key to delete => %v", key)
+	}
+
+	// node may be overwritten by the last one when freed
+	e = tree.fetch(ptr).entry.Copy()
+	if err := tree.remove(ptr); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// DeleteBatch deletes keys under a single lock and writes changes to disk
+// once. Absent keys are skipped and counted as missing.
+func (tree *RBTree[K, V]) DeleteBatch(keys []K) (deleted int, missing int, err error) {
+	if tree.onOp != nil {
+		defer tree.observe(OpDelete, time.Now(), &err)
+	}
+
+	deleted, missing, err = tree.deleteBatchMem(keys)
+	if deleted > 0 {
+		if persistErr := tree.persist(); err == nil {
+			err = persistErr
+		}
+	}
+	return deleted, missing, err
+}
+
+func (tree *RBTree[K, V]) deleteBatchMem(keys []K) (deleted int, missing int, err error) {
+	tree.mu.Lock()
+	defer tree.unlock(&err)
+
+	if tree.readOnly {
+		return 0, 0, ErrReadOnly
+	}
+
+	for i, key := range keys {
+		if err := tree.deleteKey(key); errors.Is(err, ErrNotFound) {
+			missing++
+			continue
+		} else if err != nil {
+			return deleted, missing, errors.Wrapf(err, "failed to delete key %v of batch", i)
+		}
+		deleted++
+	}
+	return deleted, missing, nil
+}
+
+// DeleteRange deletes every entry with key in [lo, hi) under a single lock
+// and writes changes to disk once
+func (tree *RBTree[K, V]) DeleteRange(lo, hi K) (deleted int, err error) {
+	if tree.onOp != nil {
+		defer tree.observe(OpDelete, time.Now(), &err)
+	}
+
+	deleted, err = tree.deleteRangeMem(lo, hi)
+	if deleted > 0 {
+		if persistErr := tree.persist(); err == nil {
+			err = persistErr
+		}
+	}
+	return deleted, err
+}
+
+func (tree *RBTree[K, V]) deleteRangeMem(lo, hi K) (deleted int, err error) {
+	for _, key := range []K{lo, hi} {
+		if kSize := key.Size(); kSize != int(tree.meta.nodeKeySize) {
+			return 0, errors.Wrapf(
+				ErrInvalidKeySize, "key size missmatch, required:'%v', got:'%v'",
+				tree.meta.nodeKeySize, kSize,
+			)
+		}
+	}
+
+	tree.mu.Lock()
+	defer tree.unlock(&err)
+
+	if tree.readOnly {
+		return 0, ErrReadOnly
+	}
+
+	hiKey, err := tree.prepare(hi)
+	if err != nil {
+		return 0, err
+	}
+
+	// removal may rebalance and move entries between nodes, so ceiling of
+	// the last deleted key is searched again every time
+	from := lo
+	for {
+		ptr, err := tree.get(from)
+		if err != nil && err != ErrNotFound {
+			return deleted, errors.Wrap(err, "failed to find key")
+		}
+		for ptr != tree.meta.nullPtr && tree.fetch(ptr).isTombstone() {
+			ptr = tree.successor(ptr)
+		}
+		if ptr == tree.meta.nullPtr {
+			return deleted, nil
+		}
+
+		k, err := tree.nodeKey(tree.fetch(ptr))
+		if err != nil {
+			return deleted, errors.Wrap(err, "failed to prepare entry key")
+		}
+		if tree.compareOrder(k, hiKey) >= 0 {
+			return deleted, nil
+		}
+
+		from = tree.fetch(ptr).entry.Copy().Key
+		if err := tree.deleteKey(from); err != nil {
+			return deleted, errors.Wrapf(err, "failed to delete key => %v", from)
+		}
+		deleted++
+	}
+}
+
+// deleteKey removes key or marks it deleted, caller holds write lock
+func (tree *RBTree[K, V]) deleteKey(key K) error {
+	kSize := key.Size()
+	if kSize != int(tree.meta.nodeKeySize) {
+		return errors.Wrapf(
+			ErrInvalidKeySize, "delete entry size missmatch, required:'%v', got:'%v'",
+			tree.meta.nodeKeySize, kSize,
+		)
+	}
+
+	ptr, err := tree.get(key)
+	if err == nil && tree.fetch(ptr).isTombstone() {
+		err = ErrNotFound
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to find key to delete => %v", key)
+	} else if ptr == 0 || ptr == tree.meta.nullPtr {
+		return errors.Wrapf(ErrNullPtrDelete, "ptr:'%v'", ptr)
+	}
+
+	return tree.remove(ptr)
+}
+
+// PopMin removes the entry with the smallest key and returns it, ErrNotFound
+// is returned for empty tree. Changes are written to disk like with Delete.
+func (tree *RBTree[K, V]) PopMin() (*Entry[K, V], error) {
+	return tree.pop(false)
+}
+
+// PopMax removes the entry with the greatest key and returns it
+func (tree *RBTree[K, V]) PopMax() (*Entry[K, V], error) {
+	return tree.pop(true)
+}
+
+func (tree *RBTree[K, V]) pop(max bool) (e *Entry[K, V], err error) {
+	if tree.onOp != nil {
+		defer tree.observe(OpDelete, time.Now(), &err)
+	}
+
+	if e, err = tree.popMem(max); err != nil {
+		return nil, err
+	}
+	return e, tree.persist()
+}
+
+func (tree *RBTree[K, V]) popMem(max bool) (e *Entry[K, V], err error) {
+	tree.mu.Lock()
+	defer tree.unlock(&err)
+
+	if tree.readOnly {
+		return nil, ErrReadOnly
+	}
+
+	c := tree.newCursor()
+	defer c.release()
+	ok := false
+	if max {
+		ok = c.last()
+	} else {
+		ok = c.first()
+	}
+	for ok && c.node().isTombstone() {
+		ok = c.step(max)
+	}
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	// node may be overwritten by the last one when freed
+	e = c.node().entry.Copy()
+	if err := tree.remove(c.ptr()); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// remove deletes node at ptr, or marks it deleted in tombstones mode
+func (tree *RBTree[K, V]) remove(ptr uint32) error {
+	if tree.tombstones {
+		tree.fetch(ptr).setTombstone(time.Now().UnixNano())
+		tree.resizeUp(ptr)
+		tree.meta.dirty = true
+		tree.meta.tombstones++
+		tree.meta.seq++
+		return nil
+	}
+
+	return errors.Wrap(tree.delete(ptr), "failed to delete node")
+}
+
+// Scan calls scanFn for entries in ascending order starting from the
+// smallest key greater or equal to key. Nil key starts from the smallest
+// entry without searching, same as ScanAll. Panic in scanFn propagates to
+// caller after read lock is released, use ScanSafe to get it as error.
+func (tree *RBTree[K, V]) Scan(key K, scanFn func(key K, val V) (bool, error)) error {
+	return tree.ScanWith(ScanOpts[K]{Start: key}, scanFn)
+}
+
+// ScanSafe is Scan which recovers panic in scanFn and returns it wrapped
+// in ErrCallbackPanic
+func (tree *RBTree[K, V]) ScanSafe(key K, scanFn func(key K, val V) (bool, error)) error {
+	return tree.Scan(key, func(key K, val V) (stop bool, err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = errors.Wrapf(ErrCallbackPanic, "%v", r)
+			}
+		}()
+		return scanFn(key, val)
+	})
+}
+
+// ScanOpts configures ScanWith, zero value scans all entries ascending
+type ScanOpts[K EntryItem] struct {
+	Reverse   bool // descending order
+	Start     K    // first key, nil starts from the smallest (greatest if Reverse) entry
+	Exclusive bool // skip entries equal to Start
+	Limit     int  // maximum number of entries, <= 0 means no limit
+}
+
+// ScanWith calls scanFn for entries selected by opts. Ascending scan starts
+// from the smallest key greater or equal to Start, descending one from the
+// greatest key less or equal to it.
+func (tree *RBTree[K, V]) ScanWith(opts ScanOpts[K], scanFn func(key K, val V) (bool, error)) (err error) {
+	if tree.onOp != nil {
+		defer tree.observe(OpScan, time.Now(), &err)
+	}
+
+	tree.mu.RLock()
+	defer tree.runlockErr(&err)
+
+	_, err = tree.scan(opts, 0, nil, scanValues(scanFn))
+	return err
+}
+
+// ScanReverse calls scanFn for entries in descending order starting from the
+// greatest key less or equal to key, or from the greatest entry if key is nil
+func (tree *RBTree[K, V]) ScanReverse(key K, scanFn func(key K, val V) (bool, error)) error {
+	return tree.ScanWith(ScanOpts[K]{Reverse: true, Start: key}, scanFn)
+}
+
+// RangeOptions selects which endpoints RangeScan includes
+type RangeOptions struct {
+	IncludeLo bool
+	IncludeHi bool
+}
+
+// RangeScan calls scanFn for entries with keys between lo and hi in
+// ascending order. Nil lo starts from the smallest entry, nil hi scans to
+// the end.
+func (tree *RBTree[K, V]) RangeScan(lo, hi K, opts RangeOptions, scanFn func(key K, val V) (bool, error)) (err error) {
+	if tree.onOp != nil {
+		defer tree.observe(OpScan, time.Now(), &err)
+	}
+
+	var hiKey orderKey[K]
+	if !hi.IsNil() {
+		if hiKey, err = tree.prepare(hi); err != nil {
+			return errors.Wrap(err, "failed to prepare hi key")
+		}
+	}
+
+	tree.mu.RLock()
+	defer tree.runlockErr(&err)
+
+	_, err = tree.scan(ScanOpts[K]{Start: lo, Exclusive: !opts.IncludeLo}, 0, nil, func(e *Entry[K, V]) (bool, error) {
+		if !hi.IsNil() {
+			k, err := tree.prepare(e.Key)
+			if err != nil {
+				return true, errors.Wrap(err, "failed to prepare entry key")
+			}
+			if cmp := tree.compareOrder(k, hiKey); cmp > 0 || cmp == 0 && !opts.IncludeHi {
+				return true, nil
+			}
+		}
+		return scanFn(e.Key, e.Val)
+	})
+	return err
+}
+
+// PrefixScan calls scanFn for entries whose marshaled key starts with
+// prefix, in ascending order. Scan starts from prefix padded with zero bytes
+// and stops at the first key without it, so it only works with the default
+// byte order of marshaled keys, ErrUnsupported is returned when
+// Options.Compare or Options.CompareBytes is set.
+func (tree *RBTree[K, V]) PrefixScan(prefix []byte, scanFn func(key K, val V) (bool, error)) (err error) {
+	if tree.onOp != nil {
+		defer tree.observe(OpScan, time.Now(), &err)
+	}
+
+	if tree.customOrder() {
+		return errors.Wrap(ErrUnsupported, "prefix scan needs default key order")
+	}
+
+	if len(prefix) > int(tree.meta.nodeKeySize) {
+		return errors.Wrapf(
+			ErrInvalidKeySize, "prefix longer than key, key size:'%v', got:'%v'",
+			tree.meta.nodeKeySize, len(prefix),
+		)
+	}
+	var k K
+	start := k.New().(K)
+	buf := make([]byte, tree.meta.nodeKeySize)
+	copy(buf, prefix)
+	if err := start.UnmarshalBinary(buf); err != nil {
+		return errors.Wrap(err, "failed to unmarshal prefix key")
+	}
+
+	tree.mu.RLock()
+	defer tree.runlockErr(&err)
+
+	_, err = tree.scan(ScanOpts[K]{Start: start}, 0, nil, func(e *Entry[K, V]) (bool, error) {
+		key, err := e.Key.MarshalBinary()
+		if err != nil {
+			return true, errors.Wrap(err, "failed to marshal entry key")
+		} else if !bytes.HasPrefix(key, prefix) {
+			return true, nil
+		}
+		return scanFn(e.Key, e.Val)
+	})
+	return err
+}
+
+// ScanAll calls scanFn for all entries in ascending order
+func (tree *RBTree[K, V]) ScanAll(scanFn func(key K, val V) (bool, error)) error {
+	var nilKey K
+	return tree.Scan(nilKey, scanFn)
+}
+
+// ScanCount is Scan which also returns number of scanFn calls, including
+// the one which stopped the scan
+func (tree *RBTree[K, V]) ScanCount(key K, scanFn func(key K, val V) (bool, error)) (n int, err error) {
+	if tree.onOp != nil {
+		defer tree.observe(OpScan, time.Now(), &err)
+	}
+
+	tree.mu.RLock()
+	defer tree.runlockErr(&err)
+
+	return tree.scan(ScanOpts[K]{Start: key}, 0, nil, scanValues(scanFn))
+}
+
+// ScanDeadline is Scan which stops once d elapses. It returns copy of the
+// last key passed to scanFn and whether scan ended before the deadline,
+// either at the last entry or by scanFn. Interrupted scan is resumed with
+// ScanWith from lastKey with Exclusive set.
+func (tree *RBTree[K, V]) ScanDeadline(
+	start K,
+	d time.Duration,
+	scanFn func(key K, val V) (bool, error),
+) (lastKey K, completed bool, err error) {
+	if tree.onOp != nil {
+		defer tree.observe(OpScan, time.Now(), &err)
+	}
+
+	tree.mu.RLock()
+	defer tree.runlockErr(&err)
+
+	deadline := time.Now().Add(d)
+	completed = true
+	var last *Entry[K, V]
+	_, err = tree.scan(ScanOpts[K]{Start: start}, 0, nil, func(e *Entry[K, V]) (bool, error) {
+		last = e
+		stop, err := scanFn(e.Key, e.Val)
+		if !stop && err == nil && !time.Now().Before(deadline) {
+			completed = false
+			return true, nil
+		}
+		return stop, err
+	})
+	if last != nil {
+		lastKey = last.Key.Copy().(K)
+	}
+	return lastKey, completed && err == nil, err
+}
+
+// ScanProgress is Scan which calls progress with number of visited entries
+// after every 'every' entries. progress may be nil.
+func (tree *RBTree[K, V]) ScanProgress(
+	key K,
+	every int,
+	progress func(visited int),
+	scanFn func(key K, val V) (bool, error),
+) (err error) {
+	if tree.onOp != nil {
+		defer tree.observe(OpScan, time.Now(), &err)
+	}
+
+	tree.mu.RLock()
+	defer tree.runlockErr(&err)
+
+	_, err = tree.scan(ScanOpts[K]{Start: key}, every, progress, scanValues(scanFn))
+	return err
+}
+
+// ScanRef is Scan passing pointers to key and value of cached entry instead
+// of copies. Pointers are valid only during scanFn call, they must not be
+// retained or modified.
+func (tree *RBTree[K, V]) ScanRef(key K, scanFn func(key *K, val *V) (bool, error)) (err error) {
+	if tree.onOp != nil {
+		defer tree.observe(OpScan, time.Now(), &err)
+	}
+
+	tree.mu.RLock()
+	defer tree.runlockErr(&err)
+
+	_, err = tree.scan(ScanOpts[K]{Start: key}, 0, nil, func(e *Entry[K, V]) (bool, error) {
+		return scanFn(&e.Key, &e.Val)
+	})
+	return err
+}
+
+// ForEach calls fn for every entry in ascending order with a copy of the
+// entry, which fn may keep after it returns. Copying allocates per entry, so
+// ForEach is slower than Scan, which passes keys and values of tree nodes
+// that are only valid during the call.
+func (tree *RBTree[K, V]) ForEach(fn func(e *Entry[K, V]) (bool, error)) (err error) {
+	if tree.onOp != nil {
+		defer tree.observe(OpScan, time.Now(), &err)
+	}
+
+	tree.mu.RLock()
+	defer tree.runlockErr(&err)
+
+	_, err = tree.scan(ScanOpts[K]{}, 0, nil, func(e *Entry[K, V]) (bool, error) {
+		return fn(e.Copy())
+	})
+	return err
+}
+
+func scanValues[K, V EntryItem](scanFn func(key K, val V) (bool, error)) func(e *Entry[K, V]) (bool, error) {
+	return func(e *Entry[K, V]) (bool, error) {
+		return scanFn(e.Key, e.Val)
+	}
+}
+
+// ScanFromIndex calls scanFn for at most limit entries in ascending order
+// starting from i-th smallest entry (0 based), limit <= 0 means no limit.
+func (tree *RBTree[K, V]) ScanFromIndex(i, limit int, scanFn func(key K, val V) (bool, error)) (err error) {
+	if tree.onOp != nil {
+		defer tree.observe(OpScan, time.Now(), &err)
+	}
+
+	tree.mu.RLock()
+	defer tree.runlockErr(&err)
+
+	ptr := tree.selectPtr(i)
+	if ptr == tree.meta.nullPtr {
+		return nil
+	}
+
+	c := tree.newCursor()
+	defer c.release()
+	ok := c.at(ptr)
+	for n := 0; ok && (limit <= 0 || n < limit); ok = c.next() {
+		if c.node().isTombstone() {
+			continue
+		}
+
+		e := c.node().entry
+		if stop, err := scanFn(e.Key, e.Val); stop || err != nil {
+			return err
+		}
+		n++
+	}
+	return nil
+}
+
+func (tree *RBTree[K, V]) scan(
+	opts ScanOpts[K],
+	every int,
+	progress func(visited int),
+	scanFn func(e *Entry[K, V]) (bool, error),
+) (int, error) {
+	if tree.meta.rootPtr == tree.meta.nullPtr {
+		return 0, nil
+	}
+
+	c := tree.newCursor()
+	defer c.release()
+	ok := false
+	if opts.Start.IsNil() && opts.Reverse {
+		ok = c.last()
+	} else if opts.Start.IsNil() {
+		ok = c.first()
+	} else {
+		var err error
+		if opts.Reverse {
+			ok, err = c.seekFloor(opts.Start)
+		} else {
+			ok, err = c.seek(opts.Start)
+		}
+		if err != nil {
+			return 0, errors.Wrap(err, "failed to find key")
+		}
+
+		if ok && opts.Exclusive {
+			if ok, err = tree.skipEqual(c, opts.Start, opts.Reverse); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	visited := 0
+	for ; ok && (opts.Limit <= 0 || visited < opts.Limit); ok = c.step(opts.Reverse) {
+		if c.node().isTombstone() {
+			continue
+		}
+
+		stop, err := scanFn(c.node().entry)
+		visited++
+		if stop || err != nil {
+			return visited, err
+		}
+
+		if progress != nil && every > 0 && visited%every == 0 {
+			progress(visited)
+		}
+	}
+
+	return visited, nil
+}
+
+// skipEqual moves cursor past entries equal to key
+func (tree *RBTree[K, V]) skipEqual(c *cursor[K, V], key K, reverse bool) (bool, error) {
+	k, err := tree.prepare(key)
+	if err != nil {
+		return false, err
+	}
+
+	for {
+		cur, err := tree.nodeKey(c.node())
+		if err != nil {
+			return false, errors.Wrap(err, "failed to prepare entry key")
+		}
+		if tree.compareOrder(cur, k) != 0 {
+			return true, nil
+		}
+		if !c.step(reverse) {
+			return false, nil
+		}
+	}
+}
+
+// Count returns number of entries, excluding tombstones
+func (tree *RBTree[K, V]) Count() int {
+	tree.mu.RLock()
+	defer tree.runlock()
+
+	return int(tree.meta.count - tree.meta.tombstones)
+}
+
+// ApproxCount is Count without locking, for frequently polled metrics. It
+// is updated when modifying operation completes, so running one is not
+// reflected yet.
+func (tree *RBTree[K, V]) ApproxCount() int {
+	return int(tree.approxCount.Load())
+}
+
+// CreatedAt returns tree creation time, zero for trees created before it
+// was recorded
+func (tree *RBTree[K, V]) CreatedAt() time.Time {
+	tree.mu.RLock()
+	defer tree.runlock()
+
+	return unixNanoTime(tree.meta.createdAt)
+}
+
+// ModifiedAt returns time of the last metadata write to file
+func (tree *RBTree[K, V]) ModifiedAt() time.Time {
+	tree.mu.RLock()
+	defer tree.runlock()
+
+	return unixNanoTime(tree.meta.modifiedAt)
+}
+
+func unixNanoTime(nanos int64) time.Time {
+	if nanos == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nanos)
+}
+
+// Print writes tree to stdout, see Fprint
+func (tree *RBTree[K, V]) Print(count int) error {
+	return tree.Fprint(os.Stdout, count)
+}
+
+// Fprint writes tree to w sideways, right subtree above its root and
+// every level indented by indent more spaces
+func (tree *RBTree[K, V]) Fprint(w io.Writer, indent int) (err error) {
+	tree.mu.RLock()
+	defer tree.runlockErr(&err)
+
+	return tree.print(w, tree.meta.rootPtr, 0, indent)
+}
+
+func (tree *RBTree[K, V]) print(w io.Writer, root uint32, space int, count int) error {
+	if root == 0 {
+		return nil
+	}
+
+	// Increase distance between levels
+	space += count
+
+	// Process right child first
+	if root != tree.meta.nullPtr {
+		if err := tree.print(w, tree.fetch(root).right, space, count); err != nil {
+			return err
+		}
+	}
+
+	// Print current node after space
+	_, err := fmt.Fprintf(
+		w, "\n%s%v %v %v\n",
+		strings.Repeat(" ", max(space - count, 0)),
+		tree.fetch(root).entry.Key,
+		tree.fetch(root).entry.Val,
+		tree.fetch(root).getFlag(FT_COLOR),
+	)
+	if err != nil {
+		return errors.Wrap(err, "failed to write node")
+	}
+
+	// Process left child
+	if root != tree.meta.nullPtr {
+		return tree.print(w, tree.fetch(root).left, space, count)
+	}
+	return nil
+}
+
+func (tree *RBTree[K, V]) WriteAll() (err error) {
+	if tree.onOp != nil {
+		defer tree.observe(OpWriteAll, time.Now(), &err)
+	}
+
+	tree.mu.Lock()
+	defer tree.mu.Unlock()
+
+	if err := tree.writeAll(); err != nil {
+		return err
+	}
+	tree.evictPages()
+	return nil
+}
+
+// Sync writes dirty pages and meta and fsyncs tree file. With
+// Options.NoAutoSync, or when using InsertMem, DeleteMem and other *Mem
+// methods, changes stay in memory until Sync is called, so callers can batch
+// many changes and Sync them periodically. Changes not synced are lost on
+// crash, tree on disk stays as of the last Sync.
+func (tree *RBTree[K, V]) Sync() (err error) {
+	if tree.onOp != nil {
+		defer tree.observe(OpWriteAll, time.Now(), &err)
+	}
+
+	tree.mu.Lock()
+	defer tree.mu.Unlock()
+
+	if err := tree.writeAll(); err != nil {
+		return errors.Wrap(err, "failed to write all")
+	}
+	tree.evictPages()
+	return errors.Wrap(tree.fsync(), "failed to fsync tree file")
+}
+
+// fsync flushes tree file from OS cache to disk, pager keeps no handle for it
+func (tree *RBTree[K, V]) fsync() error {
+	if _, ok := tree.pager.(memPager); ok || tree.pager.ReadOnly() {
+		return nil
+	}
+
+	f, err := os.OpenFile(tree.file, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// FlushN writes at most maxPages dirty pages and returns how many are still
+// dirty, so flushing can be spread over time. Meta is written when no dirty
+// pages remain.
+func (tree *RBTree[K, V]) FlushN(maxPages int) (remaining int, err error) {
+	if tree.onOp != nil {
+		defer tree.observe(OpWriteAll, time.Now(), &err)
+	}
+
+	tree.mu.Lock()
+	defer tree.mu.Unlock()
+
+	remaining, err = tree.flushN(maxPages)
+	return remaining, errors.Wrap(err, "failed to flush pages")
+}
+
+// NodeDistribution returns number of nodes reachable from root per page id.
+// Tombstones are counted too as they take node slots. Nodes spread over many
+// sparse pages mean poor traversal locality.
+func (tree *RBTree[K, V]) NodeDistribution() (dist map[uint32]int, err error) {
+	tree.mu.RLock()
+	defer tree.runlockErr(&err)
+
+	dist = map[uint32]int{}
+	c := tree.newCursor()
+	defer c.release()
+	for ok := c.first(); ok; ok = c.next() {
+		dist[tree.pointer(c.ptr()).pageId]++
+	}
+	return dist, nil
+}
+
+// IsDirty reports whether there are changes not written to disk yet
+func (tree *RBTree[K, V]) IsDirty() bool {
+	tree.mu.RLock()
+	defer tree.runlock()
+
+	return tree.meta.dirty || tree.pages.hasDirty()
+}
+
+// DropCache evicts clean pages from page cache to reclaim memory. Dirty
+// pages and pages holding null and root nodes are kept.
+func (tree *RBTree[K, V]) DropCache() {
+	tree.mu.Lock()
+	defer tree.mu.Unlock()
+
+	nullPage := tree.pointer(tree.meta.nullPtr).pageId
+	rootPage := tree.pointer(tree.meta.rootPtr).pageId
+	n := tree.pages.removeIf(func(p *page[K, V]) bool {
+		return p.id != nullPage && p.id != rootPage && !p.isDirty()
+	})
+	tree.log(LogDebug, "pages evicted", "pages", n)
+}
+
+func (tree *RBTree[K, V]) Close() error {
+	tree.stopAsync()
+
+	tree.mu.Lock()
+	defer tree.mu.Unlock()
+
+	if tree.pager == nil {
+		return nil
+	}
+
+	flushErr := tree.writeAll()
+	if flushErr == nil && tree.flushErr != nil {
+		flushErr = errors.Wrap(tree.flushErr, "background flush failed")
+	}
+	err := tree.close()
+	if flushErr == nil {
+		return err
+	} else if err != nil {
+		return errors.Wrapf(flushErr, "failed to flush RBTree on close, close error: %v", err)
+	}
+	return errors.Wrap(flushErr, "failed to flush RBTree on close")
+}
+
+// CloseNoFlush closes tree dropping all changes not written yet
+func (tree *RBTree[K, V]) CloseNoFlush() error {
+	tree.stopAsync()
+
+	tree.mu.Lock()
+	defer tree.mu.Unlock()
+
+	if tree.pager == nil {
+		return nil
+	}
+	return tree.close()
+}
+
+// Remove deletes tree file and releases the lock. Lock file is kept, since
+// removing it could let other Open lock a new file while it is still held.
+func (tree *RBTree[K, V]) Remove() {
+	tree.stopAsync()
+	tree.releaseSnapshots()
+	tree.pager.Remove()
+	if tree.wal != nil {
+		tree.wal.remove()
+		tree.wal = nil
+	}
+	if tree.lock != nil {
+		unlockFile(tree.lock)
+		tree.lock = nil
+	}
+}
+
+// persist writes changes of completed operation to disk, in AsyncWrites
+// mode it only asks background flushLoop to do it
+func (tree *RBTree[K, V]) persist() error {
+	if tree.noAutoSync {
+		return nil
+	} else if tree.flushCh == nil {
+		return errors.Wrap(tree.writeAll(), "failed to write all")
+	}
+
+	select {
+	case tree.flushCh <- struct{}{}:
+	default: // flush is already pending
+	}
+	return nil
+}
+
+func (tree *RBTree[K, V]) flushLoop() {
+	defer close(tree.flushDone)
+
+	for range tree.flushCh {
+		tree.mu.Lock()
+		if tree.pager != nil {
+			if err := tree.writeAll(); err != nil {
+				tree.flushErr = err
+				tree.log(LogError, "background flush failed", "err", err)
+			}
+		}
+		tree.mu.Unlock()
+	}
+}
+
+// stopAsync stops flushLoop waiting for pending flush
+func (tree *RBTree[K, V]) stopAsync() {
+	if tree.flushCh == nil {
+		return
+	}
+
+	tree.stopFlush.Do(func() {
+		close(tree.flushCh)
+		<-tree.flushDone
+	})
+}
+
+// unlock releases write lock. In NoCache mode changes are written through
+// and cached pages are dropped first, write error is returned via err.
+func (tree *RBTree[K, V]) unlock(err *error) {
+	r := recover()
+	if fe, ok := r.(fetchError); ok {
+		*err, r = fe.error, nil
+	}
+
+	if tree.noCache {
+		if flushErr := tree.writeAll(); flushErr != nil && *err == nil {
+			*err = errors.Wrap(flushErr, "failed to write through")
+		}
+		tree.releaseCache()
+	} else {
+		tree.evictPages()
+	}
+	if *err != nil && !errors.Is(*err, ErrNotFound) && !errors.Is(*err, ErrKeyAlreadyExists) {
+		tree.log(LogError, "operation failed", "err", *err)
+	}
+	tree.approxCount.Store(int64(tree.meta.count - tree.meta.tombstones))
+	tree.mu.Unlock()
+	if r != nil {
+		panic(r)
+	}
+}
+
+// runlock releases read lock, dropping pages read under it in NoCache mode
+func (tree *RBTree[K, V]) runlock() {
+	if tree.noCache {
+		tree.releaseCache()
+	} else {
+		tree.evictPages()
+	}
+	tree.mu.RUnlock()
+}
+
+// runlockErr is runlock which also returns failed fetch as err
+func (tree *RBTree[K, V]) runlockErr(err *error) {
+	r := recover()
+	if fe, ok := r.(fetchError); ok {
+		*err, r = fe.error, nil
+	}
+
+	tree.runlock()
+	if r != nil {
+		panic(r)
+	}
+}
+
+// releaseCache drops all clean pages
+func (tree *RBTree[K, V]) releaseCache() {
+	n := tree.pages.removeIf(func(p *page[K, V]) bool {
+		return !p.isDirty()
+	})
+	tree.log(LogDebug, "pages evicted", "pages", n)
+}
+
+// evictPages keeps page cache within Options.MaxCachedPages. It runs when
+// operation ends, so nodes it holds are never dropped from under it.
+func (tree *RBTree[K, V]) evictPages() {
+	if tree.pages.max <= 0 {
+		return
+	}
+
+	nullPage := tree.pointer(tree.meta.nullPtr).pageId
+	rootPage := tree.pointer(tree.meta.rootPtr).pageId
+	if n := tree.pages.evict(func(p *page[K, V]) bool {
+		return p.id == nullPage || p.id == rootPage
+	}); n > 0 {
+		tree.log(LogDebug, "pages evicted", "pages", n)
+	}
+}
+
+// CacheStats returns page cache counters
+func (tree *RBTree[K, V]) CacheStats() CacheStats {
+	return tree.pages.stats()
+}
+
+func (tree *RBTree[K, V]) log(level, msg string, kv ...any) {
+	if tree.logger != nil {
+		tree.logger(level, msg, kv...)
+	}
+}
 
-	return tree.print(tree.meta.rootPtr, 0, count)
+// logRebalance logs fixup of op which needed rotations since given count
+func (tree *RBTree[K, V]) logRebalance(op string, rotations int) {
+	if tree.logger != nil && tree.rotations > rotations {
+		tree.logger(LogDebug, "rebalanced", "op", op, "rotations", tree.rotations - rotations)
+	}
 }
 
-func (tree *RBTree[K, V]) print(root uint32, space int, count int) error {
-	// count := tree.pager.Count()
-	// for i := uint32(1); i < uint32(count); i++ {
-	// 	p := tree.page(i)
-	// 	if err := tree.pager.Unmarshal(uint64(p.id), p); err != nil {
-	// 		return errors.Wrap(err, "failed to unmarshal page")
-	// 	}
-	// 	nodes := p.nodes[:tree.meta.count]
-	// 	fmt.Println(nodes)
-	// }
-	// return nil
+func (tree *RBTree[K, V]) observe(op string, start time.Time, err *error) {
+	tree.onOp(op, time.Since(start), *err)
+}
 
-	if root == 0 {
-		return nil
+func (tree *RBTree[K, V]) close() error {
+	tree.releaseSnapshots()
+	err := tree.pager.Close()
+	tree.pager = nil
+	if tree.wal != nil {
+		if e := tree.wal.close(); err == nil {
+			err = e
+		}
+		tree.wal = nil
 	}
+	if tree.lock != nil {
+		if e := unlockFile(tree.lock); err == nil {
+			err = e
+		}
+		tree.lock = nil
+	}
+	return errors.Wrap(err, "failed to close RBTree")
+}
 
-	// Increase distance between levels
-	space += count
-
-	// Process right child first
-	if root != tree.meta.nullPtr {
-		tree.print(tree.fetch(root).right, space, count)
+func (tree *RBTree[K, V]) get(key K) (uint32, error) {
+	if tree.allowDups {
+		return tree.getFirst(key)
+	} else if c, ok := any(key).(KeyComparer[K]); ok && !tree.customOrder() {
+		return tree.getCompared(c)
 	}
 
-	// Print current node after space
-	// count
-	fmt.Println()
-	for i := count; i < space; i++ {
-		fmt.Print(" ")
+	searchingKey, err := tree.prepare(key)
+	if err != nil {
+		return 0, err
 	}
 
-	fmt.Println(
-		tree.fetch(root).entry.Key,
-		tree.fetch(root).entry.Val,
-		tree.fetch(root).getFlag(FT_COLOR),
-	)
+	lastGreaterPtr := tree.meta.nullPtr
+	ptr := tree.meta.rootPtr
+	for ptr != tree.meta.nullPtr {
+		k, err := tree.nodeKey(tree.fetch(ptr))
+		if err != nil {
+			return 0, errors.Wrap(err, "failed to prepare entry key")
+		}
 
-	// Process left child
-	if root != tree.meta.nullPtr {
-		tree.print(tree.fetch(root).left, space, count)
+		cmp := tree.compareOrder(k, searchingKey)
+		if cmp < 0 {
+			ptr = tree.fetch(ptr).right
+		} else if cmp > 0 {
+			lastGreaterPtr = ptr
+			ptr = tree.fetch(ptr).left
+		} else {
+			return ptr, nil
+		}
 	}
-	return nil
+	return lastGreaterPtr, ErrNotFound
 }
 
-func (tree *RBTree[K, V]) WriteAll() error {
-	tree.mu.Lock()
-	defer tree.mu.Unlock()
+// getFirst is get for trees with duplicate keys, it returns the first live
+// node with equal key, or the first equal one if all of them are deleted
+func (tree *RBTree[K, V]) getFirst(key K) (uint32, error) {
+	searchingKey, err := tree.prepare(key)
+	if err != nil {
+		return 0, err
+	}
 
-	return tree.writeAll()
-}
+	lastGreaterPtr, found := tree.meta.nullPtr, false
+	for ptr := tree.meta.rootPtr; ptr != tree.meta.nullPtr; {
+		k, err := tree.nodeKey(tree.fetch(ptr))
+		if err != nil {
+			return 0, errors.Wrap(err, "failed to prepare entry key")
+		}
 
-func (tree *RBTree[K, V]) Close() error {
-	if tree.pager == nil {
-		return nil
+		cmp := tree.compareOrder(k, searchingKey)
+		if cmp < 0 {
+			ptr = tree.fetch(ptr).right
+		} else {
+			lastGreaterPtr, found = ptr, found || cmp == 0
+			ptr = tree.fetch(ptr).left
+		}
+	}
+	if !found {
+		return lastGreaterPtr, ErrNotFound
 	}
 
-	_ = tree.writeAll()
-	err := tree.pager.Close()
-	tree.pager = nil
-	return errors.Wrap(err, "failed to close RBTree")
+	for ptr := lastGreaterPtr; ptr != tree.meta.nullPtr && tree.fetch(ptr).isTombstone(); {
+		if ptr = tree.successor(ptr); ptr == tree.meta.nullPtr {
+			break
+		}
+		k, err := tree.nodeKey(tree.fetch(ptr))
+		if err != nil {
+			return 0, errors.Wrap(err, "failed to prepare entry key")
+		}
+		if tree.compareOrder(k, searchingKey) != 0 {
+			break
+		} else if !tree.fetch(ptr).isTombstone() {
+			return ptr, nil
+		}
+	}
+	return lastGreaterPtr, nil
 }
 
-func (tree *RBTree[K, V]) Remove() {
-	tree.pager.Remove()
+// getCompared is get for keys implementing KeyComparer
+func (tree *RBTree[K, V]) getCompared(key KeyComparer[K]) (uint32, error) {
+	lastGreaterPtr := tree.meta.nullPtr
+	ptr := tree.meta.rootPtr
+	for ptr != tree.meta.nullPtr {
+		n := tree.fetch(ptr)
+		cmp := key.CompareTo(n.entry.Key)
+		if cmp > 0 {
+			ptr = n.right
+		} else if cmp < 0 {
+			lastGreaterPtr = ptr
+			ptr = n.left
+		} else {
+			return ptr, nil
+		}
+	}
+	return lastGreaterPtr, ErrNotFound
 }
 
-func (tree *RBTree[K, V]) get(key K) (uint32, error) {
-	searchingKey, err := key.MarshalBinary()
+// floor returns pointer to node with the greatest key less or equal to key,
+// or nullPtr if there is no such node
+func (tree *RBTree[K, V]) floor(key K) (uint32, error) {
+	searchingKey, err := tree.prepare(key)
 	if err != nil {
-		return 0, errors.Wrap(err, "failed to marshal entry")
+		return 0, err
 	}
 
-	lastGreaterPtr := tree.meta.nullPtr
+	lastLessPtr := tree.meta.nullPtr
 	ptr := tree.meta.rootPtr
 	for ptr != tree.meta.nullPtr {
-		k, err := tree.fetch(ptr).entry.Key.MarshalBinary()
+		k, err := tree.nodeKey(tree.fetch(ptr))
 		if err != nil {
-			return 0, errors.Wrap(err, "failed to marshal entry")
+			return 0, errors.Wrap(err, "failed to prepare entry key")
 		}
 
-		cmp := bytes.Compare(k, searchingKey)
-		if cmp == -1 {
+		cmp := tree.compareOrder(k, searchingKey)
+		if cmp < 0 {
+			lastLessPtr = ptr
 			ptr = tree.fetch(ptr).right
-		} else if cmp == 1 {
-			lastGreaterPtr = ptr
+		} else if cmp > 0 {
 			ptr = tree.fetch(ptr).left
 		} else {
 			return ptr, nil
 		}
 	}
-	return lastGreaterPtr, ErrNotFound
+	return lastLessPtr, nil
 }
 
+// height returns upper bound of root to leaf path length, 0 for empty tree
 func (tree *RBTree[K, V]) height() int {
+	if tree.meta.count <= 1 {
+		return int(tree.meta.count)
+	}
 	return 2 * int(math.Ceil(math.Log2(float64(tree.meta.count)))) + 1
 }
 
@@ -363,7 +2182,15 @@ func (tree *RBTree[K, V]) fixDelete(x uint32) {
 	tree.fetch(x).setBlack()
 }
 
-func (tree *RBTree[K, V]) delete(z uint32) {
+func (tree *RBTree[K, V]) delete(z uint32) error {
+	if z == 0 || z == tree.meta.nullPtr {
+		return errors.Wrapf(ErrNullPtrDelete, "ptr:'%v'", z)
+	}
+
+	if z == tree.maxPtr {
+		tree.maxPtr = 0
+	}
+
 	var x uint32
 	y := z
 	yOriginalColor := tree.fetch(y).getFlag(FT_COLOR)
@@ -380,32 +2207,37 @@ func (tree *RBTree[K, V]) delete(z uint32) {
 		x = tree.fetch(y).right
 
 		if tree.fetch(y).parent == z { // y is direct child of z
-			tree.fetch(x).dirty = true
+			tree.fetch(x).markDirty()
 			tree.fetch(x).parent = y
 		} else {
 			tree.transplant(y, x)
-			tree.fetch(y).dirty = true
+			tree.fetch(y).markDirty()
 			tree.fetch(y).right = tree.fetch(z).right
-			tree.fetch(tree.fetch(y).right).dirty = true
+			tree.fetch(tree.fetch(y).right).markDirty()
 			tree.fetch(tree.fetch(y).right).parent = y
 		}
 
 		tree.transplant(z, y)
 
-		tree.fetch(y).dirty = true
+		tree.fetch(y).markDirty()
 		tree.fetch(y).left = tree.fetch(z).left
-		tree.fetch(tree.fetch(y).left).dirty = true
+		tree.fetch(tree.fetch(y).left).markDirty()
     tree.fetch(tree.fetch(y).left).parent = y
     tree.fetch(y).setFlag(FT_COLOR, tree.fetch(z).getFlag(FT_COLOR))
 	}
 
+	// x parent is the lowest node whose subtree lost z
+	tree.resizeUp(tree.fetch(x).parent)
 	if yOriginalColor == FV_COLOR_BLACK {
+		rotations := tree.rotations
 		tree.fixDelete(x)
+		tree.logRebalance(OpDelete, rotations)
 	}
 
-	tree.free(z)
 	tree.meta.dirty = true
 	tree.meta.count--
+	tree.meta.seq++
+	return errors.Wrap(tree.free(z), "failed to free node")
 }
 
 func (tree *RBTree[K, V]) minimum(x uint32) uint32 {
@@ -415,12 +2247,47 @@ func (tree *RBTree[K, V]) minimum(x uint32) uint32 {
 	return x
 }
 
+func (tree *RBTree[K, V]) maximum(x uint32) uint32 {
+	for tree.fetch(x).right != tree.meta.nullPtr {
+		x = tree.fetch(x).right
+	}
+	return x
+}
+
+// successor returns in-order successor of x or nullPtr
+func (tree *RBTree[K, V]) successor(x uint32) uint32 {
+	if right := tree.fetch(x).right; right != tree.meta.nullPtr {
+		return tree.minimum(right)
+	}
+
+	y := tree.fetch(x).parent
+	for y != tree.meta.nullPtr && x == tree.fetch(y).right {
+		x = y
+		y = tree.fetch(y).parent
+	}
+	return y
+}
+
+// predecessor returns in-order predecessor of x or nullPtr
+func (tree *RBTree[K, V]) predecessor(x uint32) uint32 {
+	if left := tree.fetch(x).left; left != tree.meta.nullPtr {
+		return tree.maximum(left)
+	}
+
+	y := tree.fetch(x).parent
+	for y != tree.meta.nullPtr && x == tree.fetch(y).left {
+		x = y
+		y = tree.fetch(y).parent
+	}
+	return y
+}
+
 func (tree *RBTree[K, V]) transplant(u, v uint32) {
 	if tree.fetch(u).parent == tree.meta.nullPtr { // u is root
 		tree.meta.dirty = true
 		tree.meta.rootPtr = v
 	} else {
-		tree.fetch(tree.fetch(u).parent).dirty = true
+		tree.fetch(tree.fetch(u).parent).markDirty()
 		if u == tree.fetch(tree.fetch(u).parent).left { // u is left child
 			tree.fetch(tree.fetch(u).parent).left = v
 		} else { // u is right child
@@ -428,7 +2295,7 @@ func (tree *RBTree[K, V]) transplant(u, v uint32) {
 		}
 	}
 
-	tree.fetch(v).dirty = true
+	tree.fetch(v).markDirty()
 	tree.fetch(v).parent = tree.fetch(u).parent
 }
 
@@ -481,49 +2348,72 @@ func (tree *RBTree[K, V]) fixInsert(z uint32) {
 }
 
 func (tree *RBTree[K, V]) insert(z uint32) error {
+	if err := tree.link(z); err != nil {
+		return err
+	}
+
+	tree.resizeUp(z)
+	z = tree.place(z)
+	rotations := tree.rotations
+	tree.fixInsert(z)
+	tree.logRebalance(OpInsert, rotations)
+
+	tree.meta.dirty = true
+	tree.meta.count++
+	tree.meta.seq++
+	return nil
+}
+
+// link places z as a leaf in binary search tree order without rebalancing
+func (tree *RBTree[K, V]) link(z uint32) error {
 	y := tree.meta.nullPtr
 	temp := tree.meta.rootPtr
 
 	for temp != tree.meta.nullPtr {
 		y = temp
-		searchingKey, err := tree.fetch(z).entry.Key.MarshalBinary()
+		searchingKey, err := tree.nodeKey(tree.fetch(z))
 		if err != nil {
-			return errors.Wrap(err, "failed to marshal searching entry key")
+			return errors.Wrap(err, "failed to prepare searching entry key")
 		}
 
-		currentKey, err := tree.fetch(temp).entry.Key.MarshalBinary()
+		currentKey, err := tree.nodeKey(tree.fetch(temp))
 		if err != nil {
-			return errors.Wrap(err, "failed to marshal current entry key")
+			return errors.Wrap(err, "failed to prepare current entry key")
 		}
 
-		if bytes.Compare(searchingKey, currentKey) == -1 {
+		// keys equal to the current one descend right, so an equal key always
+		// lands after the existing ones and full in-order traversal (Scan with
+		// nil key) yields equal keys in insertion order. Searches by key stop
+		// at whichever equal node they reach first, which need not be the
+		// oldest one.
+		if tree.compareOrder(searchingKey, currentKey) < 0 {
 			temp = tree.fetch(temp).left
 		} else {
 			temp = tree.fetch(temp).right
 		}
 	}
 
-	tree.fetch(z).dirty = true
+	tree.fetch(z).markDirty()
 	tree.fetch(z).parent = y
 	if y == tree.meta.nullPtr {
 		tree.meta.dirty = true
 		tree.meta.rootPtr = z
 	} else {
-		zKey, err := tree.fetch(z).entry.Key.MarshalBinary()
+		zKey, err := tree.nodeKey(tree.fetch(z))
 		if err != nil {
-			return errors.Wrap(err, "failed to marshal searching entry key")
+			return errors.Wrap(err, "failed to prepare searching entry key")
 		}
 
-		yKey, err := tree.fetch(y).entry.Key.MarshalBinary()
+		yKey, err := tree.nodeKey(tree.fetch(y))
 		if err != nil {
-			return errors.Wrap(err, "failed to marshal current entry key")
+			return errors.Wrap(err, "failed to prepare current entry key")
 		}
 
-		if bytes.Compare(zKey, yKey) == -1 {
-			tree.fetch(y).dirty = true
+		if tree.compareOrder(zKey, yKey) < 0 {
+			tree.fetch(y).markDirty()
 			tree.fetch(y).left = z
 		} else {
-			tree.fetch(y).dirty = true
+			tree.fetch(y).markDirty()
 			tree.fetch(y).right = z
 		}
 	}
@@ -531,31 +2421,79 @@ func (tree *RBTree[K, V]) insert(z uint32) error {
 	tree.fetch(z).left = tree.meta.nullPtr
 	tree.fetch(z).right = tree.meta.nullPtr
 
+	if y == tree.meta.nullPtr || y == tree.maxPtr && tree.fetch(y).right == z {
+		tree.maxPtr = z
+	}
+	return nil
+}
+
+// insertMax attaches z as right child of current maximum node, z key must be
+// greater than maximum key
+func (tree *RBTree[K, V]) insertMax(z uint32) {
+	y := tree.maxPtr
+
+	tree.fetch(y).markDirty()
+	tree.fetch(y).right = z
+	tree.fetch(z).markDirty()
+	tree.fetch(z).parent = y
+	tree.fetch(z).left = tree.meta.nullPtr
+	tree.fetch(z).right = tree.meta.nullPtr
+	tree.maxPtr = z
+
+	tree.resizeUp(z)
+	z = tree.place(z)
+	rotations := tree.rotations
 	tree.fixInsert(z)
+	tree.logRebalance(OpInsert, rotations)
 
 	tree.meta.dirty = true
 	tree.meta.count++
-	return nil
+	tree.meta.seq++
+}
+
+// greaterThanMax reports whether key is greater than the greatest key in
+// tree, maximum node pointer is cached in maxPtr
+func (tree *RBTree[K, V]) greaterThanMax(key K) (bool, error) {
+	if tree.meta.rootPtr == tree.meta.nullPtr {
+		return false, nil
+	}
+
+	if tree.maxPtr == 0 {
+		tree.maxPtr = tree.maximum(tree.meta.rootPtr)
+	}
+
+	k, err := tree.prepare(key)
+	if err != nil {
+		return false, errors.Wrap(err, "failed to prepare key")
+	}
+
+	maxKey, err := tree.nodeKey(tree.fetch(tree.maxPtr))
+	if err != nil {
+		return false, errors.Wrap(err, "failed to prepare max key")
+	}
+
+	return tree.compareOrder(k, maxKey) > 0, nil
 }
 
 func (tree *RBTree[K, V]) leftRotate(x uint32) {
+	tree.rotations++
 	y := tree.fetch(x).right
 
-	tree.fetch(x).dirty = true
+	tree.fetch(x).markDirty()
 	tree.fetch(x).right = tree.fetch(y).left
 	if tree.fetch(y).left != tree.meta.nullPtr {
-		tree.fetch(tree.fetch(y).left).dirty = true
+		tree.fetch(tree.fetch(y).left).markDirty()
 		tree.fetch(tree.fetch(y).left).parent = x
 	}
 
-	tree.fetch(y).dirty = true
+	tree.fetch(y).markDirty()
 	tree.fetch(y).parent = tree.fetch(x).parent
 
 	if tree.fetch(x).parent == tree.meta.nullPtr { // x is root
 		tree.meta.dirty = true
 		tree.meta.rootPtr = y
 	} else {
-		tree.fetch(tree.fetch(x).parent).dirty = true
+		tree.fetch(tree.fetch(x).parent).markDirty()
 		if tree.fetch(tree.fetch(x).parent).left == x { // x is left child
 			tree.fetch(tree.fetch(x).parent).left = y
 		} else { // x is right child
@@ -565,26 +2503,29 @@ func (tree *RBTree[K, V]) leftRotate(x uint32) {
 
 	tree.fetch(y).left = x
 	tree.fetch(x).parent = y
+	tree.resize(x)
+	tree.resize(y)
 }
 
 func (tree *RBTree[K, V]) rightRotate(x uint32) {
+	tree.rotations++
 	y := tree.fetch(x).left
 
-	tree.fetch(x).dirty = true
+	tree.fetch(x).markDirty()
 	tree.fetch(x).left = tree.fetch(y).right
 	if tree.fetch(y).right != tree.meta.nullPtr {
-		tree.fetch(tree.fetch(y).right).dirty = true
+		tree.fetch(tree.fetch(y).right).markDirty()
 		tree.fetch(tree.fetch(y).right).parent = x
 	}
 
-	tree.fetch(y).dirty = true
+	tree.fetch(y).markDirty()
 	tree.fetch(y).parent = tree.fetch(x).parent
 
 	if tree.fetch(x).parent == tree.meta.nullPtr { // x is root
 		tree.meta.dirty = true
 		tree.meta.rootPtr = y
 	} else {
-		tree.fetch(tree.fetch(x).parent).dirty = true
+		tree.fetch(tree.fetch(x).parent).markDirty()
 		if tree.fetch(tree.fetch(x).parent).right == x { // x is right child
 			tree.fetch(tree.fetch(x).parent).right = y
 		} else { // x is left child
@@ -594,12 +2535,39 @@ func (tree *RBTree[K, V]) rightRotate(x uint32) {
 
 	tree.fetch(y).right = x
 	tree.fetch(x).parent = y
+	tree.resize(x)
+	tree.resize(y)
+}
+
+// resize recomputes subtree size of x from its children
+func (tree *RBTree[K, V]) resize(x uint32) {
+	if !tree.meta.hasFlag(META_SIZES) || x == tree.meta.nullPtr {
+		return
+	}
+
+	n := tree.fetch(x)
+	size := tree.fetch(n.left).size + tree.fetch(n.right).size
+	if !n.isTombstone() {
+		size++
+	}
+	if n.size != size {
+		n.markDirty()
+		n.size = size
+	}
+}
+
+// resizeUp recomputes subtree sizes on the path from x to root
+func (tree *RBTree[K, V]) resizeUp(x uint32) {
+	for x != tree.meta.nullPtr {
+		tree.resize(x)
+		x = tree.fetch(x).parent
+	}
 }
 
 func (tree *RBTree[K, V]) pointer(rawPtr uint32) *pointer {
 	return &pointer{
 		pageId: rawPtr / uint32(tree.meta.pageSize),
-		index:  (uint16(rawPtr) % tree.meta.pageSize) / tree.nodeSize,
+		index:  uint16(rawPtr % uint32(tree.meta.pageSize)) / tree.nodeSize,
 	}
 }
 
@@ -611,17 +2579,38 @@ func (tree *RBTree[K, V]) page(id uint32) *page[K, V] {
 	var k K
 	var v V
 	return &page[K, V]{
-		dirty: true,
-		id:    id,
-		size:  tree.meta.pageSize,
-		entry: &Entry[K, V]{k.New().(K), v.New().(V)},
-		nodes: make([]*node[K, V], tree.degree),
+		dirty:      true,
+		id:         id,
+		size:       tree.meta.pageSize,
+		entry:      &Entry[K, V]{k.New().(K), v.New().(V)},
+		nodes:      make([]*node[K, V], tree.degree),
+		tombstones: tree.meta.hasFlag(META_TOMBSTONES),
+		cache:      tree.pages,
+		generations: tree.meta.hasFlag(META_GENERATIONS),
+		sizes:       tree.meta.hasFlag(META_SIZES),
+		checksums:   tree.meta.hasFlag(META_CHECKSUMS),
+		verify:      tree.verifySums,
+	}
+}
+
+// fetchError is panic value of failed fetch. Node helpers assume fetch
+// succeeds, so failure unwinds to the operation, which returns it as error.
+type fetchError struct {
+	error
+}
+
+// fetchFailure returns error of recovered fetch failure, other panics are
+// resumed
+func fetchFailure(r any) error {
+	if fe, ok := r.(fetchError); ok {
+		return fe.error
 	}
+	panic(r)
 }
 
 func (tree *RBTree[K, V]) fetch(rawPtr uint32) *node[K, V] {
 	if rawPtr == 0 {
-		panic(ErrInvalidPointer)
+		panic(fetchError{errors.Wrap(ErrInvalidPointer, "failed to fetch null pointer")})
 	}
 
 	ptr := tree.pointer(rawPtr)
@@ -629,24 +2618,32 @@ func (tree *RBTree[K, V]) fetch(rawPtr uint32) *node[K, V] {
 }
 
 func (tree *RBTree[K, V]) fetchPage(id uint32) *page[K, V] {
-	if p, ok := tree.pages[id]; ok {
+	if p, ok := tree.pages.get(id); ok {
 		return p
 	}
 
+	tree.log(LogDebug, "page cache miss", "page", id)
 	p := tree.page(id)
+	tree.io.pageReads.Add(1)
 	if err := tree.pager.Unmarshal(uint64(id), p); err != nil {
-		panic(errors.Wrap(err, "failed to unmarshal fetched page"))
+		panic(fetchError{errors.Wrapf(err, "failed to unmarshal page:'%v'", id)})
 	}
 
 	p.dirty = false
-	tree.pages[id] = p
-	return p
+	return tree.pages.add(p)
 }
 
+// alloc returns pointer to a new node slot. Raw pointers are uint32 byte
+// offsets, so tree file can not grow beyond 4GiB, ErrFileTooLarge is
+// returned instead of allocating a page which would end past it.
 func (tree *RBTree[K, V]) alloc() (uint32, error) {
 	topPtr := tree.pointer(tree.meta.top)
 
 	if topPtr.index == 0 {
+		if uint64(topPtr.pageId + 1) * uint64(tree.meta.pageSize) > math.MaxUint32 {
+			return 0, errors.Wrapf(ErrFileTooLarge, "pages:'%v'", topPtr.pageId)
+		}
+
 		var err error
 		_, err = tree.pager.Alloc(1)
 		if err != nil {
@@ -656,6 +2653,7 @@ func (tree *RBTree[K, V]) alloc() (uint32, error) {
 
 	ptr := tree.meta.top
 	tree.meta.dirty = true
+	tree.io.nodeAllocs.Add(1)
 	if topPtr.index == tree.degree - 1 {
 		topPtr.pageId++
 		topPtr.index = 0
@@ -677,66 +2675,179 @@ func (tree *RBTree[K, V]) free(ptr uint32) error {
 	}
 	lastNodePtr := tree.pointerRaw(lnPtr)
 
+	// last node takes freed slot, so nodes stay packed at file start
 	if ptr != lastNodePtr {
-		lastNode := tree.fetch(lastNodePtr)
-		parent := tree.fetch(lastNode.parent)
-
-		parent.dirty = true
-		if lastNodePtr == parent.left {
-			parent.left = ptr
-		} else {
-			parent.right = ptr
-		}
-
-		freedNode := tree.fetch(ptr)
-		freedNode.dirty = true
-		freedNode.flags = lastNode.flags
-		freedNode.left = lastNode.left
-		freedNode.parent = lastNode.parent
-		freedNode.right = lastNode.right
-		freedNode.entry = lastNode.entry
-
-		if freedNode.right != tree.meta.nullPtr {
-			fr := tree.fetch(freedNode.right)
-			fr.dirty = true
-			fr.parent = ptr
-		}
-		
-		if freedNode.left != tree.meta.nullPtr {
-			fl := tree.fetch(freedNode.left)
-			fl.dirty = true
-			fl.parent = ptr
-		}
-
-		if lastNodePtr == tree.meta.rootPtr {
-			tree.meta.rootPtr = ptr
-		}
+		tree.swap(ptr, lastNodePtr)
 	}
 
 	tree.meta.dirty = true
 	tree.meta.top = lastNodePtr
+	tree.io.nodeFrees.Add(1)
 	topPtr := tree.pointer(tree.meta.top)
 
 	if tree.pager.Count() > uint64(topPtr.pageId) + 1 {
+		tree.preserve(uint64(topPtr.pageId) + 1)
 		err := tree.pager.Free(1)
 		if err != nil {
 			return errors.Wrap(err, "failed to free last page")
 		}
-		delete(tree.pages, topPtr.pageId + 1)
+		tree.pages.remove(topPtr.pageId + 1)
 	}
 
 	return nil
 }
 
+// swap exchanges nodes stored in slots a and b, links of their neighbours,
+// root and max pointers are updated to the new slots
+func (tree *RBTree[K, V]) swap(a, b uint32) {
+	na, nb := tree.fetch(a), tree.fetch(b)
+	relink := func(ptr uint32) uint32 {
+		if ptr == a {
+			return b
+		} else if ptr == b {
+			return a
+		}
+		return ptr
+	}
+
+	// each node relinked once, neighbour may be linked to both a and b
+	neighbours := []*node[K, V]{na, nb}
+	seen := map[uint32]bool{a: true, b: true, tree.meta.nullPtr: true}
+	for _, ptr := range []uint32{na.parent, na.left, na.right, nb.parent, nb.left, nb.right} {
+		if !seen[ptr] {
+			seen[ptr] = true
+			neighbours = append(neighbours, tree.fetch(ptr))
+		}
+	}
+
+	na.flags, nb.flags = nb.flags, na.flags
+	na.deletedAt, nb.deletedAt = nb.deletedAt, na.deletedAt
+	na.size, nb.size = nb.size, na.size
+	na.entry, nb.entry = nb.entry, na.entry
+	na.rawKey, nb.rawKey = nb.rawKey, na.rawKey
+	na.rawFor, nb.rawFor = nb.rawFor, na.rawFor
+	na.parent, nb.parent = nb.parent, na.parent
+	na.left, nb.left = nb.left, na.left
+	na.right, nb.right = nb.right, na.right
+
+	for _, n := range neighbours {
+		n.markDirty()
+		n.parent = relink(n.parent)
+		n.left = relink(n.left)
+		n.right = relink(n.right)
+	}
+
+	tree.meta.dirty = true
+	tree.meta.rootPtr = relink(tree.meta.rootPtr)
+	tree.maxPtr = relink(tree.maxPtr)
+}
+
+// place moves freshly linked leaf z according to allocation strategy and
+// returns its final pointer
+func (tree *RBTree[K, V]) place(z uint32) uint32 {
+	if tree.allocStrategy != AllocNearParent {
+		return z
+	}
+
+	parent := tree.fetch(z).parent
+	if parent == tree.meta.nullPtr {
+		return z
+	}
+
+	pageId := tree.pointer(parent).pageId
+	if tree.pointer(z).pageId == pageId {
+		return z
+	}
+
+	// take the slot of a node which is already away from its parent
+	for i := uint16(0); i < tree.degree; i++ {
+		ptr := tree.pointerRaw(&pointer{pageId: pageId, index: i})
+		if ptr >= tree.meta.top {
+			break
+		}
+		if ptr == tree.meta.nullPtr || ptr == parent || ptr == tree.meta.rootPtr {
+			continue
+		}
+
+		if tree.pointer(tree.fetch(ptr).parent).pageId != pageId {
+			tree.swap(z, ptr)
+			return ptr
+		}
+	}
+	return z
+}
+
 func (tree *RBTree[K, V]) open(opts *Options) error {
 	if tree.pager.Count() == 0 {
 		return tree.init(opts)
 	}
 
+	tree.io.pageReads.Add(1)
 	if err := tree.pager.Unmarshal(0, tree.meta); err != nil {
 		return errors.Wrap(err, "failed to unmarshal meta")
 	}
 
+	var k K
+	var v V
+	tree.setLayout()
+	if err := tree.meta.checkFormat(opts.PageSize, uint16(k.Size()), uint16(v.Size())); err != nil {
+		return errors.Wrapf(err, "K:'%T', V:'%T'", k, v)
+	}
+	if tree.meta.hasFlag(META_TOMBSTONES) != opts.Tombstones {
+		return errors.Wrapf(ErrTombstonesMismatch, "file tombstones:'%v'", tree.meta.hasFlag(META_TOMBSTONES))
+	}
+
+	if !opts.IgnoreIncompleteFlush {
+		return tree.checkGenerations()
+	}
+	return nil
+}
+
+// setLayout computes node size and number of nodes per page for layout
+// flags of meta
+func (tree *RBTree[K, V]) setLayout() {
+	var k K
+	var v V
+	nodeSize := nodeFixedSize + k.Size() + v.Size()
+	if tree.meta.hasFlag(META_SIZES) {
+		nodeSize += subtreeSizeSize
+	}
+	if tree.meta.hasFlag(META_TOMBSTONES) {
+		nodeSize += tombstoneSize
+	}
+	tree.nodeSize = uint16(nodeSize)
+
+	space := uint16(tree.pager.PageSize())
+	if tree.meta.hasFlag(META_GENERATIONS) {
+		space -= pageTrailerSize
+	}
+	if tree.meta.hasFlag(META_CHECKSUMS) {
+		space -= checksumSize
+	}
+	tree.degree = space / tree.nodeSize
+}
+
+// checkGenerations reads generation trailer of every page and fails if some
+// page was written by a flush which did not commit meta
+func (tree *RBTree[K, V]) checkGenerations() error {
+	if !tree.meta.hasFlag(META_GENERATIONS) {
+		return nil
+	}
+
+	buf := make([]byte, pageTrailerSize)
+	pageSize := uint64(tree.pager.PageSize())
+	for id := uint64(1); id < tree.pager.Count(); id++ {
+		if err := tree.pager.ReadAt(buf, (id + 1) * pageSize - pageTrailerSize); err != nil {
+			return errors.Wrapf(err, "failed to read generation of page:'%v'", id)
+		}
+
+		if gen := bin.Uint64(buf); gen > tree.meta.generation {
+			return errors.Wrapf(
+				ErrIncompleteFlush, "page:'%v' generation:'%v', committed:'%v'",
+				id, gen, tree.meta.generation,
+			)
+		}
+	}
 	return nil
 }
 
@@ -756,7 +2867,13 @@ func (tree *RBTree[K, V]) init(opts *Options) error {
 		nodeKeySize: uint16(k.Size()),
 		nodeValSize: uint16(v.Size()),
 		top:         uint32(opts.PageSize),
+		createdAt:   time.Now().UnixNano(),
+	}
+	if opts.Tombstones {
+		tree.meta.flags |= META_TOMBSTONES
 	}
+	tree.meta.flags |= META_GENERATIONS | META_SIZES | META_CHECKSUMS
+	tree.setLayout()
 
 	nullNode, err := tree.alloc()
 	if err != nil {
@@ -773,34 +2890,188 @@ func (tree *RBTree[K, V]) init(opts *Options) error {
 }
 
 func (tree *RBTree[K, V]) writeAll() error {
+	_, err := tree.flushN(-1)
+	return err
+}
+
+// flushN marshals up to maxPages dirty pages (all of them when maxPages is
+// negative) and returns number of pages left dirty. Meta is written only
+// after the last dirty page is flushed.
+//
+// In trees with META_GENERATIONS flag every page written is stamped with
+// meta generation + 1, and meta with advanced generation is written after
+// the last page, committing them. A page stamped newer than meta generation
+// thus belongs to a flush interrupted before meta, Open detects it. Writes
+// are not fsynced, so the order holds for process crashes, not necessarily
+// for power loss.
+func (tree *RBTree[K, V]) flushN(maxPages int) (int, error) {
 	if tree.pager.ReadOnly() {
-		return nil
+		return 0, nil
 	}
 
-	for _, p := range tree.pages {
-		if !p.dirty {
-			for _, n := range p.nodes {
-				if n.dirty {
-					p.dirty = true
-					n.dirty = false
-					break
-				}
-			}
+	if err := tree.normalizeNull(); err != nil {
+		return 0, errors.Wrap(err, "failed to normalize null node")
+	}
+
+	dirty := tree.pages.dirtyPages()
+	remaining := len(dirty)
+	if tree.logger != nil {
+		start := time.Now()
+		tree.logger(LogDebug, "flush start", "pages", remaining)
+		defer func() {
+			tree.logger(LogDebug, "flush end", "written", len(dirty) - remaining, "dur", time.Since(start))
+		}()
+	}
+	if tree.wal != nil {
+		return tree.flushWAL(dirty, maxPages)
+	}
+	for _, p := range dirty {
+		if maxPages == 0 {
+			break
+		}
+
+		p.generation = tree.meta.generation + 1
+		tree.io.pageWrites.Add(1)
+		tree.preserve(uint64(p.id))
+		if err := tree.pager.Marshal(uint64(p.id), p); err != nil {
+			return 0, errors.Wrap(err, "failed to marshal dirty page")
 		}
+		p.clean()
+		tree.uncommitted = true
+		remaining--
+		maxPages--
+	}
+
+	if remaining > 0 {
+		return remaining, nil
+	}
+
+	tree.commitGeneration()
+	return 0, errors.Wrap(tree.writeMeta(), "failed to write meta")
+}
+
+// commitGeneration advances meta generation after the last page of flush
+// was written
+func (tree *RBTree[K, V]) commitGeneration() {
+	if tree.uncommitted && tree.meta.hasFlag(META_GENERATIONS) {
+		tree.meta.dirty = true
+		tree.meta.generation++
+	}
+	tree.uncommitted = false
+}
 
-		if p.dirty {
-			if err := tree.pager.Marshal(uint64(p.id), p); err != nil {
-				return errors.Wrap(err, "failed to marshal dirty page")
+// flushWAL is flushN logging pages and meta to write-ahead log before
+// writing them to tree file. Pages are cleaned and meta committed only once
+// they are written, so failed flush is retried in full.
+func (tree *RBTree[K, V]) flushWAL(dirty []*page[K, V], maxPages int) (int, error) {
+	records, written, next, err := tree.walRecords(dirty, maxPages)
+	if err != nil {
+		return len(dirty), err
+	}
+
+	if len(records) > 0 {
+		if err := tree.wal.write(records); err != nil {
+			return len(dirty), err
+		}
+		for _, r := range records {
+			tree.io.pageWrites.Add(1)
+			tree.preserve(r.id)
+			if err := tree.pager.Write(r.id, r.data); err != nil {
+				return len(dirty), errors.Wrap(err, "failed to write logged page")
 			}
-			p.dirty = false
 		}
+		if err := tree.fsync(); err != nil {
+			return len(dirty), errors.Wrap(err, "failed to fsync tree file")
+		}
+	}
+
+	for _, p := range written {
+		p.clean()
+		tree.uncommitted = true
+	}
+	if next != nil {
+		*tree.meta = *next
+		tree.meta.dirty = false
+		tree.uncommitted = false
+	}
+	if len(records) == 0 {
+		return len(dirty) - len(written), nil
+	}
+	return len(dirty) - len(written), tree.wal.reset()
+}
+
+// walRecords marshals up to maxPages dirty pages, and meta once no dirty
+// pages are left, returning records, pages they were made of and meta to
+// commit after records are written, nil unless flush completes. Tree meta is
+// not changed, so nothing is lost if writing records fails.
+func (tree *RBTree[K, V]) walRecords(
+	dirty []*page[K, V],
+	maxPages int,
+) ([]walRecord, []*page[K, V], *metadata, error) {
+	last := maxPages < 0 || maxPages >= len(dirty)
+	if !last {
+		dirty = dirty[:maxPages]
+	}
+
+	records := make([]walRecord, 0, len(dirty) + 1)
+	for _, p := range dirty {
+		p.generation = tree.meta.generation + 1
+		d, err := p.MarshalBinary()
+		if err != nil {
+			return nil, nil, nil, errors.Wrap(err, "failed to marshal dirty page")
+		}
+		records = append(records, walRecord{id: uint64(p.id), data: d})
+	}
+	if !last {
+		return records, dirty, nil, nil
+	}
+
+	// same as commitGeneration, applied to a copy
+	next := *tree.meta
+	if (tree.uncommitted || len(dirty) > 0) && next.hasFlag(META_GENERATIONS) {
+		next.dirty = true
+		next.generation++
+	}
+	if next.dirty {
+		next.modifiedAt = time.Now().UnixNano()
+		d, err := next.MarshalBinary()
+		if err != nil {
+			return nil, nil, nil, errors.Wrap(err, "failed to marshal dirty meta")
+		}
+		records = append(records, walRecord{id: 0, data: d})
+	}
+	return records, dirty, &next, nil
+}
+
+// normalizeNull resets scratch links left in null node by fixups, so it is
+// persisted the same way init creates it
+func (tree *RBTree[K, V]) normalizeNull() (err error) {
+	if tree.meta.nullPtr == 0 {
+		return nil
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			err = fetchFailure(r)
+		}
+	}()
+
+	n := tree.fetch(tree.meta.nullPtr)
+	if n.isBlack() && n.parent == 0 && n.left == 0 && n.right == 0 && n.size == 0 {
+		return nil
 	}
 
-	return errors.Wrap(tree.writeMeta(), "failed to write meta")
+	n.setBlack()
+	n.parent = 0
+	n.left = 0
+	n.right = 0
+	n.size = 0
+	return nil
 }
 
 func (tree *RBTree[K, V]) writeMeta() error {
 	if tree.meta.dirty {
+		tree.meta.modifiedAt = time.Now().UnixNano()
+		tree.io.pageWrites.Add(1)
 		err := tree.pager.Marshal(0, tree.meta)
 		tree.meta.dirty = false
 		return errors.Wrap(err, "failed to marshal dirty meta")
@@ -1,10 +1,19 @@
 package rbtree
 
 import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
 	"fmt"
+	"io"
+	"math"
+	"math/rand"
 	"os"
 	"path"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -17,6 +26,7 @@ func TestGetBit(t *testing.T) {
 		"rbtree_test.bin",
 		&Options{
 			PageSize: uint16(os.Getpagesize()),
+			KeyOnly:  true,
 		},
 	)
 
@@ -46,6 +56,3571 @@ func TestGetBit(t *testing.T) {
 	require.NoError(t, tree.WriteAll())
 }
 
+func TestEqualKeysOrder(t *testing.T) {
+	tree := openTestTree[*freelistKey, *testVal](t)
+
+	// bypass the uniqueness check of InsertMem to place equal keys directly
+	n := 200
+	for i := 0; i < n; i++ {
+		ptr, err := tree.alloc()
+		require.NoError(t, err)
+
+		tree.fetch(ptr).left = tree.meta.nullPtr
+		tree.fetch(ptr).right = tree.meta.nullPtr
+		tree.fetch(ptr).setRed()
+		tree.fetch(ptr).entry = &Entry[*freelistKey, *testVal]{
+			Key: &freelistKey{ptr: uint64(i % 7)},
+			Val: &testVal{v: uint32(i)},
+		}
+		require.NoError(t, tree.insert(ptr))
+	}
+
+	lastKey, lastVal := uint64(0), -1
+	visited := 0
+	require.NoError(t, tree.Scan(nil, func(key *freelistKey, val *testVal) (bool, error) {
+		if key.ptr != lastKey {
+			require.Greater(t, key.ptr, lastKey)
+			lastKey, lastVal = key.ptr, -1
+		}
+		require.Greater(t, int(val.v), lastVal, "equal keys must keep insertion order")
+		lastVal = int(val.v)
+		visited++
+		return false, nil
+	}))
+	require.Equal(t, n, visited)
+}
+
+func TestFlushN(t *testing.T) {
+	tree := openTestTree[*freelistKey, *testVal](t)
+
+	insertTestKeys(t, tree, testKeys(2000, 0, 1)...)
+
+	remaining, err := tree.FlushN(1)
+	require.NoError(t, err)
+	require.Greater(t, remaining, 0)
+	require.True(t, tree.meta.dirty, "meta must wait for the last page")
+
+	for remaining > 0 {
+		prev := remaining
+		remaining, err = tree.FlushN(1)
+		require.NoError(t, err)
+		require.Equal(t, prev-1, remaining)
+	}
+	require.False(t, tree.meta.dirty)
+}
+
+func TestIncompleteFlush(t *testing.T) {
+	fileName := path.Join(t.TempDir(), "rbtree_test")
+	opts := &Options{PageSize: 1024}
+	tree, err := Open[*freelistKey, *testVal](fileName, opts)
+	require.NoError(t, err)
+	require.True(t, tree.meta.hasFlag(META_GENERATIONS))
+	insertTestKeys(t, tree, testKeys(1000, 0, 1)...)
+	require.NoError(t, tree.WriteAll())
+	generation := tree.meta.generation
+	require.NoError(t, tree.Close())
+
+	// nothing changed, generation stays
+	tree, err = Open[*freelistKey, *testVal](fileName, opts)
+	require.NoError(t, err)
+	require.NoError(t, tree.WriteAll())
+	require.Equal(t, generation, tree.meta.generation)
+
+	// crash after some pages of a flush were written
+	insertTestKeys(t, tree, testKeys(1000, 1000, 1)...)
+	remaining, err := tree.FlushN(3)
+	require.NoError(t, err)
+	require.Positive(t, remaining)
+	require.NoError(t, tree.CloseNoFlush())
+
+	_, err = Open[*freelistKey, *testVal](fileName, opts)
+	require.ErrorIs(t, err, ErrIncompleteFlush)
+
+	tree, err = Open[*freelistKey, *testVal](fileName, &Options{PageSize: 1024, IgnoreIncompleteFlush: true})
+	require.NoError(t, err)
+	require.Equal(t, generation, tree.meta.generation)
+	require.NoError(t, tree.CloseNoFlush())
+}
+
+func TestDirtyPages(t *testing.T) {
+	tree := openTestTree[*freelistKey, *testVal](t)
+	insertTestKeys(t, tree, testKeys(2000, 0, 2)...)
+	require.NoError(t, tree.WriteAll())
+	require.Empty(t, tree.pages.dirtyPages())
+
+	insertTestKeys(t, tree, 1001)
+	dirty := len(tree.pages.dirtyPages())
+	require.Greater(t, dirty, 0)
+	require.Less(t, dirty, tree.pages.len()/2)
+
+	require.NoError(t, tree.WriteAll())
+	require.Empty(t, tree.pages.dirtyPages())
+
+	for _, k := range testKeys(500, 3, 8) {
+		require.NoError(t, tree.InsertMem(&Entry[*freelistKey, *testVal]{Key: &freelistKey{ptr: k}, Val: &testVal{}}))
+	}
+	pages := tree.pages.dirtyPages()
+	require.Greater(t, len(pages), 1)
+	for i := 1; i < len(pages); i++ {
+		require.Less(t, pages[i-1].id, pages[i].id)
+	}
+}
+
+func TestExportLatest(t *testing.T) {
+	fileName := path.Join(t.TempDir(), "rbtree_test")
+	opts := &Options{PageSize: 1024, Tombstones: true}
+	tree, err := Open[*freelistKey, *testVal](fileName, opts)
+	require.NoError(t, err)
+	insertTestKeys(t, tree, 3, 1, 2)
+	require.NoError(t, tree.DeleteMem(&freelistKey{ptr: 2}))
+	insertTestKeys(t, tree, 2)
+	require.NoError(t, tree.DeleteMem(&freelistKey{ptr: 3}))
+
+	buf := &bytes.Buffer{}
+	seq, err := tree.ExportLatest(buf)
+	require.NoError(t, err)
+	require.Equal(t, uint64(6), seq)
+	require.False(t, tree.IsDirty())
+
+	data := buf.Bytes()
+	entrySize := (&freelistKey{}).Size() + (&testVal{}).Size()
+	require.Len(t, data, exportHeaderSize + 2 * entrySize)
+	require.Equal(t, seq, bin.Uint64(data[0:8]))
+	require.Equal(t, uint32(2), bin.Uint32(data[8:12]))
+
+	for i, want := range []uint64{1, 2} {
+		e := &Entry[*freelistKey, *testVal]{Key: &freelistKey{}, Val: &testVal{}}
+		require.NoError(t, e.UnmarshalBinary(data[exportHeaderSize + i * entrySize:][:entrySize]))
+		require.Equal(t, want, e.Key.ptr)
+	}
+
+	// seq survives reopen
+	require.NoError(t, tree.Close())
+	tree, err = Open[*freelistKey, *testVal](fileName, opts)
+	require.NoError(t, err)
+	defer tree.Close()
+	require.Equal(t, seq, tree.Seq())
+}
+
+func TestLogger(t *testing.T) {
+	logged := map[string]int{}
+	fileName := path.Join(t.TempDir(), "rbtree_test")
+	opts := &Options{
+		PageSize: 1024,
+		Logger: func(level, msg string, kv ...any) {
+			require.Zero(t, len(kv) % 2, msg)
+			logged[level + " " + msg]++
+		},
+	}
+
+	tree, err := Open[*freelistKey, *testVal](fileName, opts)
+	require.NoError(t, err)
+	insertTestKeys(t, tree, testKeys(200, 0, 1)...)
+	require.NoError(t, tree.DeleteMem(&freelistKey{ptr: 0}))
+	require.ErrorIs(t, tree.InsertRaw(&Entry[*freelistKey, *testVal]{Key: &freelistKey{ptr: 500}, Val: &testVal{}}, 7), ErrInvalidColor)
+	require.ErrorIs(t, tree.InsertMem(&Entry[*freelistKey, *testVal]{Key: &freelistKey{ptr: 1}, Val: &testVal{}}), ErrKeyAlreadyExists)
+	require.NoError(t, tree.WriteAll())
+	tree.DropCache()
+	_, err = tree.Get(&freelistKey{ptr: 150})
+	require.NoError(t, err)
+	require.NoError(t, tree.Close())
+
+	require.Positive(t, logged["debug rebalanced"])
+	require.Positive(t, logged["debug pages evicted"])
+	require.Positive(t, logged["debug page cache miss"])
+	require.Equal(t, 2, logged["debug flush start"])
+	require.Equal(t, 2, logged["debug flush end"])
+	require.Equal(t, 1, logged["error operation failed"])
+}
+
+func TestNodeDistribution(t *testing.T) {
+	tree := openTestTree[*freelistKey, *testVal](t, func(opts *Options) {
+		opts.PageSize = 1024
+	})
+	dist, err := tree.NodeDistribution()
+	require.NoError(t, err)
+	require.Empty(t, dist)
+
+	insertTestKeys(t, tree, testKeys(500, 0, 1)...)
+	dist, err = tree.NodeDistribution()
+	require.NoError(t, err)
+
+	total := 0
+	for id, n := range dist {
+		require.NotZero(t, id, "meta page holds no nodes")
+		require.LessOrEqual(t, n, int(tree.degree))
+		total += n
+	}
+	require.Equal(t, 500, total)
+}
+
+func TestExpectedPages(t *testing.T) {
+	for _, expected := range []int{-1, 0, 1000} {
+		tree := openTestTree[*freelistKey, *testVal](t, func(opts *Options) {
+			opts.ExpectedPages = expected
+		})
+		insertTestKeys(t, tree, testKeys(1000, 0, 1)...)
+		require.NoError(t, tree.Validate())
+	}
+}
+
+func TestApproxCount(t *testing.T) {
+	fileName := path.Join(t.TempDir(), "rbtree_test")
+	opts := &Options{PageSize: 1024, Tombstones: true}
+	tree, err := Open[*freelistKey, *testVal](fileName, opts)
+	require.NoError(t, err)
+	require.Zero(t, tree.ApproxCount())
+
+	insertTestKeys(t, tree, testKeys(10, 0, 1)...)
+	require.NoError(t, tree.DeleteMem(&freelistKey{ptr: 3}))
+	require.Equal(t, 9, tree.ApproxCount())
+	require.Equal(t, tree.Count(), tree.ApproxCount())
+	require.NoError(t, tree.Close())
+
+	tree, err = Open[*freelistKey, *testVal](fileName, opts)
+	require.NoError(t, err)
+	defer tree.Close()
+	require.Equal(t, 9, tree.ApproxCount())
+}
+
+func TestIsDirty(t *testing.T) {
+	tree := openTestTree[*freelistKey, *testVal](t)
+	insertTestKeys(t, tree, testKeys(100, 0, 1)...)
+	require.True(t, tree.IsDirty())
+	require.NoError(t, tree.WriteAll())
+	require.False(t, tree.IsDirty())
+
+	_, err := tree.Get(&freelistKey{ptr: 5})
+	require.NoError(t, err)
+	require.NoError(t, tree.ScanAll(func(*freelistKey, *testVal) (bool, error) { return false, nil }))
+	require.False(t, tree.IsDirty())
+
+	require.NoError(t, tree.DeleteMem(&freelistKey{ptr: 5}))
+	require.True(t, tree.IsDirty())
+	_, err = tree.FlushN(-1)
+	require.NoError(t, err)
+	require.False(t, tree.IsDirty())
+}
+
+func TestAsyncWrites(t *testing.T) {
+	fileName := path.Join(t.TempDir(), "rbtree_test")
+	opts := &Options{PageSize: 1024, AsyncWrites: true}
+	tree, err := Open[*freelistKey, *testVal](fileName, opts)
+	require.NoError(t, err)
+
+	// reads see writes which are not flushed yet
+	for i := uint64(0); i < 500; i++ {
+		require.NoError(t, tree.Insert(&Entry[*freelistKey, *testVal]{Key: &freelistKey{ptr: i}, Val: &testVal{v: uint32(i)}}))
+		e, err := tree.Get(&freelistKey{ptr: i})
+		require.NoError(t, err)
+		require.Equal(t, uint32(i), e.Val.v)
+	}
+	for i := uint64(0); i < 500; i += 2 {
+		require.NoError(t, tree.Delete(&freelistKey{ptr: i}))
+		_, err := tree.Get(&freelistKey{ptr: i})
+		require.ErrorIs(t, err, ErrNotFound)
+	}
+	require.NoError(t, tree.Close())
+	require.NoError(t, tree.Close())
+
+	tree, err = Open[*freelistKey, *testVal](fileName, &Options{PageSize: 1024})
+	require.NoError(t, err)
+	defer tree.Close()
+	require.Equal(t, 250, tree.Count())
+	require.NoError(t, tree.Validate())
+}
+
+func TestNoCache(t *testing.T) {
+	fileName := path.Join(t.TempDir(), "rbtree_test")
+	opts := &Options{PageSize: uint16(os.Getpagesize()), NoCache: true}
+
+	tree, err := Open[*freelistKey, *testVal](fileName, opts)
+	require.NoError(t, err)
+	insertTestKeys(t, tree, testKeys(500, 0, 1)...)
+	require.Zero(t, tree.pages.len())
+
+	for i := uint64(0); i < 500; i += 3 {
+		require.NoError(t, tree.DeleteMem(&freelistKey{ptr: i}))
+	}
+	require.Zero(t, tree.pages.len())
+
+	e, err := tree.Get(&freelistKey{ptr: 100})
+	require.NoError(t, err)
+	require.Equal(t, uint32(100), e.Val.v)
+	require.Zero(t, tree.pages.len())
+	require.NoError(t, tree.CloseNoFlush())
+
+	tree, err = Open[*freelistKey, *testVal](fileName, &Options{PageSize: opts.PageSize})
+	require.NoError(t, err)
+	defer tree.Close()
+	require.NoError(t, tree.Validate())
+	require.Equal(t, 333, tree.Count())
+}
+
+func TestCompareBytes(t *testing.T) {
+	tree := openTestTree[*freelistKey, *testVal](t, func(opts *Options) {
+		opts.CompareBytes = func(a, b []byte) int {
+			return bytes.Compare(b, a)
+		}
+	})
+
+	for i := 0; i < 100; i++ {
+		require.NoError(t, tree.InsertMem(&Entry[*freelistKey, *testVal]{
+			Key: &freelistKey{size: uint32(i)},
+			Val: &testVal{v: uint32(i)},
+		}))
+	}
+
+	expected := uint32(99)
+	require.NoError(t, tree.Scan(nil, func(key *freelistKey, val *testVal) (bool, error) {
+		require.Equal(t, expected, key.size)
+		expected--
+		return false, nil
+	}))
+
+	e, err := tree.Get(&freelistKey{size: 42})
+	require.NoError(t, err)
+	require.Equal(t, uint32(42), e.Val.v)
+}
+
+func TestValidateReport(t *testing.T) {
+	tree := openTestTree[*freelistKey, *testVal](t)
+
+	keys := testKeys(500, 0, 7)
+	for i := range keys {
+		keys[i] %= 500
+	}
+	insertTestKeys(t, tree, keys...)
+	for i := 0; i < 500; i += 3 {
+		require.NoError(t, tree.DeleteMem(&freelistKey{ptr: keys[i]}))
+		require.NoError(t, tree.Validate())
+	}
+
+	report, err := tree.ValidateReport()
+	require.NoError(t, err)
+	require.Empty(t, report.Violations)
+	require.NoError(t, report.Err())
+
+	// break several invariants at once
+	root := tree.fetch(tree.meta.rootPtr)
+	root.setRed()
+	tree.fetch(root.left).parent = root.right
+	tree.meta.count++
+
+	report, err = tree.ValidateReport()
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, len(report.Violations), 3)
+	require.ErrorIs(t, report.Err(), ErrCorrupted)
+	require.ErrorIs(t, tree.Validate(), ErrCorrupted)
+}
+
+func TestValidateReportSubtrees(t *testing.T) {
+	tree := openTestTree[*freelistKey, *testVal](t)
+	insertTestKeys(t, tree, testKeys(500, 0, 1)...)
+
+	// black height break in left subtree
+	root := tree.fetch(tree.meta.rootPtr)
+	ptr := root.left
+	for tree.fetch(ptr).isRed() || tree.fetch(ptr).left == tree.meta.nullPtr {
+		ptr = tree.fetch(ptr).right
+	}
+	ptr = tree.fetch(ptr).left
+	for tree.fetch(ptr).isRed() {
+		ptr = tree.fetch(ptr).left
+	}
+	tree.fetch(ptr).setRed()
+
+	// parent pointer break in right subtree
+	right := tree.fetch(root.right)
+	tree.fetch(right.left).parent = tree.meta.rootPtr
+
+	report, err := tree.ValidateReport()
+	require.NoError(t, err)
+
+	blackHeight, parent := false, false
+	for _, v := range report.Violations {
+		blackHeight = blackHeight || strings.Contains(v.Invariant, "black height mismatch")
+		parent = parent || strings.Contains(v.Invariant, "parent pointer")
+	}
+	require.True(t, blackHeight, "violations: %v", report.Violations)
+	require.True(t, parent, "violations: %v", report.Violations)
+}
+
+func TestCloseNoFlush(t *testing.T) {
+	fileName := path.Join(t.TempDir(), "rbtree_test")
+	opts := &Options{PageSize: uint16(os.Getpagesize())}
+
+	tree, err := Open[*freelistKey, *testVal](fileName, opts)
+	require.NoError(t, err)
+	require.NoError(t, tree.Insert(&Entry[*freelistKey, *testVal]{Key: &freelistKey{ptr: 1}, Val: &testVal{}}))
+	require.NoError(t, tree.InsertMem(&Entry[*freelistKey, *testVal]{Key: &freelistKey{ptr: 2}, Val: &testVal{}}))
+	require.NoError(t, tree.CloseNoFlush())
+	require.NoError(t, tree.Close())
+
+	tree, err = Open[*freelistKey, *testVal](fileName, opts)
+	require.NoError(t, err)
+	defer tree.Close()
+
+	require.Equal(t, 1, tree.Count())
+	_, err = tree.Get(&freelistKey{ptr: 2})
+	require.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestOpenLocked(t *testing.T) {
+	fileName := path.Join(t.TempDir(), "rbtree_test")
+	opts := &Options{PageSize: uint16(os.Getpagesize())}
+
+	tree, err := Open[*freelistKey, *testVal](fileName, opts)
+	require.NoError(t, err)
+
+	_, err = Open[*freelistKey, *testVal](fileName, opts)
+	require.ErrorIs(t, err, ErrLocked)
+
+	require.NoError(t, tree.Close())
+	tree, err = Open[*freelistKey, *testVal](fileName, opts)
+	require.NoError(t, err)
+	tree.Remove()
+
+	// shared locks conflict only with exclusive one
+	tree, err = Open[*freelistKey, *testVal](fileName, opts)
+	require.NoError(t, err)
+	require.NoError(t, tree.Close())
+
+	lockName := fileName + ".lock"
+	first, err := lockFile(lockName, 0664, true)
+	require.NoError(t, err)
+	second, err := lockFile(lockName, 0664, true)
+	require.NoError(t, err)
+	_, err = lockFile(lockName, 0664, false)
+	require.ErrorIs(t, err, ErrLocked)
+	require.NoError(t, unlockFile(first))
+	require.NoError(t, unlockFile(second))
+}
+
+func TestTimestamps(t *testing.T) {
+	fileName := path.Join(t.TempDir(), "rbtree_test")
+	opts := &Options{PageSize: uint16(os.Getpagesize())}
+
+	before := time.Now()
+	tree, err := Open[*freelistKey, *testVal](fileName, opts)
+	require.NoError(t, err)
+	require.NoError(t, tree.Insert(&Entry[*freelistKey, *testVal]{Key: &freelistKey{ptr: 1}, Val: &testVal{}}))
+	createdAt, modifiedAt := tree.CreatedAt(), tree.ModifiedAt()
+	require.False(t, createdAt.Before(before))
+	require.False(t, modifiedAt.Before(createdAt))
+
+	require.NoError(t, tree.Insert(&Entry[*freelistKey, *testVal]{Key: &freelistKey{ptr: 2}, Val: &testVal{}}))
+	require.True(t, tree.ModifiedAt().After(modifiedAt))
+	modifiedAt = tree.ModifiedAt()
+	require.NoError(t, tree.Close())
+
+	tree, err = Open[*freelistKey, *testVal](fileName, opts)
+	require.NoError(t, err)
+	defer tree.Close()
+	require.True(t, createdAt.Equal(tree.CreatedAt()))
+	require.True(t, modifiedAt.Equal(tree.ModifiedAt()))
+}
+
+func TestInspect(t *testing.T) {
+	fileName := path.Join(t.TempDir(), "rbtree_test")
+	tree, err := Open[*freelistKey, *testVal](fileName, &Options{PageSize: 1024, Tombstones: true})
+	require.NoError(t, err)
+	insertTestKeys(t, tree, 1, 2, 3)
+	require.NoError(t, tree.Delete(&freelistKey{ptr: 2}))
+	require.NoError(t, tree.Close())
+
+	info, err := Inspect(fileName)
+	require.NoError(t, err)
+	require.Equal(t, uint16(1024), info.PageSize)
+	require.Equal(t, uint16((&freelistKey{}).Size()), info.NodeKeySize)
+	require.Equal(t, uint16((&testVal{}).Size()), info.NodeValSize)
+	require.Equal(t, 2, info.Count)
+	require.True(t, info.Tombstones)
+	require.False(t, info.ModifiedAt.Before(info.CreatedAt))
+
+	require.NoError(t, os.WriteFile(fileName + ".idx", []byte{1, 2, 3}, 0664))
+	_, err = Inspect(fileName)
+	require.ErrorIs(t, err, ErrCorrupted)
+}
+
+func TestFileSuffix(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		opts Options
+		file string
+	}{
+		{Options{}, "tree.idx"},
+		{Options{FileSuffix: ".rbt"}, "tree.rbt"},
+		{Options{ExactFileName: true}, "tree"},
+	}
+
+	for _, tt := range tests {
+		tt.opts.PageSize = 1024
+		tree, err := Open[*freelistKey, *testVal](path.Join(dir, "tree"), &tt.opts)
+		require.NoError(t, err)
+		insertTestKeys(t, tree, 1, 2)
+		require.NoError(t, tree.Close())
+
+		info, err := InspectFile(path.Join(dir, tt.file))
+		require.NoError(t, err)
+		require.Equal(t, 2, info.Count)
+		require.NoError(t, os.Remove(path.Join(dir, tt.file)))
+	}
+}
+
+func TestBlobTree(t *testing.T) {
+	bt, err := OpenBlob[*freelistKey](
+		path.Join(t.TempDir(), "rbtree_test"),
+		&Options{PageSize: uint16(os.Getpagesize())},
+	)
+	require.NoError(t, err)
+	defer bt.Close()
+
+	vals := map[uint64][]byte{}
+	for i := 0; i < 100; i++ {
+		vals[uint64(i)] = bytes.Repeat([]byte{byte(i)}, i*10)
+		require.NoError(t, bt.Insert(&freelistKey{ptr: uint64(i)}, vals[uint64(i)]))
+	}
+	require.ErrorIs(t, bt.Insert(&freelistKey{ptr: 1}, []byte("dup")), ErrKeyAlreadyExists)
+
+	size := bt.size
+	for i := 0; i < 100; i += 2 {
+		require.NoError(t, bt.Delete(&freelistKey{ptr: uint64(i)}))
+		delete(vals, uint64(i))
+	}
+
+	// freed extents are reused by values of the same or smaller size
+	for i := 0; i < 100; i += 2 {
+		vals[uint64(i)] = bytes.Repeat([]byte{0xff}, i*5)
+		require.NoError(t, bt.Insert(&freelistKey{ptr: uint64(i)}, vals[uint64(i)]))
+	}
+	require.Equal(t, size, bt.size)
+
+	for k, v := range vals {
+		got, err := bt.Get(&freelistKey{ptr: k})
+		require.NoError(t, err)
+		require.Equal(t, v, got)
+	}
+}
+
+func TestBlobTreeFreelist(t *testing.T) {
+	bt, err := OpenBlob[*freelistKey](
+		path.Join(t.TempDir(), "rbtree_test"),
+		&Options{
+			PageSize: uint16(os.Getpagesize()),
+			CompareBytes: func(a, b []byte) int {
+				return bytes.Compare(b, a)
+			},
+		},
+	)
+	require.NoError(t, err)
+	defer bt.Close()
+
+	vals := map[uint64][]byte{}
+	for i := 0; i < 6; i++ {
+		vals[uint64(i)] = bytes.Repeat([]byte{byte(i)}, 10)
+		require.NoError(t, bt.Insert(&freelistKey{ptr: uint64(i)}, vals[uint64(i)]))
+	}
+
+	// adjacent extents are merged, the last one is truncated
+	for _, k := range []uint64{1, 3, 2, 5} {
+		require.NoError(t, bt.Delete(&freelistKey{ptr: k}))
+		delete(vals, k)
+	}
+	require.Equal(t, uint64(50), bt.size)
+	require.Equal(t, 1, bt.free.Count())
+	require.Equal(t, 1, bt.spans.Count())
+
+	// custom key order of the main tree does not affect best fit
+	vals[10] = bytes.Repeat([]byte{0xaa}, 500)
+	require.NoError(t, bt.Insert(&freelistKey{ptr: 10}, vals[10]))
+	require.Equal(t, uint64(550), bt.size)
+
+	vals[11] = bytes.Repeat([]byte{0xbb}, 25)
+	require.NoError(t, bt.Insert(&freelistKey{ptr: 11}, vals[11]))
+	require.Equal(t, uint64(550), bt.size)
+
+	for k, v := range vals {
+		got, err := bt.Get(&freelistKey{ptr: k})
+		require.NoError(t, err)
+		require.Equal(t, v, got)
+	}
+}
+
+func TestVerifyOnOpen(t *testing.T) {
+	fileName := path.Join(t.TempDir(), "rbtree_test")
+	opts := &Options{PageSize: uint16(os.Getpagesize()), VerifyOnOpen: true}
+
+	tree, err := Open[*freelistKey, *testVal](fileName, opts)
+	require.NoError(t, err)
+	for i := 0; i < 100; i++ {
+		require.NoError(t, tree.Insert(&Entry[*freelistKey, *testVal]{Key: &freelistKey{ptr: uint64(i)}, Val: &testVal{}}))
+	}
+	require.NoError(t, tree.Close())
+
+	tree, err = Open[*freelistKey, *testVal](fileName, opts)
+	require.NoError(t, err)
+	tree.fetch(tree.meta.rootPtr).setRed()
+	require.NoError(t, tree.Close())
+
+	_, err = Open[*freelistKey, *testVal](fileName, opts)
+	require.ErrorIs(t, err, ErrCorrupted)
+}
+
+func TestIteratorContext(t *testing.T) {
+	tree := openTestTree[*freelistKey, *testVal](t)
+
+	insertTestKeys(t, tree, testKeys(300, 0, 2)...)
+
+	it := tree.IteratorContext(context.Background(), &freelistKey{ptr: 101})
+	expected := uint64(102)
+	for it.Next() {
+		require.Equal(t, expected, it.Entry().Key.ptr)
+		expected += 2
+	}
+	require.NoError(t, it.Err())
+	require.Equal(t, uint64(600), expected)
+	it.Close()
+	it.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	it = tree.IteratorContext(ctx, nil)
+	require.True(t, it.Next())
+	require.Equal(t, uint64(0), it.Entry().Key.ptr)
+	cancel()
+	require.False(t, it.Next())
+	require.ErrorIs(t, it.Err(), context.Canceled)
+	it.Close()
+
+	// read lock must be released
+	require.NoError(t, tree.WriteAll())
+}
+
+func TestIteratorBidirectional(t *testing.T) {
+	tree := openTestTree[*freelistKey, *testVal](t, func(opts *Options) {
+		opts.Tombstones = true
+	})
+	insertTestKeys(t, tree, testKeys(10, 10, 10)...)
+	require.NoError(t, tree.DeleteMem(&freelistKey{ptr: 40}))
+
+	it := tree.Iterator()
+	defer it.Close()
+	moves := []struct {
+		next bool
+		key  uint64
+	}{
+		{true, 10}, {true, 20}, {true, 30}, {true, 50}, {false, 30},
+		{false, 20}, {false, 10}, {false, 0}, {true, 10}, {true, 20},
+	}
+	for i, m := range moves {
+		var ok bool
+		if m.next {
+			ok = it.Next()
+		} else {
+			ok = it.Prev()
+		}
+		require.Equal(t, m.key != 0, ok, i)
+		if ok {
+			require.Equal(t, m.key, it.Entry().Key.ptr, i)
+		}
+	}
+
+	it.Seek(&freelistKey{ptr: 95})
+	require.True(t, it.Next())
+	require.Equal(t, uint64(100), it.Entry().Key.ptr)
+	require.False(t, it.Next())
+	require.True(t, it.Prev())
+	require.Equal(t, uint64(100), it.Entry().Key.ptr)
+
+	it.Seek(&freelistKey{ptr: 50})
+	require.True(t, it.Prev())
+	require.Equal(t, uint64(30), it.Entry().Key.ptr)
+	require.True(t, it.Next())
+	require.Equal(t, uint64(50), it.Entry().Key.ptr)
+	require.NoError(t, it.Err())
+}
+
+func TestOnOp(t *testing.T) {
+	ops := map[string]int{}
+	var lastErr error
+	tree := openTestTree[*freelistKey, *testVal](t, func(opts *Options) {
+		opts.OnOp = func(op string, dur time.Duration, err error) {
+			ops[op]++
+			lastErr = err
+		}
+	})
+
+	e := &Entry[*freelistKey, *testVal]{Key: &freelistKey{ptr: 1}, Val: &testVal{}}
+	require.NoError(t, tree.Insert(e))
+	require.ErrorIs(t, tree.Insert(e), ErrKeyAlreadyExists)
+	require.ErrorIs(t, lastErr, ErrKeyAlreadyExists)
+	_, err := tree.Get(e.Key)
+	require.NoError(t, err)
+	require.NoError(t, tree.Scan(nil, func(key *freelistKey, val *testVal) (bool, error) { return false, nil }))
+	require.NoError(t, tree.Delete(e.Key))
+	require.NoError(t, tree.WriteAll())
+
+	require.Equal(t, map[string]int{
+		OpInsert:   2,
+		OpGet:      1,
+		OpScan:     1,
+		OpDelete:   1,
+		OpWriteAll: 1,
+	}, ops)
+
+	// batch and whole tree operations are reported too
+	for op := range ops {
+		delete(ops, op)
+	}
+	entries := []*Entry[*freelistKey, *testVal]{}
+	for _, k := range testKeys(10, 0, 1) {
+		entries = append(entries, &Entry[*freelistKey, *testVal]{Key: &freelistKey{ptr: k}, Val: &testVal{}})
+	}
+	require.NoError(t, tree.BulkLoad(entries))
+	_, err = tree.DeleteRange(&freelistKey{ptr: 0}, &freelistKey{ptr: 4})
+	require.NoError(t, err)
+	_, err = tree.InsertBatch(entries)
+	require.NoError(t, err)
+	_, err = tree.PurgeTombstones(time.Now())
+	require.NoError(t, err)
+	require.NoError(t, tree.Compact())
+
+	buf := &bytes.Buffer{}
+	require.NoError(t, tree.Export(buf))
+	require.NoError(t, tree.Clear())
+	require.NoError(t, tree.Import(buf))
+	other := openTestTree[*freelistKey, *testVal](t)
+	_, err = tree.MergeFrom(other, nil)
+	require.NoError(t, err)
+
+	require.Equal(t, map[string]int{
+		OpInsert:  4,
+		OpDelete:  3,
+		OpCompact: 1,
+	}, ops)
+}
+
+func TestCreateDir(t *testing.T) {
+	fileName := path.Join(t.TempDir(), "a", "b", "rbtree_test")
+	tree, err := Open[*freelistKey, *testVal](fileName, &Options{
+		PageSize:  uint16(os.Getpagesize()),
+		FileMode:  0600,
+		CreateDir: true,
+	})
+	require.NoError(t, err)
+	require.NoError(t, tree.Close())
+
+	stat, err := os.Stat(fileName + ".idx")
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), stat.Mode().Perm())
+}
+
+func TestBlobCreateDir(t *testing.T) {
+	fileName := path.Join(t.TempDir(), "a", "b", "rbtree_test")
+	bt, err := OpenBlob[*freelistKey](fileName, &Options{
+		PageSize:  uint16(os.Getpagesize()),
+		FileMode:  0600,
+		CreateDir: true,
+	})
+	require.NoError(t, err)
+	defer bt.Close()
+
+	stat, err := os.Stat(fileName + ".blob")
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), stat.Mode().Perm())
+}
+
+func TestHasMulti(t *testing.T) {
+	tree := openTestTree[*freelistKey, *testVal](t)
+
+	insertTestKeys(t, tree, testKeys(334, 0, 3)...)
+
+	keys := []*freelistKey{}
+	for i := 0; i < 1005; i++ {
+		keys = append(keys, &freelistKey{ptr: uint64(i)})
+	}
+	// unsorted tail resets search
+	keys = append(keys, &freelistKey{ptr: 3}, &freelistKey{ptr: 4}, &freelistKey{ptr: 999}, &freelistKey{ptr: 0})
+
+	has, err := tree.HasMulti(keys)
+	require.NoError(t, err)
+	require.Len(t, has, len(keys))
+	for i, k := range keys {
+		require.Equal(t, k.ptr%3 == 0 && k.ptr < 1000, has[i], "key %d", k.ptr)
+	}
+}
+
+func TestScanProgress(t *testing.T) {
+	tree := openTestTree[*freelistKey, *testVal](t)
+
+	insertTestKeys(t, tree, testKeys(95, 0, 1)...)
+
+	reported := []int{}
+	require.NoError(t, tree.ScanProgress(nil, 10, func(visited int) {
+		reported = append(reported, visited)
+	}, func(key *freelistKey, val *testVal) (bool, error) {
+		return false, nil
+	}))
+	require.Equal(t, []int{10, 20, 30, 40, 50, 60, 70, 80, 90}, reported)
+
+	require.NoError(t, tree.ScanProgress(nil, 10, nil, func(key *freelistKey, val *testVal) (bool, error) {
+		return false, nil
+	}))
+}
+
+func TestAppendMax(t *testing.T) {
+	tree := openTestTree[*freelistKey, *testVal](t)
+
+	next := uint64(0)
+	keys := map[uint64]bool{}
+	for i := 0; i < 2000; i++ {
+		if i%5 == 4 {
+			// delete the current maximum so the hint is recomputed
+			for k := next - 1; ; k-- {
+				if keys[k] {
+					require.NoError(t, tree.DeleteMem(&freelistKey{ptr: k}))
+					delete(keys, k)
+					break
+				}
+			}
+		} else {
+			next += 2
+			insertTestKeys(t, tree, next)
+			keys[next] = true
+		}
+	}
+
+	// keys less than maximum take the regular path
+	for k := uint64(1); k < next; k += 10 {
+		insertTestKeys(t, tree, k)
+		keys[k] = true
+	}
+	require.ErrorIs(t, tree.InsertMem(&Entry[*freelistKey, *testVal]{Key: &freelistKey{ptr: next}, Val: &testVal{}}), ErrKeyAlreadyExists)
+
+	require.NoError(t, tree.Validate())
+	require.Equal(t, len(keys), tree.Count())
+
+	var prev *freelistKey
+	require.NoError(t, tree.Scan(nil, func(key *freelistKey, val *testVal) (bool, error) {
+		require.True(t, keys[key.ptr])
+		if prev != nil {
+			require.Greater(t, key.ptr, prev.ptr)
+		}
+		prev = key
+		return false, nil
+	}))
+}
+
+func TestDropCache(t *testing.T) {
+	tree := openTestTree[*freelistKey, *testVal](t)
+
+	insertTestKeys(t, tree, testKeys(2000, 0, 1)...)
+
+	tree.DropCache()
+	require.Greater(t, tree.pages.len(), 2, "dirty pages must stay cached")
+
+	require.NoError(t, tree.WriteAll())
+	tree.DropCache()
+	require.LessOrEqual(t, tree.pages.len(), 2)
+
+	e, err := tree.Get(&freelistKey{ptr: 1234})
+	require.NoError(t, err)
+	require.Equal(t, uint32(1234), e.Val.v)
+	require.NoError(t, tree.Validate())
+}
+
+func TestInsertRaw(t *testing.T) {
+	tree := openTestTree[*freelistKey, *testVal](t)
+	keys := testKeys(500, 0, 31)
+	for i := range keys {
+		keys[i] %= 500
+	}
+	insertTestKeys(t, tree, keys...)
+
+	type shape struct {
+		key   uint64
+		color byte
+		left  uint64
+		right uint64
+	}
+
+	dump := func(tree *RBTree[*freelistKey, *testVal]) []shape {
+		nodes := []shape{}
+		var walk func(ptr uint32)
+		walk = func(ptr uint32) {
+			if ptr == tree.meta.nullPtr {
+				return
+			}
+
+			n := tree.fetch(ptr)
+			sh := shape{key: n.entry.Key.ptr, color: byte(n.getFlag(FT_COLOR)), left: math.MaxUint64, right: math.MaxUint64}
+			if n.left != tree.meta.nullPtr {
+				sh.left = tree.fetch(n.left).entry.Key.ptr
+			}
+			if n.right != tree.meta.nullPtr {
+				sh.right = tree.fetch(n.right).entry.Key.ptr
+			}
+			nodes = append(nodes, sh)
+			walk(n.left)
+			walk(n.right)
+		}
+		walk(tree.meta.rootPtr)
+		return nodes
+	}
+
+	// pre-order placement reproduces exact shape
+	original := dump(tree)
+	rebuilt := openTestTree[*freelistKey, *testVal](t)
+	for _, sh := range original {
+		require.NoError(t, rebuilt.InsertRaw(&Entry[*freelistKey, *testVal]{Key: &freelistKey{ptr: sh.key}, Val: &testVal{}}, sh.color))
+	}
+
+	require.Equal(t, original, dump(rebuilt))
+	require.NoError(t, rebuilt.Validate())
+	require.ErrorIs(t, rebuilt.InsertRaw(&Entry[*freelistKey, *testVal]{Key: &freelistKey{ptr: 1000}, Val: &testVal{}}, 2), ErrInvalidColor)
+}
+
+func TestScanFromKey(t *testing.T) {
+	tree := openTestTree[*freelistKey, *testVal](t)
+	insertTestKeys(t, tree, testKeys(100, 0, 2)...)
+
+	keys := []uint64{}
+	require.NoError(t, tree.Scan(&freelistKey{ptr: 151}, func(key *freelistKey, val *testVal) (bool, error) {
+		keys = append(keys, key.ptr)
+		return false, nil
+	}))
+	require.Equal(t, testKeys(24, 152, 2), keys)
+
+	require.NoError(t, tree.Scan(&freelistKey{ptr: 199}, func(key *freelistKey, val *testVal) (bool, error) {
+		require.FailNow(t, "no keys after the maximum")
+		return false, nil
+	}))
+}
+
+func TestScanReverse(t *testing.T) {
+	tree := openTestTree[*freelistKey, *testVal](t)
+	insertTestKeys(t, tree, testKeys(1000, 1, 1)...)
+
+	scan := func(start *freelistKey, limit int) []uint64 {
+		keys := []uint64{}
+		require.NoError(t, tree.ScanReverse(start, func(key *freelistKey, val *testVal) (bool, error) {
+			require.Equal(t, uint32(key.ptr), val.v)
+			keys = append(keys, key.ptr)
+			return len(keys) == limit, nil
+		}))
+		return keys
+	}
+
+	all := scan(nil, -1)
+	require.Len(t, all, 1000)
+	for i, k := range all {
+		require.Equal(t, uint64(1000 - i), k)
+	}
+
+	require.Equal(t, []uint64{500, 499, 498}, scan(&freelistKey{ptr: 500}, 3))
+	require.Equal(t, []uint64{1000}, scan(&freelistKey{ptr: 5000}, 1))
+	require.Empty(t, scan(&freelistKey{ptr: 0}, -1))
+}
+
+func TestRangeScan(t *testing.T) {
+	tree := openTestTree[*freelistKey, *testVal](t)
+	insertTestKeys(t, tree, testKeys(10, 0, 10)...)
+	key := func(k uint64) *freelistKey { return &freelistKey{ptr: k} }
+
+	tests := []struct {
+		name   string
+		lo, hi *freelistKey
+		opts   RangeOptions
+		want   []uint64
+	}{
+		{"closed", key(20), key(50), RangeOptions{true, true}, []uint64{20, 30, 40, 50}},
+		{"half open", key(20), key(50), RangeOptions{true, false}, []uint64{20, 30, 40}},
+		{"open", key(20), key(50), RangeOptions{false, false}, []uint64{30, 40}},
+		{"missing bounds", key(15), key(45), RangeOptions{}, []uint64{20, 30, 40}},
+		{"lo after all", key(100), key(200), RangeOptions{true, true}, []uint64{}},
+		{"lo equals hi", key(30), key(30), RangeOptions{true, true}, []uint64{30}},
+		{"lo equals hi exclusive", key(30), key(30), RangeOptions{true, false}, []uint64{}},
+		{"nil bounds", nil, nil, RangeOptions{}, testKeys(10, 0, 10)},
+		{"nil lo", nil, key(20), RangeOptions{IncludeHi: true}, []uint64{0, 10, 20}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := []uint64{}
+			require.NoError(t, tree.RangeScan(tt.lo, tt.hi, tt.opts, func(key *freelistKey, _ *testVal) (bool, error) {
+				got = append(got, key.ptr)
+				return false, nil
+			}))
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestScanFromExistingKey(t *testing.T) {
+	tree := openTestTree[*freelistKey, *testVal](t)
+	insertTestKeys(t, tree, testKeys(100, 1, 1)...)
+
+	keys := []uint64{}
+	require.NoError(t, tree.Scan(&freelistKey{ptr: 50}, func(key *freelistKey, val *testVal) (bool, error) {
+		keys = append(keys, key.ptr)
+		return false, nil
+	}))
+	require.Equal(t, testKeys(51, 50, 1), keys)
+}
+
+func TestBulkLoad(t *testing.T) {
+	entries := func(keys ...uint64) []*Entry[*freelistKey, *testVal] {
+		res := []*Entry[*freelistKey, *testVal]{}
+		for _, k := range keys {
+			res = append(res, &Entry[*freelistKey, *testVal]{Key: &freelistKey{ptr: k}, Val: &testVal{v: uint32(k)}})
+		}
+		return res
+	}
+
+	for _, n := range []int{1, 2, 3, 7, 8, 100, 10000} {
+		tree := openTestTree[*freelistKey, *testVal](t)
+		require.NoError(t, tree.BulkLoad(entries(testKeys(n, 0, 1)...)))
+		require.NoError(t, tree.Validate(), "n=%d", n)
+		require.Equal(t, n, tree.Count())
+
+		e, err := tree.Max()
+		require.NoError(t, err)
+		require.Equal(t, uint64(n - 1), e.Key.ptr)
+		insertTestKeys(t, tree, uint64(n))
+		require.NoError(t, tree.Validate())
+	}
+
+	tree := openTestTree[*freelistKey, *testVal](t)
+	require.ErrorIs(t, tree.BulkLoad(entries(1, 3, 2)), ErrNotSorted)
+	require.ErrorIs(t, tree.BulkLoad(entries(1, 2, 2)), ErrNotSorted)
+	require.Equal(t, 0, tree.Count())
+	require.NoError(t, tree.BulkLoad(nil))
+	require.NoError(t, tree.BulkLoad(entries(1)))
+	require.ErrorIs(t, tree.BulkLoad(entries(2)), ErrNotEmpty)
+}
+
+func TestBulkLoadUnsorted(t *testing.T) {
+	entries := func(keys ...uint64) []*Entry[*freelistKey, *testVal] {
+		res := []*Entry[*freelistKey, *testVal]{}
+		for i, k := range keys {
+			res = append(res, &Entry[*freelistKey, *testVal]{Key: &freelistKey{ptr: k}, Val: &testVal{v: uint32(i)}})
+		}
+		return res
+	}
+
+	for n := 1; n <= 70; n++ {
+		tree := openTestTree[*freelistKey, *testVal](t)
+		keys := []uint64{}
+		for _, k := range rand.New(rand.NewSource(int64(n))).Perm(n) {
+			keys = append(keys, uint64(k))
+		}
+		require.NoError(t, tree.BulkLoadUnsorted(entries(keys...), nil))
+		require.NoError(t, tree.Validate(), "n=%d", n)
+		require.Equal(t, n, tree.Count())
+
+		scanned := []uint64{}
+		require.NoError(t, tree.ScanAll(func(key *freelistKey, _ *testVal) (bool, error) {
+			scanned = append(scanned, key.ptr)
+			return false, nil
+		}))
+		require.Equal(t, testKeys(n, 0, 1), scanned)
+
+		// tree stays usable for regular inserts
+		insertTestKeys(t, tree, uint64(n), uint64(n + 1))
+		require.NoError(t, tree.Validate())
+	}
+
+	tree := openTestTree[*freelistKey, *testVal](t)
+	require.ErrorIs(t, tree.BulkLoadUnsorted(entries(3, 1, 3), nil), ErrKeyAlreadyExists)
+
+	// later duplicate wins
+	require.NoError(t, tree.BulkLoadUnsorted(entries(3, 1, 3, 2), func(a, b *Entry[*freelistKey, *testVal]) *Entry[*freelistKey, *testVal] {
+		return b
+	}))
+	e, err := tree.Get(&freelistKey{ptr: 3})
+	require.NoError(t, err)
+	require.Equal(t, uint32(2), e.Val.v)
+	require.Equal(t, 3, tree.Count())
+
+	require.ErrorIs(t, tree.BulkLoadUnsorted(entries(5), nil), ErrNotEmpty)
+}
+
+func TestRepair(t *testing.T) {
+	tree := openTestTree[*freelistKey, *testVal](t)
+	insertTestKeys(t, tree, testKeys(100, 0, 1)...)
+
+	// cycle back to root cuts off left subtree of root's left child
+	left := tree.fetch(tree.fetch(tree.meta.rootPtr).left)
+	lost := map[uint64]bool{}
+	for k := uint64(0); k < left.entry.Key.ptr; k++ {
+		lost[k] = true
+	}
+	left.left = tree.meta.rootPtr
+	require.Error(t, tree.Validate())
+
+	dest := path.Join(t.TempDir(), "repaired")
+	recovered, err := tree.Repair(dest)
+	require.NoError(t, err)
+	require.Equal(t, 100 - len(lost), recovered)
+
+	repaired, err := Open[*freelistKey, *testVal](dest, &Options{PageSize: tree.meta.pageSize})
+	require.NoError(t, err)
+	require.NoError(t, repaired.Validate())
+	require.Equal(t, recovered, repaired.Count())
+	require.NoError(t, repaired.ScanAll(func(key *freelistKey, val *testVal) (bool, error) {
+		require.False(t, lost[key.ptr])
+		require.Equal(t, uint32(key.ptr), val.v)
+		return false, nil
+	}))
+	require.NoError(t, repaired.Close())
+
+	// destination must be empty
+	_, err = tree.Repair(dest)
+	require.ErrorIs(t, err, ErrNotEmpty)
+}
+
+func TestNullNodeNormalized(t *testing.T) {
+	fileName := path.Join(t.TempDir(), "rbtree_test")
+	opts := &Options{PageSize: 1024}
+	tree, err := Open[*freelistKey, *testVal](fileName, opts)
+	require.NoError(t, err)
+	insertTestKeys(t, tree, testKeys(100, 0, 1)...)
+
+	for i := uint64(0); i < 50; i += 3 {
+		require.NoError(t, tree.DeleteMem(&freelistKey{ptr: i}))
+	}
+	require.NotZero(t, tree.fetch(tree.meta.nullPtr).parent, "delete fixups leave scratch in null node")
+	_, err = tree.FlushN(-1)
+	require.NoError(t, err)
+	require.NoError(t, tree.CloseNoFlush())
+
+	tree, err = Open[*freelistKey, *testVal](fileName, opts)
+	require.NoError(t, err)
+	defer tree.Close()
+
+	null := tree.fetch(tree.meta.nullPtr)
+	require.True(t, null.isBlack())
+	require.Zero(t, null.parent)
+	require.Zero(t, null.left)
+	require.Zero(t, null.right)
+	require.NoError(t, tree.Validate())
+}
+
+func TestZeroValueSize(t *testing.T) {
+	fileName := path.Join(t.TempDir(), "rbtree_test")
+	_, err := Open[*Uint64, *DummyVal](fileName, &Options{PageSize: 1024})
+	require.ErrorIs(t, err, ErrZeroValueSize)
+
+	tree, err := Open[*Uint64, *DummyVal](fileName, &Options{PageSize: 1024, KeyOnly: true})
+	require.NoError(t, err)
+	require.NoError(t, tree.Close())
+}
+
+func TestKeyComparer(t *testing.T) {
+	tree := openTestTree[*Uint64, *DummyVal](t, func(opts *Options) {
+		opts.KeyOnly = true
+	})
+	for _, k := range []Uint64{5, 300, 1, 256, 70000} {
+		key := k
+		require.NoError(t, tree.InsertMem(&Entry[*Uint64, *DummyVal]{Key: &key, Val: &DummyVal{}}))
+	}
+
+	for _, k := range []Uint64{1, 5, 256, 300, 70000} {
+		e, err := tree.Get(&k)
+		require.NoError(t, err)
+		require.Equal(t, k, *e.Key)
+	}
+
+	// ceiling of missing key is the same as with marshaled comparison
+	missing := Uint64(257)
+	ptr, err := tree.get(&missing)
+	require.ErrorIs(t, err, ErrNotFound)
+	require.Equal(t, Uint64(300), *tree.fetch(ptr).entry.Key)
+}
+
+func TestScanDeadline(t *testing.T) {
+	tree := openTestTree[*freelistKey, *testVal](t)
+	insertTestKeys(t, tree, testKeys(100, 0, 1)...)
+
+	visited := []uint64{}
+	scanFn := func(key *freelistKey, _ *testVal) (bool, error) {
+		visited = append(visited, key.ptr)
+		if key.ptr == 9 {
+			time.Sleep(20 * time.Millisecond)
+		}
+		return false, nil
+	}
+
+	last, completed, err := tree.ScanDeadline(nil, 10 * time.Millisecond, scanFn)
+	require.NoError(t, err)
+	require.False(t, completed)
+	require.Equal(t, uint64(9), last.ptr)
+	require.Equal(t, testKeys(10, 0, 1), visited)
+
+	// resume after the last key
+	require.NoError(t, tree.ScanWith(ScanOpts[*freelistKey]{Start: last, Exclusive: true}, scanFn))
+	require.Equal(t, testKeys(100, 0, 1), visited)
+
+	last, completed, err = tree.ScanDeadline(&freelistKey{ptr: 95}, time.Minute, scanFn)
+	require.NoError(t, err)
+	require.True(t, completed)
+	require.Equal(t, uint64(99), last.ptr)
+}
+
+func TestScanSafe(t *testing.T) {
+	tree := openTestTree[*freelistKey, *testVal](t)
+	insertTestKeys(t, tree, testKeys(10, 0, 1)...)
+
+	visited := 0
+	err := tree.ScanSafe(nil, func(key *freelistKey, _ *testVal) (bool, error) {
+		visited++
+		if key.ptr == 3 {
+			panic("bad callback")
+		}
+		return false, nil
+	})
+	require.ErrorIs(t, err, ErrCallbackPanic)
+	require.ErrorContains(t, err, "bad callback")
+	require.Equal(t, 4, visited)
+
+	require.Panics(t, func() {
+		tree.Scan(nil, func(*freelistKey, *testVal) (bool, error) { panic("bad callback") })
+	})
+
+	// lock was released in both cases
+	insertTestKeys(t, tree, 100)
+}
+
+func TestScanWith(t *testing.T) {
+	tree := openTestTree[*freelistKey, *testVal](t, func(opts *Options) {
+		opts.Tombstones = true
+	})
+	insertTestKeys(t, tree, testKeys(10, 0, 10)...)
+	require.NoError(t, tree.DeleteMem(&freelistKey{ptr: 60}))
+
+	tests := []struct {
+		name string
+		opts ScanOpts[*freelistKey]
+		want []uint64
+	}{
+		{"all", ScanOpts[*freelistKey]{}, []uint64{0, 10, 20, 30, 40, 50, 70, 80, 90}},
+		{"reverse", ScanOpts[*freelistKey]{Reverse: true, Limit: 3}, []uint64{90, 80, 70}},
+		{"start", ScanOpts[*freelistKey]{Start: &freelistKey{ptr: 50}, Limit: 2}, []uint64{50, 70}},
+		{"exclusive", ScanOpts[*freelistKey]{Start: &freelistKey{ptr: 50}, Exclusive: true}, []uint64{70, 80, 90}},
+		{"reverse start", ScanOpts[*freelistKey]{Reverse: true, Start: &freelistKey{ptr: 25}}, []uint64{20, 10, 0}},
+		{"reverse exclusive", ScanOpts[*freelistKey]{Reverse: true, Start: &freelistKey{ptr: 20}, Exclusive: true}, []uint64{10, 0}},
+		{"missing start", ScanOpts[*freelistKey]{Start: &freelistKey{ptr: 95}}, []uint64{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := []uint64{}
+			require.NoError(t, tree.ScanWith(tt.opts, func(key *freelistKey, _ *testVal) (bool, error) {
+				got = append(got, key.ptr)
+				return false, nil
+			}))
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestScanCursor(t *testing.T) {
+	tree := openTestTree[*freelistKey, *testVal](t)
+	insertTestKeys(t, tree, testKeys(25, 0, 2)...)
+
+	pages := func(scan func(token []byte, limit int) ([]*Entry[*freelistKey, *testVal], []byte, error)) [][]uint64 {
+		res := [][]uint64{}
+		var token []byte
+		for {
+			entries, next, err := scan(token, 10)
+			require.NoError(t, err)
+			page := []uint64{}
+			for _, e := range entries {
+				page = append(page, e.Key.ptr)
+			}
+			res = append(res, page)
+			if next == nil {
+				return res
+			}
+			token = next
+		}
+	}
+
+	require.Equal(t, [][]uint64{testKeys(10, 0, 2), testKeys(10, 20, 2), testKeys(5, 40, 2)}, pages(tree.ScanCursor))
+
+	reversed := pages(tree.ScanCursorReverse)
+	require.Len(t, reversed, 3)
+	require.Equal(t, []uint64{48, 46, 44, 42, 40, 38, 36, 34, 32, 30}, reversed[0])
+	require.Equal(t, []uint64{8, 6, 4, 2, 0}, reversed[2])
+
+	// token of a missing key continues from its position
+	token, err := (&freelistKey{ptr: 15}).MarshalBinary()
+	require.NoError(t, err)
+	entries, _, err := tree.ScanCursorReverse(token, 2)
+	require.NoError(t, err)
+	require.Equal(t, uint64(14), entries[0].Key.ptr)
+	require.Equal(t, uint64(12), entries[1].Key.ptr)
+
+	entries, next, err := tree.ScanCursor(token, 100)
+	require.NoError(t, err)
+	require.Len(t, entries, 17)
+	require.Nil(t, next)
+}
+
+func TestNearest(t *testing.T) {
+	tree := openTestTree[*freelistKey, *testVal](t, func(opts *Options) {
+		opts.Tombstones = true
+	})
+	insertTestKeys(t, tree, testKeys(10, 0, 10)...)
+	require.NoError(t, tree.DeleteMem(&freelistKey{ptr: 40}))
+
+	tests := []struct {
+		key  uint64
+		k    int
+		want []uint64
+	}{
+		{50, 3, []uint64{30, 50, 60}},
+		{55, 4, []uint64{30, 50, 60, 70}},
+		{45, 1, []uint64{50}},
+		{0, 3, []uint64{0, 10, 20}},
+		{200, 2, []uint64{80, 90}},
+		{50, 100, []uint64{0, 10, 20, 30, 50, 60, 70, 80, 90}},
+		{50, 0, []uint64{}},
+	}
+
+	for _, tt := range tests {
+		entries, err := tree.Nearest(&freelistKey{ptr: tt.key}, tt.k)
+		require.NoError(t, err)
+		got := []uint64{}
+		for _, e := range entries {
+			got = append(got, e.Key.ptr)
+		}
+		require.Equal(t, tt.want, got, "key:%d k:%d", tt.key, tt.k)
+	}
+}
+
+func TestScanCount(t *testing.T) {
+	tree := openTestTree[*freelistKey, *testVal](t)
+	insertTestKeys(t, tree, testKeys(50, 0, 1)...)
+
+	n, err := tree.ScanCount(nil, func(key *freelistKey, val *testVal) (bool, error) {
+		return key.ptr == 9, nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, 10, n)
+
+	n, err = tree.ScanCount(nil, func(key *freelistKey, val *testVal) (bool, error) {
+		return false, nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, 50, n)
+}
+
+func TestSet(t *testing.T) {
+	dir := t.TempDir()
+	opts := &Options{PageSize: uint16(os.Getpagesize())}
+	open := func(name string, keys ...uint64) *Set[*freelistKey] {
+		s, err := OpenSet[*freelistKey](path.Join(dir, name), opts)
+		require.NoError(t, err)
+		t.Cleanup(func() { s.Close() })
+		for _, k := range keys {
+			require.NoError(t, s.Add(&freelistKey{ptr: k}))
+		}
+		return s
+	}
+
+	keys := func(s *Set[*freelistKey]) []uint64 {
+		res := []uint64{}
+		require.NoError(t, s.Tree().Scan(nil, func(key *freelistKey, _ *DummyVal) (bool, error) {
+			res = append(res, key.ptr)
+			return false, nil
+		}))
+		return res
+	}
+
+	a := open("a", 1, 2, 3, 5, 8)
+	require.NoError(t, a.Add(&freelistKey{ptr: 1}))
+	ok, err := a.Contains(&freelistKey{ptr: 5})
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.NoError(t, a.Remove(&freelistKey{ptr: 5}))
+	require.NoError(t, a.Remove(&freelistKey{ptr: 5}))
+	ok, err = a.Contains(&freelistKey{ptr: 5})
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	b := open("b", 2, 3, 4, 9)
+	require.NoError(t, a.Union(b))
+	require.Equal(t, []uint64{1, 2, 3, 4, 8, 9}, keys(a))
+
+	c := open("c", 0, 3, 4, 8, 10)
+	require.NoError(t, a.Intersect(c))
+	require.Equal(t, []uint64{3, 4, 8}, keys(a))
+
+	require.NoError(t, a.Difference(b))
+	require.Equal(t, []uint64{8}, keys(a))
+
+	require.NoError(t, a.Difference(a))
+	require.Equal(t, []uint64{}, keys(a))
+}
+
+func TestDeleteNullNode(t *testing.T) {
+	tree := openTestTree[*freelistKey, *testVal](t)
+	insertTestKeys(t, tree, testKeys(10, 0, 1)...)
+
+	require.ErrorIs(t, tree.delete(tree.meta.nullPtr), ErrNullPtrDelete)
+	require.ErrorIs(t, tree.delete(0), ErrNullPtrDelete)
+	require.Equal(t, 10, tree.Count())
+	require.NoError(t, tree.Validate())
+}
+
+func TestScanFromIndex(t *testing.T) {
+	tree := openTestTree[*freelistKey, *testVal](t)
+	insertTestKeys(t, tree, testKeys(100, 0, 2)...)
+
+	keys := []uint64{}
+	require.NoError(t, tree.ScanFromIndex(40, 5, func(key *freelistKey, val *testVal) (bool, error) {
+		keys = append(keys, key.ptr)
+		return false, nil
+	}))
+	require.Equal(t, []uint64{80, 82, 84, 86, 88}, keys)
+
+	keys = keys[:0]
+	require.NoError(t, tree.ScanFromIndex(97, 0, func(key *freelistKey, val *testVal) (bool, error) {
+		keys = append(keys, key.ptr)
+		return false, nil
+	}))
+	require.Equal(t, []uint64{194, 196, 198}, keys)
+}
+
+func TestScanRef(t *testing.T) {
+	tree := openTestTree[*freelistKey, *testVal](t)
+	insertTestKeys(t, tree, testKeys(20, 0, 1)...)
+
+	visited := 0
+	require.NoError(t, tree.ScanRef(nil, func(key **freelistKey, val **testVal) (bool, error) {
+		ptr, err := tree.get(*key)
+		require.NoError(t, err)
+		require.Same(t, &tree.fetch(ptr).entry.Key, key)
+		require.Same(t, &tree.fetch(ptr).entry.Val, val)
+		require.Equal(t, uint32((*key).ptr), (*val).v)
+		visited++
+		return false, nil
+	}))
+	require.Equal(t, 20, visited)
+}
+
+func TestTombstones(t *testing.T) {
+	fileName := path.Join(t.TempDir(), "rbtree_test")
+	opts := &Options{PageSize: uint16(os.Getpagesize()), Tombstones: true}
+
+	tree, err := Open[*freelistKey, *testVal](fileName, opts)
+	require.NoError(t, err)
+	insertTestKeys(t, tree, testKeys(100, 0, 1)...)
+
+	start := time.Now()
+	for i := uint64(0); i < 100; i += 10 {
+		require.NoError(t, tree.Delete(&freelistKey{ptr: i}))
+	}
+	require.ErrorIs(t, tree.Delete(&freelistKey{ptr: 0}), ErrNotFound)
+	require.NoError(t, tree.Close())
+
+	tree, err = Open[*freelistKey, *testVal](fileName, opts)
+	require.NoError(t, err)
+	defer tree.Close()
+	require.NoError(t, tree.Validate())
+	require.Equal(t, 90, tree.Count())
+
+	_, err = tree.Get(&freelistKey{ptr: 20})
+	require.ErrorIs(t, err, ErrNotFound)
+	has, err := tree.HasMulti([]*freelistKey{{ptr: 20}, {ptr: 21}})
+	require.NoError(t, err)
+	require.Equal(t, []bool{false, true}, has)
+
+	keys := []uint64{}
+	require.NoError(t, tree.ScanAll(func(key *freelistKey, val *testVal) (bool, error) {
+		require.NotZero(t, key.ptr%10)
+		keys = append(keys, key.ptr)
+		return false, nil
+	}))
+	require.Len(t, keys, 90)
+
+	keys = keys[:0]
+	require.NoError(t, tree.ScanFromIndex(8, 3, func(key *freelistKey, val *testVal) (bool, error) {
+		keys = append(keys, key.ptr)
+		return false, nil
+	}))
+	require.Equal(t, []uint64{9, 11, 12}, keys)
+
+	deleted := []uint64{}
+	require.NoError(t, tree.ScanTombstones(start, func(key *freelistKey, deletedAt time.Time) (bool, error) {
+		require.False(t, deletedAt.Before(start))
+		deleted = append(deleted, key.ptr)
+		return false, nil
+	}))
+	require.Equal(t, testKeys(10, 0, 10), deleted)
+
+	// insert revives tombstone
+	require.NoError(t, tree.Insert(&Entry[*freelistKey, *testVal]{Key: &freelistKey{ptr: 50}, Val: &testVal{v: 5}}))
+	e, err := tree.Get(&freelistKey{ptr: 50})
+	require.NoError(t, err)
+	require.Equal(t, uint32(5), e.Val.v)
+	require.Equal(t, 91, tree.Count())
+
+	purged, err := tree.PurgeTombstones(start)
+	require.NoError(t, err)
+	require.Zero(t, purged)
+
+	purged, err = tree.PurgeTombstones(time.Now())
+	require.NoError(t, err)
+	require.Equal(t, 9, purged)
+	require.Equal(t, 91, tree.Count())
+	require.Equal(t, uint32(91), tree.meta.count)
+	require.NoError(t, tree.Validate())
+	require.NoError(t, tree.ScanTombstones(time.Time{}, func(key *freelistKey, deletedAt time.Time) (bool, error) {
+		require.FailNow(t, "tombstones must be purged")
+		return false, nil
+	}))
+
+	require.NoError(t, tree.Delete(&freelistKey{ptr: 99}))
+	e, err = tree.Max()
+	require.NoError(t, err)
+	require.Equal(t, uint64(98), e.Key.ptr)
+}
+
+func TestMinMax(t *testing.T) {
+	tree := openTestTree[*freelistKey, *testVal](t, func(opts *Options) {
+		opts.Tombstones = true
+	})
+	_, err := tree.Min()
+	require.ErrorIs(t, err, ErrNotFound)
+	_, err = tree.Max()
+	require.ErrorIs(t, err, ErrNotFound)
+
+	insertTestKeys(t, tree, 50, 20, 80, 10, 90, 30)
+	min, err := tree.Min()
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), min.Key.ptr)
+	max, err := tree.Max()
+	require.NoError(t, err)
+	require.Equal(t, uint64(90), max.Key.ptr)
+
+	// tombstones are skipped
+	require.NoError(t, tree.DeleteMem(&freelistKey{ptr: 10}))
+	require.NoError(t, tree.DeleteMem(&freelistKey{ptr: 20}))
+	min, err = tree.Min()
+	require.NoError(t, err)
+	require.Equal(t, uint64(30), min.Key.ptr)
+
+	for _, k := range []uint64{30, 50, 80, 90} {
+		require.NoError(t, tree.DeleteMem(&freelistKey{ptr: k}))
+	}
+	_, err = tree.Min()
+	require.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestTombstonesMismatch(t *testing.T) {
+	fileName := path.Join(t.TempDir(), "rbtree_test")
+	tree, err := Open[*freelistKey, *testVal](fileName, &Options{PageSize: uint16(os.Getpagesize())})
+	require.NoError(t, err)
+	insertTestKeys(t, tree, 1)
+	require.NoError(t, tree.Close())
+
+	_, err = Open[*freelistKey, *testVal](fileName, &Options{PageSize: uint16(os.Getpagesize()), Tombstones: true})
+	require.ErrorIs(t, err, ErrTombstonesMismatch)
+}
+
+func TestFileTooLarge(t *testing.T) {
+	tree := openTestTree[*freelistKey, *testVal](t)
+	insertTestKeys(t, tree, testKeys(10, 0, 1)...)
+
+	pageSize := uint32(tree.meta.pageSize)
+	top := tree.meta.top
+	tree.meta.top = math.MaxUint32 / pageSize * pageSize
+	require.ErrorIs(t, tree.InsertMem(&Entry[*freelistKey, *testVal]{Key: &freelistKey{ptr: 100}, Val: &testVal{}}), ErrFileTooLarge)
+	tree.meta.top = top
+}
+
+func TestOddPageSize(t *testing.T) {
+	tree := openTestTree[*freelistKey, *testVal](t, func(opts *Options) {
+		opts.PageSize = 1000
+	})
+	insertTestKeys(t, tree, testKeys(3000, 0, 1)...)
+	require.NoError(t, tree.Validate())
+
+	for i := uint64(0); i < 3000; i += 7 {
+		e, err := tree.Get(&freelistKey{ptr: i})
+		require.NoError(t, err)
+		require.Equal(t, uint32(i), e.Val.v)
+	}
+}
+
+func TestPop(t *testing.T) {
+	for _, tombstones := range []bool{false, true} {
+		t.Run(fmt.Sprintf("tombstones=%v", tombstones), func(t *testing.T) {
+			tree := openTestTree[*freelistKey, *testVal](t, func(opts *Options) {
+				opts.Tombstones = tombstones
+			})
+			insertTestKeys(t, tree, 5, 3, 8, 1, 9, 4)
+
+			popped := []uint64{}
+			for _, pop := range []func() (*Entry[*freelistKey, *testVal], error){tree.PopMin, tree.PopMax, tree.PopMin} {
+				e, err := pop()
+				require.NoError(t, err)
+				require.Equal(t, uint32(e.Key.ptr), e.Val.v)
+				popped = append(popped, e.Key.ptr)
+			}
+			require.Equal(t, []uint64{1, 9, 3}, popped)
+			require.Equal(t, 3, tree.Count())
+			require.NoError(t, tree.Validate())
+
+			for range 3 {
+				_, err := tree.PopMax()
+				require.NoError(t, err)
+			}
+			_, err := tree.PopMin()
+			require.ErrorIs(t, err, ErrNotFound)
+			_, err = tree.PopMax()
+			require.ErrorIs(t, err, ErrNotFound)
+		})
+	}
+}
+
+func TestPopCopy(t *testing.T) {
+	tree := openTestTree[*freelistKey, *testVal](t)
+	insertTestKeys(t, tree, testKeys(1000, 0, 1)...)
+
+	// popped nodes are refilled with the last allocated ones and then with
+	// new entries, returned copies must not change
+	popped := []*Entry[*freelistKey, *testVal]{}
+	for range 100 {
+		e, err := tree.PopMin()
+		require.NoError(t, err)
+		popped = append(popped, e)
+		e, err = tree.PopMax()
+		require.NoError(t, err)
+		popped = append(popped, e)
+	}
+	insertTestKeys(t, tree, testKeys(200, 5000, 1)...)
+
+	for i, e := range popped {
+		k := uint64(i / 2)
+		if i % 2 == 1 {
+			k = 999 - k
+		}
+		require.Equal(t, k, e.Key.ptr)
+		require.Equal(t, uint32(k), e.Val.v)
+	}
+	require.Equal(t, 1000, tree.Count())
+	require.NoError(t, tree.Validate())
+}
+
+func TestAllocStrategy(t *testing.T) {
+	// share of nodes stored on the same page as their parent
+	locality := func(strategy AllocStrategy) float64 {
+		tree := openTestTree[*freelistKey, *testVal](t, func(opts *Options) {
+			opts.PageSize = 512
+			opts.AllocStrategy = strategy
+		})
+
+		keys := []uint64{}
+		for i := uint64(0); i < 2000; i++ {
+			keys = append(keys, i * 7919 % 2000)
+		}
+		insertTestKeys(t, tree, keys...)
+		for _, k := range keys[:500] {
+			require.NoError(t, tree.DeleteMem(&freelistKey{ptr: k}))
+		}
+		require.NoError(t, tree.Validate())
+
+		e, err := tree.Get(&freelistKey{ptr: keys[1000]})
+		require.NoError(t, err)
+		require.Equal(t, uint32(keys[1000]), e.Val.v)
+
+		near := 0
+		require.NoError(t, tree.ScanAll(func(key *freelistKey, _ *testVal) (bool, error) {
+			ptr, err := tree.get(key)
+			require.NoError(t, err)
+			if tree.pointer(ptr).pageId == tree.pointer(tree.fetch(ptr).parent).pageId {
+				near++
+			}
+			return false, nil
+		}))
+		return float64(near) / float64(tree.Count())
+	}
+
+	require.Greater(t, locality(AllocNearParent), locality(AllocSequential))
+}
+
+func TestUpdate(t *testing.T) {
+	tree := openTestTree[*freelistKey, *testVal](t, func(opts *Options) {
+		opts.Tombstones = true
+	})
+	insertTestKeys(t, tree, 1, 2, 3)
+
+	require.NoError(t, tree.Update(&Entry[*freelistKey, *testVal]{Key: &freelistKey{ptr: 2}, Val: &testVal{v: 20}}))
+	e, err := tree.Get(&freelistKey{ptr: 2})
+	require.NoError(t, err)
+	require.Equal(t, uint32(20), e.Val.v)
+	require.Equal(t, 3, tree.Count())
+
+	err = tree.Update(&Entry[*freelistKey, *testVal]{Key: &freelistKey{ptr: 4}, Val: &testVal{v: 40}})
+	require.ErrorIs(t, err, ErrNotFound)
+
+	require.NoError(t, tree.Delete(&freelistKey{ptr: 3}))
+	err = tree.Update(&Entry[*freelistKey, *testVal]{Key: &freelistKey{ptr: 3}, Val: &testVal{v: 30}})
+	require.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestUpdateValue(t *testing.T) {
+	fileName := path.Join(t.TempDir(), "rbtree_test")
+	tree, err := Open[*freelistKey, *testVal](fileName, &Options{PageSize: 1024})
+	require.NoError(t, err)
+	insertTestKeys(t, tree, testKeys(100, 0, 1)...)
+
+	seq := tree.Seq()
+	val := &testVal{v: 500}
+	require.NoError(t, tree.UpdateValue(&freelistKey{ptr: 50}, val))
+	require.Equal(t, seq + 1, tree.Seq())
+	require.ErrorIs(t, tree.UpdateValue(&freelistKey{ptr: 100}, val), ErrNotFound)
+
+	// value is copied into tree
+	val.v = 0
+	require.NoError(t, tree.Close())
+
+	tree, err = Open[*freelistKey, *testVal](fileName, &Options{PageSize: 1024})
+	require.NoError(t, err)
+	defer tree.Close()
+	e, err := tree.Get(&freelistKey{ptr: 50})
+	require.NoError(t, err)
+	require.Equal(t, uint32(500), e.Val.v)
+	require.Equal(t, 100, tree.Count())
+}
+
+func TestUpsert(t *testing.T) {
+	tree := openTestTree[*freelistKey, *testVal](t, func(opts *Options) {
+		opts.Tombstones = true
+	})
+	insertTestKeys(t, tree, 1, 2)
+
+	created, err := tree.Upsert(&Entry[*freelistKey, *testVal]{Key: &freelistKey{ptr: 2}, Val: &testVal{v: 20}})
+	require.NoError(t, err)
+	require.False(t, created)
+	require.Equal(t, 2, tree.Count())
+
+	created, err = tree.Upsert(&Entry[*freelistKey, *testVal]{Key: &freelistKey{ptr: 3}, Val: &testVal{v: 30}})
+	require.NoError(t, err)
+	require.True(t, created)
+	require.Equal(t, 3, tree.Count())
+
+	// tombstoned key is revived
+	require.NoError(t, tree.Delete(&freelistKey{ptr: 1}))
+	created, err = tree.Upsert(&Entry[*freelistKey, *testVal]{Key: &freelistKey{ptr: 1}, Val: &testVal{v: 10}})
+	require.NoError(t, err)
+	require.True(t, created)
+
+	for k, v := range map[uint64]uint32{1: 10, 2: 20, 3: 30} {
+		e, err := tree.Get(&freelistKey{ptr: k})
+		require.NoError(t, err)
+		require.Equal(t, v, e.Val.v)
+	}
+	require.NoError(t, tree.Validate())
+}
+
+func TestHas(t *testing.T) {
+	tree := openTestTree[*freelistKey, *testVal](t, func(opts *Options) {
+		opts.Tombstones = true
+	})
+	insertTestKeys(t, tree, 1, 2)
+	require.NoError(t, tree.DeleteMem(&freelistKey{ptr: 2}))
+
+	for k, exists := range map[uint64]bool{0: false, 1: true, 2: false, 3: false} {
+		ok, err := tree.Has(&freelistKey{ptr: k})
+		require.NoError(t, err)
+		require.Equal(t, exists, ok, k)
+	}
+}
+
+func TestFloorCeiling(t *testing.T) {
+	tree := openTestTree[*freelistKey, *testVal](t, func(opts *Options) {
+		opts.Tombstones = true
+	})
+	_, err := tree.Floor(&freelistKey{ptr: 10})
+	require.ErrorIs(t, err, ErrNotFound)
+	_, err = tree.Ceiling(&freelistKey{ptr: 10})
+	require.ErrorIs(t, err, ErrNotFound)
+
+	insertTestKeys(t, tree, 10, 20, 30, 40, 50)
+	require.NoError(t, tree.DeleteMem(&freelistKey{ptr: 30}))
+
+	cases := []struct {
+		key, floor, ceiling uint64
+	}{
+		{key: 5, ceiling: 10},
+		{key: 10, floor: 10, ceiling: 10},
+		{key: 25, floor: 20, ceiling: 40},
+		{key: 30, floor: 20, ceiling: 40},
+		{key: 50, floor: 50, ceiling: 50},
+		{key: 55, floor: 50},
+	}
+	for _, c := range cases {
+		e, err := tree.Floor(&freelistKey{ptr: c.key})
+		if c.floor == 0 {
+			require.ErrorIs(t, err, ErrNotFound, c.key)
+		} else {
+			require.NoError(t, err)
+			require.Equal(t, c.floor, e.Key.ptr, c.key)
+		}
+
+		e, err = tree.Ceiling(&freelistKey{ptr: c.key})
+		if c.ceiling == 0 {
+			require.ErrorIs(t, err, ErrNotFound, c.key)
+		} else {
+			require.NoError(t, err)
+			require.Equal(t, c.ceiling, e.Key.ptr, c.key)
+		}
+	}
+}
+
+func TestHigherLower(t *testing.T) {
+	tree := openTestTree[*freelistKey, *testVal](t, func(opts *Options) {
+		opts.Tombstones = true
+	})
+	insertTestKeys(t, tree, testKeys(100, 10, 10)...)
+	require.NoError(t, tree.DeleteMem(&freelistKey{ptr: 500}))
+
+	cases := []struct {
+		key, lower, higher uint64
+	}{
+		{key: 5, higher: 10},
+		{key: 10, higher: 20},
+		{key: 15, lower: 10, higher: 20},
+		{key: 490, lower: 480, higher: 510},
+		{key: 500, lower: 490, higher: 510},
+		{key: 510, lower: 490, higher: 520},
+		{key: 1000, lower: 990},
+		{key: 1005, lower: 1000},
+	}
+	for _, c := range cases {
+		e, err := tree.Lower(&freelistKey{ptr: c.key})
+		if c.lower == 0 {
+			require.ErrorIs(t, err, ErrNotFound, c.key)
+		} else {
+			require.NoError(t, err)
+			require.Equal(t, c.lower, e.Key.ptr, c.key)
+		}
+
+		e, err = tree.Higher(&freelistKey{ptr: c.key})
+		if c.higher == 0 {
+			require.ErrorIs(t, err, ErrNotFound, c.key)
+		} else {
+			require.NoError(t, err)
+			require.Equal(t, c.higher, e.Key.ptr, c.key)
+		}
+	}
+}
+
+func TestSelectRank(t *testing.T) {
+	for _, tombstones := range []bool{false, true} {
+		fileName := path.Join(t.TempDir(), "rbtree_test")
+		opts := &Options{PageSize: 1024, Tombstones: tombstones}
+		tree, err := Open[*freelistKey, *testVal](fileName, opts)
+		require.NoError(t, err)
+
+		rnd := rand.New(rand.NewSource(1))
+		for _, k := range rnd.Perm(500) {
+			insertTestKeys(t, tree, uint64(k*2))
+		}
+		for _, k := range rnd.Perm(500)[:200] {
+			require.NoError(t, tree.DeleteMem(&freelistKey{ptr: uint64(k*2)}))
+		}
+		require.NoError(t, tree.Close())
+
+		// sizes survive reopen
+		tree, err = Open[*freelistKey, *testVal](fileName, opts)
+		require.NoError(t, err)
+		require.NoError(t, tree.Validate())
+
+		keys := []uint64{}
+		require.NoError(t, tree.ScanAll(func(key *freelistKey, val *testVal) (bool, error) {
+			keys = append(keys, key.ptr)
+			return false, nil
+		}))
+		require.Len(t, keys, 300)
+
+		for i, k := range keys {
+			e, err := tree.Select(i)
+			require.NoError(t, err)
+			require.Equal(t, k, e.Key.ptr)
+
+			rank, err := tree.Rank(&freelistKey{ptr: k})
+			require.NoError(t, err)
+			require.Equal(t, i, rank)
+
+			rank, err = tree.Rank(&freelistKey{ptr: k + 1})
+			require.NoError(t, err)
+			require.Equal(t, i + 1, rank)
+		}
+
+		_, err = tree.Select(-1)
+		require.ErrorIs(t, err, ErrNotFound)
+		_, err = tree.Select(len(keys))
+		require.ErrorIs(t, err, ErrNotFound)
+		require.NoError(t, tree.Close())
+	}
+}
+
+func TestCountRange(t *testing.T) {
+	tree := openTestTree[*freelistKey, *testVal](t, func(opts *Options) {
+		opts.Tombstones = true
+	})
+	insertTestKeys(t, tree, testKeys(10, 10, 10)...)
+	require.NoError(t, tree.DeleteMem(&freelistKey{ptr: 50}))
+
+	cases := []struct {
+		lo, hi uint64
+		count  int
+	}{
+		{lo: 10, hi: 100, count: 9},
+		{lo: 0, hi: 1000, count: 9},
+		{lo: 20, hi: 40, count: 3},
+		{lo: 15, hi: 45, count: 3},
+		{lo: 40, hi: 60, count: 2},
+		{lo: 50, hi: 50, count: 0},
+		{lo: 60, hi: 60, count: 1},
+		{lo: 61, hi: 69, count: 0},
+		{lo: 80, hi: 20, count: 0},
+	}
+	for _, c := range cases {
+		count, err := tree.CountRange(&freelistKey{ptr: c.lo}, &freelistKey{ptr: c.hi})
+		require.NoError(t, err)
+		require.Equal(t, c.count, count, "[%v, %v]", c.lo, c.hi)
+	}
+}
+
+func TestOpenMem(t *testing.T) {
+	tree, err := OpenMem[*freelistKey, *testVal](&Options{PageSize: 1024})
+	require.NoError(t, err)
+
+	keys := testKeys(1000, 0, 1)
+	insertTestKeys(t, tree, keys...)
+	require.NoError(t, tree.WriteAll())
+	tree.DropCache()
+	require.NoError(t, tree.Validate())
+	require.Equal(t, len(keys), tree.Count())
+
+	e, err := tree.Get(&freelistKey{ptr: 500})
+	require.NoError(t, err)
+	require.Equal(t, uint32(500), e.Val.v)
+	require.NoError(t, tree.Close())
+
+	// second tree does not share data and nothing is created on disk
+	tree, err = OpenMem[*freelistKey, *testVal](&Options{PageSize: 1024})
+	require.NoError(t, err)
+	require.Equal(t, 0, tree.Count())
+	tree.Remove()
+	_, err = os.Stat(":memory:")
+	require.True(t, os.IsNotExist(err))
+	_, err = os.Stat(":memory:.lock")
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestCompare(t *testing.T) {
+	fileName := path.Join(t.TempDir(), "rbtree_test")
+	opts := &Options{
+		PageSize: 1024,
+		Compare:  func(a, b *signedKey) int { return cmp.Compare(a.v, b.v) },
+	}
+	tree, err := Open[*signedKey, *testVal](fileName, opts)
+	require.NoError(t, err)
+
+	for _, k := range rand.New(rand.NewSource(1)).Perm(200) {
+		require.NoError(t, tree.InsertMem(&Entry[*signedKey, *testVal]{Key: &signedKey{int64(k - 100)}, Val: &testVal{}}))
+	}
+	require.NoError(t, tree.Close())
+
+	tree, err = Open[*signedKey, *testVal](fileName, opts)
+	require.NoError(t, err)
+	defer tree.Close()
+	require.NoError(t, tree.Validate())
+
+	expected := int64(-100)
+	require.NoError(t, tree.ScanAll(func(key *signedKey, val *testVal) (bool, error) {
+		require.Equal(t, expected, key.v)
+		expected++
+		return false, nil
+	}))
+	require.Equal(t, int64(100), expected)
+
+	e, err := tree.Ceiling(&signedKey{-150})
+	require.NoError(t, err)
+	require.Equal(t, int64(-100), e.Key.v)
+	rank, err := tree.Rank(&signedKey{0})
+	require.NoError(t, err)
+	require.Equal(t, 100, rank)
+
+	_, err = Open[*signedKey, *testVal](path.Join(t.TempDir(), "rbtree_test"), &Options{
+		PageSize: 1024,
+		Compare:  func(a, b *freelistKey) int { return 0 },
+	})
+	require.ErrorIs(t, err, ErrInvalidCompare)
+}
+
+func TestKeyCache(t *testing.T) {
+	tree := openTestTree[*freelistKey, *testVal](t, func(opts *Options) {
+		opts.PageSize = 1024
+	})
+	insertTestKeys(t, tree, testKeys(300, 0, 1)...)
+	require.NoError(t, tree.WriteAll())
+	tree.DropCache()
+
+	// freed slots are taken by the last node, its cached key must follow it
+	for k := uint64(0); k < 300; k += 3 {
+		require.NoError(t, tree.DeleteMem(&freelistKey{ptr: k}))
+	}
+	require.NoError(t, tree.Validate())
+
+	c := tree.newCursor()
+	defer c.release()
+	for ok := c.first(); ok; ok = c.next() {
+		raw, err := c.node().entry.Key.MarshalBinary()
+		require.NoError(t, err)
+		if cached := c.node().cachedKey(); cached != nil {
+			require.Equal(t, raw, cached)
+		}
+	}
+}
+
+func TestVerifyChecksums(t *testing.T) {
+	fileName := path.Join(t.TempDir(), "rbtree_test")
+	opts := &Options{PageSize: 1024, VerifyChecksums: true}
+	tree, err := Open[*freelistKey, *testVal](fileName, opts)
+	require.NoError(t, err)
+	insertTestKeys(t, tree, testKeys(100, 0, 1)...)
+	require.NoError(t, tree.Close())
+
+	// intact file passes
+	tree, err = Open[*freelistKey, *testVal](fileName, opts)
+	require.NoError(t, err)
+	require.NoError(t, tree.Validate())
+	require.NoError(t, tree.Close())
+
+	flipByte(t, fileName + ".idx", 1024 + 30)
+	tree, err = Open[*freelistKey, *testVal](fileName, opts)
+	require.NoError(t, err)
+	defer tree.CloseNoFlush()
+	_, err = tree.safeFetch(tree.meta.nullPtr)
+	require.ErrorIs(t, err, ErrChecksumMismatch)
+	require.ErrorIs(t, tree.Validate(), ErrCorrupted)
+}
+
+func TestFetchError(t *testing.T) {
+	fileName := path.Join(t.TempDir(), "rbtree_test")
+	opts := &Options{PageSize: 1024, VerifyChecksums: true}
+	tree, err := Open[*freelistKey, *testVal](fileName, opts)
+	require.NoError(t, err)
+	insertTestKeys(t, tree, testKeys(100, 0, 1)...)
+	require.NoError(t, tree.Close())
+
+	// every page fails to load after the first one holding null and root
+	stat, err := os.Stat(fileName + ".idx")
+	require.NoError(t, err)
+	for off := int64(2 * 1024); off < stat.Size(); off += 1024 {
+		flipByte(t, fileName + ".idx", off + 30)
+	}
+
+	tree, err = Open[*freelistKey, *testVal](fileName, opts)
+	require.NoError(t, err)
+
+	_, err = tree.Get(&freelistKey{ptr: 99})
+	require.ErrorIs(t, err, ErrChecksumMismatch)
+	require.ErrorIs(t, tree.Insert(&Entry[*freelistKey, *testVal]{Key: &freelistKey{ptr: 200}, Val: &testVal{}}), ErrChecksumMismatch)
+	require.ErrorIs(t, tree.Delete(&freelistKey{ptr: 99}), ErrChecksumMismatch)
+	require.ErrorIs(t, tree.ScanAll(func(key *freelistKey, val *testVal) (bool, error) {
+		return false, nil
+	}), ErrChecksumMismatch)
+
+	it := tree.Iterator()
+	for it.Next() {
+	}
+	require.ErrorIs(t, it.Err(), ErrChecksumMismatch)
+	it.Close()
+
+	// locks are released after failures
+	require.NoError(t, tree.CloseNoFlush())
+}
+
+func TestWriteDOT(t *testing.T) {
+	tree, err := OpenMem[*freelistKey, *testVal](&Options{PageSize: 1024})
+	require.NoError(t, err)
+	defer tree.Close()
+
+	insertTestKeys(t, tree, testKeys(100, 0, 1)...)
+
+	var buf bytes.Buffer
+	require.NoError(t, tree.WriteDOT(&buf))
+
+	out := buf.String()
+	require.True(t, strings.HasPrefix(out, "digraph rbtree {\n"))
+	require.True(t, strings.HasSuffix(out, "}\n"))
+	require.Equal(t, tree.Count(), strings.Count(out, "fillcolor="))
+	require.Equal(t, tree.Count() - 1, strings.Count(out, " -> "))
+	require.Positive(t, strings.Count(out, "fillcolor=red"))
+	require.Positive(t, strings.Count(out, "fillcolor=black"))
+}
+
+func TestFprint(t *testing.T) {
+	tree, err := OpenMem[*freelistKey, *testVal](&Options{PageSize: 1024})
+	require.NoError(t, err)
+	defer tree.Close()
+
+	insertTestKeys(t, tree, testKeys(3, 0, 1)...)
+
+	var buf bytes.Buffer
+	require.NoError(t, tree.Fprint(&buf, 2))
+
+	// right-root-left, each level indented by 2 more, null leaves included
+	lines := []string{}
+	for _, l := range strings.Split(buf.String(), "\n") {
+		if l != "" {
+			lines = append(lines, l)
+		}
+	}
+	require.Len(t, lines, 7)
+	require.Equal(t, fmt.Sprintf("  %v %v %v", &freelistKey{ptr: 2}, &testVal{v: 2}, 1), lines[1])
+	require.Equal(t, fmt.Sprintf("%v %v %v", &freelistKey{ptr: 1}, &testVal{v: 1}, 0), lines[3])
+	require.Equal(t, fmt.Sprintf("  %v %v %v", &freelistKey{ptr: 0}, &testVal{v: 0}, 1), lines[5])
+}
+
+func TestInsertBatch(t *testing.T) {
+	fileName := path.Join(t.TempDir(), "rbtree_test")
+	tree, err := Open[*freelistKey, *testVal](fileName, &Options{PageSize: 1024})
+	require.NoError(t, err)
+
+	entries := func(keys ...uint64) []*Entry[*freelistKey, *testVal] {
+		res := make([]*Entry[*freelistKey, *testVal], 0, len(keys))
+		for _, k := range keys {
+			res = append(res, &Entry[*freelistKey, *testVal]{Key: &freelistKey{ptr: k}, Val: &testVal{v: uint32(k)}})
+		}
+		return res
+	}
+
+	inserted, err := tree.InsertBatch(entries(testKeys(1000, 0, 2)...))
+	require.NoError(t, err)
+	require.Equal(t, 1000, inserted)
+
+	// existing keys are skipped
+	inserted, err = tree.InsertBatch(entries(1, 2, 3, 4, 5))
+	require.NoError(t, err)
+	require.Equal(t, 3, inserted)
+	require.NoError(t, tree.Validate())
+	require.NoError(t, tree.Close())
+
+	tree, err = Open[*freelistKey, *testVal](fileName, &Options{PageSize: 1024, StrictBatch: true})
+	require.NoError(t, err)
+	defer tree.Close()
+	require.Equal(t, 1003, tree.Count())
+
+	inserted, err = tree.InsertBatch(entries(7, 9, 10, 11))
+	require.ErrorIs(t, err, ErrKeyAlreadyExists)
+	require.Equal(t, 2, inserted)
+	require.Equal(t, 1005, tree.Count())
+	require.NoError(t, tree.Validate())
+}
+
+func TestDeleteBatch(t *testing.T) {
+	for _, tombstones := range []bool{false, true} {
+		fileName := path.Join(t.TempDir(), "rbtree_test")
+		tree, err := Open[*freelistKey, *testVal](fileName, &Options{PageSize: 1024, Tombstones: tombstones})
+		require.NoError(t, err)
+		insertTestKeys(t, tree, testKeys(1000, 0, 2)...)
+
+		keys := []*freelistKey{}
+		for i := uint64(0); i < 1000; i++ {
+			keys = append(keys, &freelistKey{ptr: i})
+		}
+		deleted, missing, err := tree.DeleteBatch(keys)
+		require.NoError(t, err)
+		require.Equal(t, 500, deleted)
+		require.Equal(t, 500, missing)
+
+		// already deleted keys are missing too
+		deleted, missing, err = tree.DeleteBatch(keys[:10])
+		require.NoError(t, err)
+		require.Equal(t, 0, deleted)
+		require.Equal(t, 10, missing)
+		require.NoError(t, tree.Validate())
+		require.NoError(t, tree.Close())
+
+		tree, err = Open[*freelistKey, *testVal](fileName, &Options{PageSize: 1024, Tombstones: tombstones})
+		require.NoError(t, err)
+		require.Equal(t, 500, tree.Count())
+		e, err := tree.Min()
+		require.NoError(t, err)
+		require.Equal(t, uint64(1000), e.Key.ptr)
+		require.NoError(t, tree.Close())
+	}
+}
+
+func TestDeleteRange(t *testing.T) {
+	for _, tombstones := range []bool{false, true} {
+		tree, err := Open[*freelistKey, *testVal](path.Join(t.TempDir(), "rbtree_test"), &Options{PageSize: 1024, Tombstones: tombstones})
+		require.NoError(t, err)
+		insertTestKeys(t, tree, testKeys(1000, 0, 2)...)
+
+		// empty ranges
+		deleted, err := tree.DeleteRange(&freelistKey{ptr: 101}, &freelistKey{ptr: 102})
+		require.NoError(t, err)
+		require.Equal(t, 0, deleted)
+		deleted, err = tree.DeleteRange(&freelistKey{ptr: 500}, &freelistKey{ptr: 100})
+		require.NoError(t, err)
+		require.Equal(t, 0, deleted)
+		deleted, err = tree.DeleteRange(&freelistKey{ptr: 500}, &freelistKey{ptr: 500})
+		require.NoError(t, err)
+		require.Equal(t, 0, deleted)
+
+		// hi is excluded
+		deleted, err = tree.DeleteRange(&freelistKey{ptr: 99}, &freelistKey{ptr: 200})
+		require.NoError(t, err)
+		require.Equal(t, 50, deleted)
+		require.Equal(t, 950, tree.Count())
+		has, err := tree.Has(&freelistKey{ptr: 200})
+		require.NoError(t, err)
+		require.True(t, has)
+		e, err := tree.Ceiling(&freelistKey{ptr: 99})
+		require.NoError(t, err)
+		require.Equal(t, uint64(200), e.Key.ptr)
+		require.NoError(t, tree.Validate())
+
+		// whole tree
+		deleted, err = tree.DeleteRange(&freelistKey{ptr: 0}, &freelistKey{ptr: math.MaxUint64})
+		require.NoError(t, err)
+		require.Equal(t, 950, deleted)
+		require.Equal(t, 0, tree.Count())
+		require.NoError(t, tree.Validate())
+		require.NoError(t, tree.Close())
+	}
+}
+
+func TestGetAndDelete(t *testing.T) {
+	for _, tombstones := range []bool{false, true} {
+		tree, err := Open[*freelistKey, *testVal](path.Join(t.TempDir(), "rbtree_test"), &Options{PageSize: 1024, Tombstones: tombstones})
+		require.NoError(t, err)
+		insertTestKeys(t, tree, testKeys(1000, 0, 1)...)
+
+		for _, k := range []uint64{500, 0, 999} {
+			e, err := tree.GetAndDelete(&freelistKey{ptr: k})
+			require.NoError(t, err)
+			require.Equal(t, k, e.Key.ptr)
+			require.Equal(t, uint32(k), e.Val.v)
+		}
+
+		// copies stay intact while freed slots are reused
+		e, err := tree.GetAndDelete(&freelistKey{ptr: 10})
+		require.NoError(t, err)
+		insertTestKeys(t, tree, testKeys(100, 2000, 1)...)
+		require.Equal(t, uint64(10), e.Key.ptr)
+		require.Equal(t, uint32(10), e.Val.v)
+
+		_, err = tree.GetAndDelete(&freelistKey{ptr: 500})
+		require.ErrorIs(t, err, ErrNotFound)
+		require.Equal(t, 1096, tree.Count())
+		require.NoError(t, tree.Validate())
+		require.NoError(t, tree.Close())
+	}
+}
+
+func TestClear(t *testing.T) {
+	for _, tombstones := range []bool{false, true} {
+		fileName := path.Join(t.TempDir(), "rbtree_test")
+		opts := &Options{PageSize: 1024, Tombstones: tombstones}
+		tree, err := Open[*freelistKey, *testVal](fileName, opts)
+		require.NoError(t, err)
+		insertTestKeys(t, tree, testKeys(1000, 0, 1)...)
+		require.NoError(t, tree.Delete(&freelistKey{ptr: 10}))
+		seq := tree.Seq()
+
+		require.NoError(t, tree.Clear())
+		require.Equal(t, 0, tree.Count())
+		require.Greater(t, tree.Seq(), seq)
+		require.NoError(t, tree.Validate())
+		_, err = tree.Min()
+		require.ErrorIs(t, err, ErrNotFound)
+
+		stat, err := os.Stat(fileName + ".idx")
+		require.NoError(t, err)
+		require.Equal(t, int64(2 * 1024), stat.Size())
+
+		insertTestKeys(t, tree, testKeys(100, 0, 1)...)
+		require.NoError(t, tree.Close())
+
+		tree, err = Open[*freelistKey, *testVal](fileName, opts)
+		require.NoError(t, err)
+		require.Equal(t, 100, tree.Count())
+		require.NoError(t, tree.Validate())
+		e, err := tree.Max()
+		require.NoError(t, err)
+		require.Equal(t, uint64(99), e.Key.ptr)
+		require.NoError(t, tree.Close())
+	}
+}
+
+func TestClone(t *testing.T) {
+	dir := t.TempDir()
+	opts := &Options{PageSize: 1024}
+	tree, err := Open[*freelistKey, *testVal](path.Join(dir, "rbtree_test"), opts)
+	require.NoError(t, err)
+	defer tree.Close()
+
+	insertTestKeys(t, tree, testKeys(1000, 0, 1)...)
+	require.NoError(t, tree.InsertMem(&Entry[*freelistKey, *testVal]{Key: &freelistKey{ptr: 5000}, Val: &testVal{v: 5000}}))
+
+	clone, err := tree.Clone(path.Join(dir, "rbtree_clone"))
+	require.NoError(t, err)
+	defer clone.Close()
+	require.NoError(t, clone.Validate())
+	require.Equal(t, 1001, clone.Count())
+
+	src, err := os.ReadFile(path.Join(dir, "rbtree_test.idx"))
+	require.NoError(t, err)
+	dst, err := os.ReadFile(path.Join(dir, "rbtree_clone.idx"))
+	require.NoError(t, err)
+	require.Equal(t, src, dst)
+
+	// trees change independently
+	require.NoError(t, tree.Delete(&freelistKey{ptr: 5000}))
+	insertTestKeys(t, clone, 6000)
+	has, err := clone.Has(&freelistKey{ptr: 5000})
+	require.NoError(t, err)
+	require.True(t, has)
+	has, err = tree.Has(&freelistKey{ptr: 6000})
+	require.NoError(t, err)
+	require.False(t, has)
+
+	_, err = tree.Clone(path.Join(dir, "rbtree_clone"))
+	require.ErrorIs(t, err, os.ErrExist)
+	require.Equal(t, 1002, clone.Count())
+}
+
+func TestMaxCachedPages(t *testing.T) {
+	fileName := path.Join(t.TempDir(), "rbtree_test")
+	opts := &Options{PageSize: 1024, MaxCachedPages: 16}
+	tree, err := Open[*freelistKey, *testVal](fileName, opts)
+	require.NoError(t, err)
+	insertTestKeys(t, tree, testKeys(5000, 0, 1)...)
+	require.NoError(t, tree.WriteAll())
+	require.LessOrEqual(t, tree.CacheStats().Pages, 16)
+	require.NoError(t, tree.Close())
+
+	tree, err = Open[*freelistKey, *testVal](fileName, opts)
+	require.NoError(t, err)
+	defer tree.Close()
+
+	n := 0
+	require.NoError(t, tree.ScanAll(func(key *freelistKey, val *testVal) (bool, error) {
+		require.Equal(t, uint64(n), key.ptr)
+		n++
+		return false, nil
+	}))
+	require.Equal(t, 5000, n)
+
+	stats := tree.CacheStats()
+	require.LessOrEqual(t, stats.Pages, 16)
+	require.Positive(t, stats.Hits)
+	require.Positive(t, stats.Misses)
+	require.Positive(t, stats.Evictions)
+
+	// evicted pages are read again, changes made between evictions persist
+	for i := uint64(0); i < 5000; i += 7 {
+		require.NoError(t, tree.Delete(&freelistKey{ptr: i}))
+		e, err := tree.Get(&freelistKey{ptr: 4999 - i})
+		if (4999 - i) % 7 == 0 && 4999 - i <= i {
+			require.ErrorIs(t, err, ErrNotFound)
+		} else {
+			require.NoError(t, err)
+			require.Equal(t, uint32(4999 - i), e.Val.v)
+		}
+		require.LessOrEqual(t, tree.CacheStats().Pages, 16)
+	}
+	require.NoError(t, tree.Validate())
+	require.Equal(t, 5000 - 715, tree.Count())
+}
+
+func TestStats(t *testing.T) {
+	fileName := path.Join(t.TempDir(), "rbtree_test")
+	opts := &Options{PageSize: 1024}
+	tree, err := Open[*freelistKey, *testVal](fileName, opts)
+	require.NoError(t, err)
+	require.Equal(t, 0, tree.Stats().Height)
+
+	insertTestKeys(t, tree, testKeys(1000, 0, 1)...)
+	require.NoError(t, tree.Delete(&freelistKey{ptr: 0}))
+	stats := tree.Stats()
+	require.Equal(t, 999, stats.Count)
+	require.Equal(t, uint64(1001), stats.NodeAllocs) // null node included
+	require.Equal(t, uint64(1), stats.NodeFrees)
+	require.Equal(t, tree.CacheStats().Pages, stats.CachedPages)
+	require.Positive(t, stats.PageWrites)
+	require.GreaterOrEqual(t, stats.Height, 10)
+	require.NoError(t, tree.Close())
+
+	tree, err = Open[*freelistKey, *testVal](fileName, opts)
+	require.NoError(t, err)
+	defer tree.Close()
+
+	before := tree.Stats()
+	require.Equal(t, uint64(0), before.PageWrites)
+	_, err = tree.Get(&freelistKey{ptr: 500})
+	require.NoError(t, err)
+	after := tree.Stats()
+	require.Greater(t, after.PageReads, before.PageReads)
+	require.Equal(t, after.PageReads - before.PageReads, after.CacheMisses - before.CacheMisses)
+	require.Positive(t, after.CacheHits)
+}
+
+func TestSync(t *testing.T) {
+	fileName := path.Join(t.TempDir(), "rbtree_test")
+	opts := &Options{PageSize: 1024, NoAutoSync: true}
+	tree, err := Open[*freelistKey, *testVal](fileName, opts)
+	require.NoError(t, err)
+
+	for _, k := range testKeys(100, 0, 1) {
+		require.NoError(t, tree.Insert(&Entry[*freelistKey, *testVal]{Key: &freelistKey{ptr: k}, Val: &testVal{v: uint32(k)}}))
+	}
+	require.True(t, tree.IsDirty())
+	require.NoError(t, tree.Sync())
+	require.False(t, tree.IsDirty())
+
+	// changes after the last Sync are lost without flushing on close
+	require.NoError(t, tree.Delete(&freelistKey{ptr: 0}))
+	insertTestKeys(t, tree, 1000)
+	require.True(t, tree.IsDirty())
+	require.NoError(t, tree.CloseNoFlush())
+
+	tree, err = Open[*freelistKey, *testVal](fileName, opts)
+	require.NoError(t, err)
+	require.Equal(t, 100, tree.Count())
+	require.NoError(t, tree.Validate())
+	_, err = tree.Get(&freelistKey{ptr: 0})
+	require.NoError(t, err)
+	require.NoError(t, tree.Close())
+}
+
+func TestWAL(t *testing.T) {
+	fileName := path.Join(t.TempDir(), "rbtree_test")
+	opts := &Options{PageSize: 1024, WAL: true}
+	tree, err := Open[*freelistKey, *testVal](fileName, opts)
+	require.NoError(t, err)
+	insertTestKeys(t, tree, testKeys(1000, 0, 2)...)
+	require.NoError(t, tree.Close())
+
+	stat, err := os.Stat(fileName + ".wal")
+	require.NoError(t, err)
+	require.Equal(t, int64(0), stat.Size())
+
+	// crash leaves flush logged and some of its pages written
+	crash := func(logBytes int, applied int) {
+		tree, err := Open[*freelistKey, *testVal](fileName, opts)
+		require.NoError(t, err)
+		insertTestKeys(t, tree, testKeys(500, 1, 2)...)
+		for i := uint64(0); i < 100; i++ {
+			require.NoError(t, tree.DeleteMem(&freelistKey{ptr: i * 4}))
+		}
+
+		records, _, _, err := tree.walRecords(tree.pages.dirtyPages(), -1)
+		require.NoError(t, err)
+		require.NoError(t, tree.wal.write(records))
+		for _, r := range records[:applied] {
+			require.NoError(t, tree.pager.Write(r.id, r.data))
+		}
+		if logBytes > 0 {
+			require.NoError(t, tree.wal.file.Truncate(int64(logBytes)))
+		}
+		require.NoError(t, tree.CloseNoFlush())
+	}
+
+	// incomplete log is discarded, tree file was not touched yet
+	crash(1000, 0)
+	tree, err = Open[*freelistKey, *testVal](fileName, opts)
+	require.NoError(t, err)
+	require.Equal(t, 1000, tree.Count())
+	require.NoError(t, tree.Validate())
+	require.NoError(t, tree.Close())
+
+	// complete log is replayed over partially written pages
+	crash(0, 3)
+	tree, err = Open[*freelistKey, *testVal](fileName, opts)
+	require.NoError(t, err)
+	require.Equal(t, 1400, tree.Count())
+	require.NoError(t, tree.Validate())
+	e, err := tree.Get(&freelistKey{ptr: 999})
+	require.NoError(t, err)
+	require.Equal(t, uint32(999), e.Val.v)
+	_, err = tree.Get(&freelistKey{ptr: 396})
+	require.ErrorIs(t, err, ErrNotFound)
+	require.NoError(t, tree.Close())
+
+	stat, err = os.Stat(fileName + ".wal")
+	require.NoError(t, err)
+	require.Equal(t, int64(0), stat.Size())
+}
+
+func TestTypeMismatch(t *testing.T) {
+	fileName := path.Join(t.TempDir(), "rbtree_test")
+	opts := &Options{PageSize: 1024}
+	tree, err := Open[*freelistKey, *testVal](fileName, opts)
+	require.NoError(t, err)
+	insertTestKeys(t, tree, testKeys(100, 0, 1)...)
+	require.NoError(t, tree.Close())
+
+	_, err = Open[*Uint64, *testVal](fileName, opts)
+	require.ErrorIs(t, err, ErrTypeMismatch)
+	require.ErrorContains(t, err, "*rbtree.Uint64")
+	_, err = Open[*freelistKey, *Uint64](fileName, opts)
+	require.ErrorIs(t, err, ErrTypeMismatch)
+
+	tree, err = Open[*freelistKey, *testVal](fileName, opts)
+	require.NoError(t, err)
+	require.Equal(t, 100, tree.Count())
+	require.NoError(t, tree.Close())
+}
+
+func TestIncompatibleFormat(t *testing.T) {
+	fileName := path.Join(t.TempDir(), "rbtree_test")
+	opts := &Options{PageSize: 1024}
+	tree, err := Open[*freelistKey, *testVal](fileName, opts)
+	require.NoError(t, err)
+	insertTestKeys(t, tree, testKeys(100, 0, 1)...)
+	require.NoError(t, tree.Close())
+	info, err := os.Stat(fileName + ".idx")
+	require.NoError(t, err)
+
+	_, err = Open[*freelistKey, *testVal](fileName, &Options{PageSize: 2048})
+	require.ErrorIs(t, err, ErrIncompatibleFormat)
+
+	// failed opens leave file as it was
+	after, err := os.Stat(fileName + ".idx")
+	require.NoError(t, err)
+	require.Equal(t, info.Size(), after.Size())
+	tree, err = Open[*freelistKey, *testVal](fileName, opts)
+	require.NoError(t, err)
+	require.Equal(t, 100, tree.Count())
+	require.NoError(t, tree.Close())
+
+	flipByte(t, fileName + ".idx", 63)
+	_, err = Open[*freelistKey, *testVal](fileName, opts)
+	require.ErrorIs(t, err, ErrIncompatibleFormat)
+	flipByte(t, fileName + ".idx", 63)
+
+	flipByte(t, fileName + ".idx", 59)
+	_, err = Open[*freelistKey, *testVal](fileName, opts)
+	require.ErrorIs(t, err, ErrIncompatibleFormat)
+
+	// files without magic are opened as before
+	for off := int64(59); off < 64; off++ {
+		f, err := os.OpenFile(fileName + ".idx", os.O_RDWR, 0)
+		require.NoError(t, err)
+		_, err = f.WriteAt([]byte{0}, off)
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+	}
+	tree, err = Open[*freelistKey, *testVal](fileName, opts)
+	require.NoError(t, err)
+	require.Equal(t, 100, tree.Count())
+	require.NoError(t, tree.Close())
+}
+
+func TestHeight(t *testing.T) {
+	tree := openTestTree[*freelistKey, *testVal](t)
+	require.Equal(t, 0, tree.height())
+
+	insertTestKeys(t, tree, 1)
+	require.Equal(t, 1, tree.height())
+
+	insertTestKeys(t, tree, 2)
+	require.Equal(t, 3, tree.height())
+
+	var depth func(ptr uint32) int
+	depth = func(ptr uint32) int {
+		if ptr == tree.meta.nullPtr {
+			return 0
+		}
+		return 1 + max(depth(tree.fetch(ptr).left), depth(tree.fetch(ptr).right))
+	}
+	for n := 3; n < 1000; n++ {
+		insertTestKeys(t, tree, uint64(n))
+		require.LessOrEqual(t, depth(tree.meta.rootPtr), tree.height(), "n=%d", n)
+	}
+}
+
+func TestAllowDuplicates(t *testing.T) {
+	for _, tombstones := range []bool{false, true} {
+		t.Run(fmt.Sprintf("tombstones=%v", tombstones), func(t *testing.T) {
+			tree := openTestTree[*freelistKey, *testVal](t, func(opts *Options) {
+				opts.PageSize = 1024
+				opts.AllowDuplicates = true
+				opts.Tombstones = tombstones
+			})
+
+			vals := func(key uint64) []uint32 {
+				entries, err := tree.GetAll(&freelistKey{ptr: key})
+				if err == ErrNotFound {
+					return nil
+				}
+				require.NoError(t, err)
+				res := []uint32{}
+				for _, e := range entries {
+					require.Equal(t, key, e.Key.ptr)
+					res = append(res, e.Val.v)
+				}
+				return res
+			}
+
+			// every round adds one more duplicate of each key
+			keys := rand.New(rand.NewSource(1)).Perm(200)
+			for round := uint32(0); round < 5; round++ {
+				for _, k := range keys {
+					require.NoError(t, tree.Insert(&Entry[*freelistKey, *testVal]{
+						Key: &freelistKey{ptr: uint64(k)},
+						Val: &testVal{v: uint32(k) * 10 + round},
+					}))
+				}
+			}
+			require.Equal(t, 1000, tree.Count())
+			require.NoError(t, tree.Validate())
+			require.Equal(t, []uint32{70, 71, 72, 73, 74}, vals(7))
+
+			e, err := tree.Get(&freelistKey{ptr: 7})
+			require.NoError(t, err)
+			require.Equal(t, uint32(70), e.Val.v)
+
+			// deletes remove the first duplicate only
+			for _, k := range keys[:100] {
+				require.NoError(t, tree.Delete(&freelistKey{ptr: uint64(k)}))
+			}
+			for _, k := range keys[:50] {
+				require.NoError(t, tree.Delete(&freelistKey{ptr: uint64(k)}))
+			}
+			k := uint64(keys[0])
+			require.Equal(t, []uint32{uint32(k) * 10 + 2, uint32(k) * 10 + 3, uint32(k) * 10 + 4}, vals(k))
+			k = uint64(keys[99])
+			require.Equal(t, []uint32{uint32(k) * 10 + 1, uint32(k) * 10 + 2, uint32(k) * 10 + 3, uint32(k) * 10 + 4}, vals(k))
+			require.Equal(t, 850, tree.Count())
+			require.NoError(t, tree.Validate())
+
+			for range 3 {
+				require.NoError(t, tree.Delete(&freelistKey{ptr: uint64(keys[0])}))
+			}
+			require.Nil(t, vals(uint64(keys[0])))
+			require.ErrorIs(t, tree.Delete(&freelistKey{ptr: uint64(keys[0])}), ErrNotFound)
+			_, err = tree.Get(&freelistKey{ptr: uint64(keys[0])})
+			require.ErrorIs(t, err, ErrNotFound)
+
+			// scans start at the first duplicate and visit all of them
+			scanned := []uint32{}
+			require.NoError(t, tree.Scan(&freelistKey{ptr: 7}, func(key *freelistKey, val *testVal) (bool, error) {
+				scanned = append(scanned, val.v)
+				return key.ptr > 7, nil
+			}))
+			require.Equal(t, append(vals(7), vals(8)[0]), scanned)
+
+			n := 0
+			require.NoError(t, tree.ScanAll(func(key *freelistKey, val *testVal) (bool, error) {
+				n++
+				return false, nil
+			}))
+			require.Equal(t, 847, n)
+		})
+	}
+}
+
+func TestForEach(t *testing.T) {
+	tree := openTestTree[*freelistKey, *testVal](t)
+	insertTestKeys(t, tree, testKeys(1000, 0, 1)...)
+
+	entries := []*Entry[*freelistKey, *testVal]{}
+	require.NoError(t, tree.ForEach(func(e *Entry[*freelistKey, *testVal]) (bool, error) {
+		entries = append(entries, e)
+		return false, nil
+	}))
+	require.Len(t, entries, 1000)
+
+	// freed slots are overwritten by moved and new nodes
+	for i := uint64(0); i < 1000; i += 2 {
+		require.NoError(t, tree.Delete(&freelistKey{ptr: i}))
+	}
+	insertTestKeys(t, tree, testKeys(500, 2000, 1)...)
+	for i, e := range entries {
+		require.Equal(t, uint64(i), e.Key.ptr)
+		require.Equal(t, uint32(i), e.Val.v)
+	}
+
+	n := 0
+	require.NoError(t, tree.ForEach(func(e *Entry[*freelistKey, *testVal]) (bool, error) {
+		n++
+		return n == 10, nil
+	}))
+	require.Equal(t, 10, n)
+}
+
+func TestReadOnly(t *testing.T) {
+	fileName := path.Join(t.TempDir(), "rbtree_test")
+	_, err := Open[*freelistKey, *testVal](fileName, &Options{PageSize: 1024, ReadOnly: true})
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	tree, err := Open[*freelistKey, *testVal](fileName, &Options{PageSize: 1024})
+	require.NoError(t, err)
+	insertTestKeys(t, tree, testKeys(100, 0, 1)...)
+	require.NoError(t, tree.Close())
+	info, err := os.Stat(fileName + ".idx")
+	require.NoError(t, err)
+
+	opts := &Options{PageSize: 1024, ReadOnly: true}
+	tree, err = Open[*freelistKey, *testVal](fileName, opts)
+	require.NoError(t, err)
+	other, err := Open[*freelistKey, *testVal](fileName, opts)
+	require.NoError(t, err)
+	_, err = Open[*freelistKey, *testVal](fileName, &Options{PageSize: 1024})
+	require.ErrorIs(t, err, ErrLocked)
+
+	e, err := other.Get(&freelistKey{ptr: 50})
+	require.NoError(t, err)
+	require.Equal(t, uint32(50), e.Val.v)
+	require.NoError(t, other.Close())
+
+	entry := &Entry[*freelistKey, *testVal]{Key: &freelistKey{ptr: 500}, Val: &testVal{}}
+	require.ErrorIs(t, tree.Insert(entry), ErrReadOnly)
+	require.ErrorIs(t, tree.InsertMem(entry), ErrReadOnly)
+	require.ErrorIs(t, tree.Delete(&freelistKey{ptr: 1}), ErrReadOnly)
+	require.ErrorIs(t, tree.DeleteMem(&freelistKey{ptr: 1}), ErrReadOnly)
+	entry.Key.ptr = 1
+	require.ErrorIs(t, tree.Update(entry), ErrReadOnly)
+	_, err = tree.PopMin()
+	require.ErrorIs(t, err, ErrReadOnly)
+	require.ErrorIs(t, tree.Clear(), ErrReadOnly)
+	require.False(t, tree.IsDirty())
+	require.Equal(t, 100, tree.Count())
+	require.NoError(t, tree.Validate())
+	tree.Remove()
+
+	after, err := os.Stat(fileName + ".idx")
+	require.NoError(t, err)
+	require.Equal(t, info.ModTime(), after.ModTime())
+	require.Equal(t, info.Size(), after.Size())
+}
+
+func TestSnapshot(t *testing.T) {
+	for _, mem := range []bool{false, true} {
+		opts := &Options{PageSize: 1024}
+		var tree *RBTree[*freelistKey, *testVal]
+		var err error
+		if mem {
+			tree, err = OpenMem[*freelistKey, *testVal](opts)
+		} else {
+			tree, err = Open[*freelistKey, *testVal](path.Join(t.TempDir(), "rbtree_test"), opts)
+		}
+		require.NoError(t, err)
+		insertTestKeys(t, tree, testKeys(200, 0, 1)...)
+
+		s, err := tree.Snapshot()
+		require.NoError(t, err)
+		for _, k := range testKeys(150, 0, 1) {
+			require.NoError(t, tree.Delete(&freelistKey{ptr: k}))
+		}
+		require.NoError(t, tree.Update(&Entry[*freelistKey, *testVal]{Key: &freelistKey{ptr: 199}, Val: &testVal{v: 7}}))
+
+		// writers are not blocked while snapshot is read
+		keys := []uint64{}
+		require.NoError(t, s.Scan(&freelistKey{}, func(key *freelistKey, val *testVal) (bool, error) {
+			keys = append(keys, key.ptr)
+			require.Equal(t, uint32(key.ptr), val.v)
+			return false, tree.Insert(&Entry[*freelistKey, *testVal]{Key: &freelistKey{ptr: 1000 + key.ptr}, Val: &testVal{}})
+		}))
+		require.Equal(t, testKeys(200, 0, 1), keys)
+		require.Equal(t, 200, s.Count())
+		require.Equal(t, 250, tree.Count())
+
+		e, err := s.Get(&freelistKey{ptr: 10})
+		require.NoError(t, err)
+		require.Equal(t, uint32(10), e.Val.v)
+		_, err = s.Get(&freelistKey{ptr: 1000})
+		require.ErrorIs(t, err, ErrNotFound)
+
+		require.NoError(t, tree.Clear())
+		e, err = s.Get(&freelistKey{ptr: 199})
+		require.NoError(t, err)
+		require.Equal(t, uint32(199), e.Val.v)
+
+		s.Release()
+		s.Release()
+		_, err = s.Get(&freelistKey{ptr: 10})
+		require.ErrorIs(t, err, ErrSnapshotReleased)
+		require.ErrorIs(t, s.Scan(&freelistKey{}, nil), ErrSnapshotReleased)
+
+		s, err = tree.Snapshot()
+		require.NoError(t, err)
+		require.NoError(t, tree.Close())
+		_, err = s.Get(&freelistKey{ptr: 10})
+		require.ErrorIs(t, err, ErrSnapshotReleased)
+	}
+}
+
+func TestGetMany(t *testing.T) {
+	tree := openTestTree[*freelistKey, *testVal](t)
+
+	insertTestKeys(t, tree, testKeys(100, 0, 2)...)
+
+	keys := []*freelistKey{{ptr: 10}, {ptr: 11}, {ptr: 198}, {ptr: 0}, {ptr: 500}}
+	entries, errs := tree.GetMany(keys)
+	require.Len(t, entries, len(keys))
+	require.Len(t, errs, len(keys))
+	for i, k := range keys {
+		if k.ptr%2 == 0 && k.ptr < 200 {
+			require.NoError(t, errs[i])
+			require.Equal(t, k.ptr, entries[i].Key.ptr)
+		} else {
+			require.ErrorIs(t, errs[i], ErrNotFound)
+			require.Nil(t, entries[i])
+		}
+	}
+
+	// entries are copies
+	require.NoError(t, tree.Update(&Entry[*freelistKey, *testVal]{Key: &freelistKey{ptr: 10}, Val: &testVal{v: 99}}))
+	require.Equal(t, uint32(10), entries[0].Val.v)
+}
+
+func TestExportImport(t *testing.T) {
+	tree := openTestTree[*freelistKey, *testVal](t, func(opts *Options) { opts.Tombstones = true })
+	insertTestKeys(t, tree, testKeys(500, 0, 1)...)
+	for _, k := range testKeys(100, 0, 5) {
+		require.NoError(t, tree.DeleteMem(&freelistKey{ptr: k}))
+	}
+
+	buf := &bytes.Buffer{}
+	require.NoError(t, tree.Export(buf))
+	require.True(t, tree.IsDirty())
+	data := buf.Bytes()
+
+	restored, err := OpenMem[*freelistKey, *testVal](&Options{PageSize: 1024})
+	require.NoError(t, err)
+	defer restored.Close()
+	require.NoError(t, restored.Import(bytes.NewReader(data)))
+	require.Equal(t, 400, restored.Count())
+	require.NoError(t, restored.Validate())
+	for _, k := range testKeys(500, 0, 1) {
+		e, err := restored.Get(&freelistKey{ptr: k})
+		if k%5 == 0 {
+			require.ErrorIs(t, err, ErrNotFound)
+			continue
+		}
+		require.NoError(t, err)
+		require.Equal(t, uint32(k), e.Val.v)
+	}
+
+	require.ErrorIs(t, restored.Import(bytes.NewReader(data)), ErrNotEmpty)
+	require.Error(t, restored.Import(bytes.NewReader(data[:len(data)-1])))
+
+	other, err := OpenMem[*Uint64, *testVal](&Options{PageSize: 1024})
+	require.NoError(t, err)
+	defer other.Close()
+	require.ErrorIs(t, other.Import(bytes.NewReader(data)), ErrTypeMismatch)
+
+	// header is validated and its count does not size allocation
+	empty, err := OpenMem[*freelistKey, *testVal](&Options{PageSize: 1024})
+	require.NoError(t, err)
+	defer empty.Close()
+	header := append([]byte{}, data[:exportHeaderSize]...)
+	bin.PutUint32(header[8:12], math.MaxUint32)
+	require.ErrorIs(t, empty.Import(bytes.NewReader(header)), ErrCorrupted)
+	bin.PutUint64(header[0:8], math.MaxUint64)
+	require.ErrorIs(t, empty.Import(bytes.NewReader(header)), io.EOF)
+	require.Zero(t, empty.Count())
+}
+
+func TestExportJSON(t *testing.T) {
+	tree := openTestTree[*freelistKey, *testVal](t)
+
+	buf := &bytes.Buffer{}
+	require.NoError(t, tree.ExportJSON(buf, nil, nil))
+	require.Equal(t, "[]", buf.String())
+
+	insertTestKeys(t, tree, 3, 1, 2)
+	buf.Reset()
+	require.NoError(t, tree.ExportJSON(
+		buf,
+		func(k *freelistKey) any { return k.ptr },
+		func(v *testVal) any { return fmt.Sprintf("v%d", v.v) },
+	))
+
+	var entries []struct {
+		Key   uint64 `json:"key"`
+		Value string `json:"value"`
+	}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &entries))
+	require.Len(t, entries, 3)
+	for i, e := range entries {
+		require.Equal(t, uint64(i + 1), e.Key)
+		require.Equal(t, fmt.Sprintf("v%d", i + 1), e.Value)
+
+		got, err := tree.Get(&freelistKey{ptr: e.Key})
+		require.NoError(t, err)
+		require.Equal(t, e.Value, fmt.Sprintf("v%d", got.Val.v))
+	}
+}
+
+func TestMergeFrom(t *testing.T) {
+	tree := openTestTree[*freelistKey, *testVal](t)
+	other := openTestTree[*freelistKey, *testVal](t, func(opts *Options) { opts.Tombstones = true })
+	insertTestKeys(t, tree, testKeys(100, 0, 2)...)
+	insertTestKeys(t, other, testKeys(100, 0, 3)...)
+	require.NoError(t, other.Delete(&freelistKey{ptr: 3}))
+
+	_, err := tree.MergeFrom(tree, nil)
+	require.ErrorIs(t, err, ErrSelfMerge)
+
+	conflicts := 0
+	merged, err := tree.MergeFrom(other, func(existing, incoming *Entry[*freelistKey, *testVal]) *Entry[*freelistKey, *testVal] {
+		require.Equal(t, existing.Key.ptr, incoming.Key.ptr)
+		conflicts++
+		if existing.Key.ptr%4 == 0 {
+			return nil
+		}
+		return &Entry[*freelistKey, *testVal]{Key: incoming.Key, Val: &testVal{v: 1000}}
+	})
+	require.NoError(t, err)
+	// keys divisible by 6 conflict, those divisible by 12 keep existing value
+	require.Equal(t, 34, conflicts)
+	require.Equal(t, 99 - 34 + 17, merged)
+	require.Equal(t, 100 + 99 - 34, tree.Count())
+	require.False(t, tree.IsDirty())
+	require.NoError(t, tree.Validate())
+
+	for _, k := range []uint64{0, 6, 12, 3, 9, 297} {
+		e, err := tree.Get(&freelistKey{ptr: k})
+		if k == 3 {
+			require.ErrorIs(t, err, ErrNotFound)
+			continue
+		}
+		require.NoError(t, err)
+		if k%6 == 0 && k%4 != 0 {
+			require.Equal(t, uint32(1000), e.Val.v)
+		} else {
+			require.Equal(t, uint32(k), e.Val.v)
+		}
+	}
+
+	_, err = tree.MergeFrom(other, nil)
+	require.ErrorIs(t, err, ErrKeyAlreadyExists)
+}
+
+func TestPrefixScan(t *testing.T) {
+	tree := openTestTree[*freelistKey, *testVal](t)
+
+	for _, size := range []uint32{3, 1, 2, 0x0100} {
+		for _, ptr := range []uint64{5, 1 << 56, 0} {
+			require.NoError(t, tree.Insert(&Entry[*freelistKey, *testVal]{Key: &freelistKey{size: size, ptr: ptr}, Val: &testVal{}}))
+		}
+	}
+
+	scan := func(prefix []byte) (keys []freelistKey) {
+		require.NoError(t, tree.PrefixScan(prefix, func(key *freelistKey, val *testVal) (bool, error) {
+			keys = append(keys, *key)
+			return false, nil
+		}))
+		return keys
+	}
+
+	require.Equal(t, []freelistKey{{size: 2, ptr: 0}, {size: 2, ptr: 5}, {size: 2, ptr: 1 << 56}}, scan([]byte{0, 0, 0, 2}))
+	require.Equal(t, []freelistKey{{size: 2, ptr: 1 << 56}}, scan([]byte{0, 0, 0, 2, 1}))
+	require.Equal(t, []freelistKey{{size: 1, ptr: 0}, {size: 1, ptr: 5}}, scan([]byte{0, 0, 0, 1, 0}))
+	require.Len(t, scan([]byte{0, 0, 0}), 9)
+	require.Len(t, scan(nil), 12)
+	require.Empty(t, scan([]byte{0, 0, 0, 4}))
+	require.Empty(t, scan([]byte{0xff}))
+
+	require.ErrorIs(t, tree.PrefixScan(make([]byte, 13), nil), ErrInvalidKeySize)
+
+	reversed := openTestTree[*freelistKey, *testVal](t, func(opts *Options) {
+		opts.CompareBytes = func(a, b []byte) int { return bytes.Compare(b, a) }
+	})
+	require.ErrorIs(t, reversed.PrefixScan([]byte{0}, nil), ErrUnsupported)
+	typed := openTestTree[*freelistKey, *testVal](t, func(opts *Options) {
+		opts.Compare = func(a, b *freelistKey) int { return cmp.Compare(a.ptr, b.ptr) }
+	})
+	require.ErrorIs(t, typed.PrefixScan([]byte{0}, nil), ErrUnsupported)
+}
+
+func TestCompact(t *testing.T) {
+	fileName := path.Join(t.TempDir(), "rbtree_test")
+	opts := &Options{PageSize: 1024, Tombstones: true}
+	tree, err := Open[*freelistKey, *testVal](fileName, opts)
+	require.NoError(t, err)
+	for _, k := range testKeys(5000, 0, 1) {
+		require.NoError(t, tree.InsertMem(&Entry[*freelistKey, *testVal]{Key: &freelistKey{ptr: k}, Val: &testVal{v: uint32(k)}}))
+	}
+	for _, k := range testKeys(4900, 0, 1) {
+		require.NoError(t, tree.DeleteMem(&freelistKey{ptr: k}))
+	}
+	require.NoError(t, tree.WriteAll())
+	before, err := os.Stat(fileName + ".idx")
+	require.NoError(t, err)
+	seq := tree.Seq()
+
+	s, err := tree.Snapshot()
+	require.NoError(t, err)
+	defer s.Release()
+
+	require.NoError(t, tree.Compact())
+	after, err := os.Stat(fileName + ".idx")
+	require.NoError(t, err)
+	require.Less(t, after.Size() * 20, before.Size())
+	require.Equal(t, 100, tree.Count())
+	require.Equal(t, seq, tree.Seq())
+	require.NoError(t, tree.Validate())
+	require.NoFileExists(t, fileName + ".idx.compact")
+
+	_, err = s.Get(&freelistKey{ptr: 4950})
+	require.ErrorIs(t, err, ErrSnapshotReleased)
+
+	// tree stays usable and survives reopen
+	insertTestKeys(t, tree, 1, 2)
+	require.NoError(t, tree.Delete(&freelistKey{ptr: 4999}))
+	require.NoError(t, tree.Close())
+	tree, err = Open[*freelistKey, *testVal](fileName, opts)
+	require.NoError(t, err)
+	defer tree.Close()
+	require.Equal(t, 101, tree.Count())
+	require.NoError(t, tree.Validate())
+	e, err := tree.Get(&freelistKey{ptr: 4950})
+	require.NoError(t, err)
+	require.Equal(t, uint32(4950), e.Val.v)
+
+	// compacted file is written and removed under tree file name
+	require.NoError(t, tree.Compact())
+	insertTestKeys(t, tree, 3)
+	require.NoError(t, tree.Compact())
+	require.Equal(t, 102, tree.Count())
+	require.NoError(t, tree.Validate())
+	tree.Remove()
+	require.NoFileExists(t, fileName + ".idx")
+	require.NoFileExists(t, fileName + ".idx.compact")
+
+	mem, err := OpenMem[*freelistKey, *testVal](&Options{PageSize: 1024})
+	require.NoError(t, err)
+	defer mem.Close()
+	insertTestKeys(t, mem, testKeys(1000, 0, 1)...)
+	for _, k := range testKeys(500, 0, 2) {
+		require.NoError(t, mem.Delete(&freelistKey{ptr: k}))
+	}
+	require.NoError(t, mem.Compact())
+	require.Equal(t, 500, mem.Count())
+	require.NoError(t, mem.Validate())
+	has, err := mem.Has(&freelistKey{ptr: 999})
+	require.NoError(t, err)
+	require.True(t, has)
+}
+
+func TestUtilization(t *testing.T) {
+	tree := openTestTree[*freelistKey, *testVal](t, func(opts *Options) { opts.PageSize = 1024; opts.Tombstones = true })
+	require.Zero(t, tree.Utilization())
+
+	for _, k := range testKeys(5000, 0, 1) {
+		require.NoError(t, tree.InsertMem(&Entry[*freelistKey, *testVal]{Key: &freelistKey{ptr: k}, Val: &testVal{}}))
+	}
+	require.NoError(t, tree.WriteAll())
+	size, err := tree.FileSize()
+	require.NoError(t, err)
+	require.Equal(t, int64(tree.pager.Count()) * 1024, size)
+	full := tree.Utilization()
+	require.Greater(t, full, 0.8)
+	require.LessOrEqual(t, full, 1.0)
+
+	for _, k := range testKeys(4500, 0, 1) {
+		require.NoError(t, tree.DeleteMem(&freelistKey{ptr: k}))
+	}
+	require.Less(t, tree.Utilization(), 0.1)
+
+	require.NoError(t, tree.Compact())
+	require.Greater(t, tree.Utilization(), 0.8)
+	compacted, err := tree.FileSize()
+	require.NoError(t, err)
+	require.Less(t, compacted * 5, size)
+
+	mem, err := OpenMem[*freelistKey, *testVal](&Options{PageSize: 1024})
+	require.NoError(t, err)
+	defer mem.Close()
+	size, err = mem.FileSize()
+	require.NoError(t, err)
+	require.Equal(t, int64(2048), size)
+}
+
+func TestDeleteKeyReuse(t *testing.T) {
+	for _, tombstones := range []bool{false, true} {
+		tree := openTestTree[*freelistKey, *testVal](t, func(opts *Options) { opts.Tombstones = tombstones })
+		insertTestKeys(t, tree, testKeys(100, 0, 1)...)
+
+		key := &freelistKey{ptr: 50}
+		require.NoError(t, tree.Delete(key))
+		key.ptr = 1000
+		require.NoError(t, tree.Validate())
+
+		_, err := tree.Get(&freelistKey{ptr: 50})
+		require.ErrorIs(t, err, ErrNotFound)
+		for _, k := range []uint64{49, 51} {
+			e, err := tree.Get(&freelistKey{ptr: k})
+			require.NoError(t, err)
+			require.Equal(t, k, e.Key.ptr)
+		}
+
+		if tombstones {
+			keys := []uint64{}
+			require.NoError(t, tree.ScanTombstones(time.Time{}, func(key *freelistKey, deletedAt time.Time) (bool, error) {
+				keys = append(keys, key.ptr)
+				return false, nil
+			}))
+			require.Equal(t, []uint64{50}, keys)
+		}
+	}
+}
+
+func TestKeyComparerCompareBytes(t *testing.T) {
+	tree := openTestTree[*Uint64, *DummyVal](t, func(opts *Options) {
+		opts.KeyOnly = true
+		opts.CompareBytes = func(a, b []byte) int {
+			return bytes.Compare(b, a)
+		}
+	})
+	keys := []Uint64{5, 300, 1, 256, 70000, 42, 7}
+	for _, k := range keys {
+		key := k
+		require.NoError(t, tree.InsertMem(&Entry[*Uint64, *DummyVal]{Key: &key, Val: &DummyVal{}}))
+	}
+
+	for _, k := range keys {
+		e, err := tree.Get(&k)
+		require.NoError(t, err)
+		require.Equal(t, k, *e.Key)
+	}
+	missing := Uint64(257)
+	_, err := tree.Get(&missing)
+	require.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestPurgeTombstonesDuplicates(t *testing.T) {
+	tree := openTestTree[*freelistKey, *testVal](t, func(opts *Options) {
+		opts.AllowDuplicates = true
+		opts.Tombstones = true
+	})
+	insertTestKeys(t, tree, 4, 6)
+	for _, v := range []uint32{1, 2, 3} {
+		require.NoError(t, tree.Insert(&Entry[*freelistKey, *testVal]{Key: &freelistKey{ptr: 5}, Val: &testVal{v: v}}))
+	}
+	require.NoError(t, tree.Delete(&freelistKey{ptr: 5}))
+
+	purged, err := tree.PurgeTombstones(time.Now().Add(time.Second))
+	require.NoError(t, err)
+	require.Equal(t, 1, purged)
+	require.NoError(t, tree.Validate())
+
+	entries, err := tree.GetAll(&freelistKey{ptr: 5})
+	require.NoError(t, err)
+	vals := []uint32{}
+	for _, e := range entries {
+		vals = append(vals, e.Val.v)
+	}
+	require.Equal(t, []uint32{2, 3}, vals)
+	require.Equal(t, 4, tree.Count())
+	require.NoError(t, tree.ScanTombstones(time.Time{}, func(key *freelistKey, deletedAt time.Time) (bool, error) {
+		return true, fmt.Errorf("tombstone left, key:%v", key.ptr)
+	}))
+}
+
+func TestMergeFromConcurrent(t *testing.T) {
+	a := openTestTree[*freelistKey, *testVal](t)
+	b := openTestTree[*freelistKey, *testVal](t)
+	insertTestKeys(t, a, testKeys(5, 0, 2)...)
+	insertTestKeys(t, b, testKeys(5, 1, 2)...)
+
+	keepExisting := func(existing, incoming *Entry[*freelistKey, *testVal]) *Entry[*freelistKey, *testVal] {
+		return nil
+	}
+	done := make(chan error, 2)
+	for _, pair := range [][2]*RBTree[*freelistKey, *testVal]{{a, b}, {b, a}} {
+		go func(dst, src *RBTree[*freelistKey, *testVal]) {
+			for i := 0; i < 2000; i++ {
+				if _, err := dst.MergeFrom(src, keepExisting); err != nil {
+					done <- err
+					return
+				}
+			}
+			done <- nil
+		}(pair[0], pair[1])
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-done:
+			require.NoError(t, err)
+		case <-time.After(30 * time.Second):
+			t.Fatal("concurrent MergeFrom deadlocked")
+		}
+	}
+	require.Equal(t, 10, a.Count())
+	require.Equal(t, 10, b.Count())
+}
+
+func TestWALWriteFailure(t *testing.T) {
+	fileName := path.Join(t.TempDir(), "rbtree_test")
+	opts := &Options{PageSize: 1024, WAL: true}
+	tree, err := Open[*freelistKey, *testVal](fileName, opts)
+	require.NoError(t, err)
+	insertTestKeys(t, tree, testKeys(100, 0, 2)...)
+	generation := tree.meta.generation
+
+	for _, k := range testKeys(100, 1, 2) {
+		require.NoError(t, tree.InsertMem(&Entry[*freelistKey, *testVal]{Key: &freelistKey{ptr: k}, Val: &testVal{v: uint32(k)}}))
+	}
+	walFile := tree.wal.file
+	closed, err := os.Open(fileName + ".wal")
+	require.NoError(t, err)
+	require.NoError(t, closed.Close())
+	tree.wal.file = closed
+
+	// failed log write keeps pages and meta dirty
+	require.Error(t, tree.WriteAll())
+	require.True(t, tree.IsDirty())
+	require.True(t, tree.meta.dirty)
+	require.Equal(t, generation, tree.meta.generation)
+
+	tree.wal.file = walFile
+	require.NoError(t, tree.WriteAll())
+	require.False(t, tree.IsDirty())
+	require.Equal(t, generation + 1, tree.meta.generation)
+	require.NoError(t, tree.CloseNoFlush())
+
+	tree, err = Open[*freelistKey, *testVal](fileName, opts)
+	require.NoError(t, err)
+	defer tree.Close()
+	require.Equal(t, 200, tree.Count())
+	require.NoError(t, tree.Validate())
+}
+
+func BenchmarkInsertSequential(b *testing.B) {
+	tree, err := Open[*freelistKey, *testVal](
+		path.Join(b.TempDir(), "rbtree_bench"),
+		&Options{PageSize: uint16(os.Getpagesize())},
+	)
+	require.NoError(b, err)
+	defer tree.Close()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err := tree.InsertMem(&Entry[*freelistKey, *testVal]{Key: &freelistKey{ptr: uint64(i)}, Val: &testVal{}})
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkFlushOrder compares flushing all pages in id order with flushing them
+// in random order, as flushes did before dirty pages were sorted
+func BenchmarkFlushOrder(b *testing.B) {
+	tree, err := Open[*freelistKey, *testVal](path.Join(b.TempDir(), "rbtree_bench"), &Options{PageSize: 1024})
+	require.NoError(b, err)
+	defer tree.Close()
+	for i := 0; i < 100000; i++ {
+		require.NoError(b, tree.InsertMem(&Entry[*freelistKey, *testVal]{Key: &freelistKey{ptr: uint64(i)}, Val: &testVal{}}))
+	}
+	require.NoError(b, tree.WriteAll())
+
+	dirtyAll := func() {
+		for id := uint32(1); uint64(id) < tree.pager.Count(); id++ {
+			tree.fetchPage(id).markDirty()
+		}
+	}
+
+	b.Run("sorted", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			dirtyAll()
+			b.StartTimer()
+			if err := tree.writeAll(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("random", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			dirtyAll()
+			pages := tree.pages.dirtyPages()
+			rand.Shuffle(len(pages), func(i, j int) { pages[i], pages[j] = pages[j], pages[i] })
+			b.StartTimer()
+			for _, p := range pages {
+				if err := tree.pager.Marshal(uint64(p.id), p); err != nil {
+					b.Fatal(err)
+				}
+				p.clean()
+			}
+			if err := tree.writeAll(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// BenchmarkInsertBatch compares 100k inserts flushed once with flushing
+// after every Insert
+func BenchmarkInsertBatch(b *testing.B) {
+	n := 100000
+	entries := make([]*Entry[*freelistKey, *testVal], n)
+	for i := range entries {
+		entries[i] = &Entry[*freelistKey, *testVal]{Key: &freelistKey{ptr: uint64(i)}, Val: &testVal{}}
+	}
+
+	open := func(b *testing.B) *RBTree[*freelistKey, *testVal] {
+		tree, err := Open[*freelistKey, *testVal](
+			path.Join(b.TempDir(), "rbtree_bench"),
+			&Options{PageSize: uint16(os.Getpagesize())},
+		)
+		require.NoError(b, err)
+		return tree
+	}
+
+	b.Run("batch", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			tree := open(b)
+			b.StartTimer()
+			if _, err := tree.InsertBatch(entries); err != nil {
+				b.Fatal(err)
+			}
+			b.StopTimer()
+			tree.Close()
+		}
+	})
+
+	b.Run("single", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			tree := open(b)
+			b.StartTimer()
+			for _, e := range entries {
+				if err := tree.Insert(e); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.StopTimer()
+			tree.Close()
+		}
+	})
+}
+
+// BenchmarkBulkLoad compares building tree of 100k sorted entries at once
+// with inserting them one by one
+func BenchmarkBulkLoad(b *testing.B) {
+	n := 100000
+	entries := make([]*Entry[*freelistKey, *testVal], n)
+	for i := range entries {
+		entries[i] = &Entry[*freelistKey, *testVal]{Key: &freelistKey{ptr: uint64(i)}, Val: &testVal{}}
+	}
+
+	for _, bulk := range []bool{true, false} {
+		b.Run(fmt.Sprintf("bulk=%v", bulk), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				tree, err := Open[*freelistKey, *testVal](
+					path.Join(b.TempDir(), "rbtree_bench"),
+					&Options{PageSize: uint16(os.Getpagesize())},
+				)
+				require.NoError(b, err)
+				b.StartTimer()
+
+				if bulk {
+					err = tree.BulkLoad(entries)
+				} else {
+					_, err = tree.InsertBatch(entries)
+				}
+				if err != nil {
+					b.Fatal(err)
+				}
+				b.StopTimer()
+				tree.Close()
+			}
+		})
+	}
+}
+
+func BenchmarkParallelGet(b *testing.B) {
+	tree, err := Open[*freelistKey, *testVal](
+		path.Join(b.TempDir(), "rbtree_bench"),
+		&Options{PageSize: uint16(os.Getpagesize())},
+	)
+	require.NoError(b, err)
+	defer tree.Close()
+
+	n := 100000
+	insertTestKeys(b, tree, testKeys(n, 0, 1)...)
+	require.NoError(b, tree.WriteAll())
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		key := &freelistKey{}
+		for i := 0; pb.Next(); i++ {
+			key.ptr = uint64(i * 7919 % n)
+			if _, err := tree.Get(key); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// BenchmarkFlush measures WriteAll after a single change to a large tree,
+// only pages touched by the change are marshaled
+func BenchmarkFlush(b *testing.B) {
+	tree, err := Open[*freelistKey, *testVal](
+		path.Join(b.TempDir(), "rbtree_bench"),
+		&Options{PageSize: uint16(os.Getpagesize())},
+	)
+	require.NoError(b, err)
+	defer tree.Close()
+
+	n := 100000
+	insertTestKeys(b, tree, testKeys(n, 0, 2)...)
+	require.NoError(b, tree.WriteAll())
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		insertTestKeys(b, tree, uint64(i * 2 + 1))
+		if err := tree.WriteAll(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkGet(b *testing.B) {
+	tree, err := Open[*Uint64, *DummyVal](
+		path.Join(b.TempDir(), "rbtree_bench"),
+		&Options{PageSize: uint16(os.Getpagesize()), KeyOnly: true},
+	)
+	require.NoError(b, err)
+	defer tree.Close()
+
+	n := 100000
+	for i := 0; i < n; i++ {
+		key := Uint64(i)
+		require.NoError(b, tree.InsertMem(&Entry[*Uint64, *DummyVal]{Key: &key, Val: &DummyVal{}}))
+	}
+	require.NoError(b, tree.WriteAll())
+
+	key := new(Uint64)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		*key = Uint64(i * 7919 % n)
+		if _, err := tree.Get(key); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkGetMarshaled looks up keys compared in marshaled form, which
+// are cached on nodes instead of marshaled on every comparison
+func BenchmarkGetMarshaled(b *testing.B) {
+	tree, err := Open[*freelistKey, *testVal](
+		path.Join(b.TempDir(), "rbtree_bench"),
+		&Options{PageSize: uint16(os.Getpagesize())},
+	)
+	require.NoError(b, err)
+	defer tree.Close()
+
+	n := 1000000
+	insertTestKeys(b, tree, testKeys(n, 0, 1)...)
+	require.NoError(b, tree.WriteAll())
+
+	key := &freelistKey{}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		key.ptr = uint64(i * 7919 % n)
+		if _, err := tree.Get(key); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSmallScans(b *testing.B) {
+	tree, err := Open[*freelistKey, *testVal](
+		path.Join(b.TempDir(), "rbtree_bench"),
+		&Options{PageSize: uint16(os.Getpagesize())},
+	)
+	require.NoError(b, err)
+	defer tree.Close()
+
+	n := 100000
+	insertTestKeys(b, tree, testKeys(n, 0, 1)...)
+	require.NoError(b, tree.WriteAll())
+
+	scanFn := func(*freelistKey, *testVal) (bool, error) { return false, nil }
+	key := &freelistKey{}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		key.ptr = uint64(i * 7919 % n)
+		if err := tree.ScanWith(ScanOpts[*freelistKey]{Start: key, Limit: 10}, scanFn); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func openTestTree[K, V EntryItem](t *testing.T, configure ...func(opts *Options)) *RBTree[K, V] {
+	t.Helper()
+
+	opts := &Options{
+		PageSize: uint16(os.Getpagesize()),
+	}
+	for _, fn := range configure {
+		fn(opts)
+	}
+
+	tree, err := Open[K, V](path.Join(t.TempDir(), "rbtree_test"), opts)
+	require.NoError(t, err)
+	t.Cleanup(func() { tree.Close() })
+	return tree
+}
+
+// flipByte inverts byte at off in file
+func flipByte(t *testing.T, fileName string, off int64) {
+	f, err := os.OpenFile(fileName, os.O_RDWR, 0)
+	require.NoError(t, err)
+	defer f.Close()
+
+	b := make([]byte, 1)
+	_, err = f.ReadAt(b, off)
+	require.NoError(t, err)
+	b[0] ^= 0xff
+	_, err = f.WriteAt(b, off)
+	require.NoError(t, err)
+}
+
+// insertTestKeys inserts entries with given keys and values equal to keys
+func insertTestKeys(t require.TestingT, tree *RBTree[*freelistKey, *testVal], keys ...uint64) {
+	for _, k := range keys {
+		require.NoError(t, tree.InsertMem(&Entry[*freelistKey, *testVal]{
+			Key: &freelistKey{ptr: k},
+			Val: &testVal{v: uint32(k)},
+		}))
+	}
+}
+
+// testKeys returns n keys starting from start with given step
+func testKeys(n int, start, step uint64) []uint64 {
+	keys := make([]uint64, n)
+	for i := range keys {
+		keys[i] = start + uint64(i)*step
+	}
+	return keys
+}
 
 type freelistKey struct {
 	ptr  uint64
@@ -85,3 +3660,70 @@ func (k *freelistKey) UnmarshalBinary(d []byte) error {
 func (k *freelistKey) Format(f fmt.State, c rune) {
 	f.Write([]byte(fmt.Sprintf("{ptr:'%v', size:'%v'}", k.ptr, k.size)))
 }
+
+
+type testVal struct {
+	v uint32
+}
+
+func (v *testVal) New() EntryItem {
+	return &testVal{}
+}
+
+func (v *testVal) Copy() EntryItem {
+	cp := *v
+	return &cp
+}
+
+func (v *testVal) Size() int {
+	return 4
+}
+
+func (v *testVal) IsNil() bool {
+	return v == nil
+}
+
+func (v *testVal) MarshalBinary() ([]byte, error) {
+	buf := make([]byte, v.Size())
+	bin.PutUint32(buf, v.v)
+	return buf, nil
+}
+
+func (v *testVal) UnmarshalBinary(d []byte) error {
+	v.v = bin.Uint32(d)
+	return nil
+}
+
+// signedKey is marshaled as two's complement, so negative keys sort after
+// positive ones byte-wise
+type signedKey struct {
+	v int64
+}
+
+func (k *signedKey) New() EntryItem {
+	return &signedKey{}
+}
+
+func (k *signedKey) Copy() EntryItem {
+	cp := *k
+	return &cp
+}
+
+func (k *signedKey) Size() int {
+	return 8
+}
+
+func (k *signedKey) IsNil() bool {
+	return k == nil
+}
+
+func (k *signedKey) MarshalBinary() ([]byte, error) {
+	buf := make([]byte, 8)
+	bin.PutUint64(buf, uint64(k.v))
+	return buf, nil
+}
+
+func (k *signedKey) UnmarshalBinary(d []byte) error {
+	k.v = int64(bin.Uint64(d))
+	return nil
+}
@@ -0,0 +1,104 @@
+package rbtree
+
+import (
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// Repair copies every entry reachable from root into a new tree at
+// destFileName and returns number of copied entries. It is meant for trees
+// failing Validate: cycles are cut, unreadable nodes and pointers out of
+// file bounds are skipped, duplicate keys are copied once. Destination tree
+// must be empty, it is created with page size and key ordering of tree.
+func (tree *RBTree[K, V]) Repair(destFileName string) (recovered int, err error) {
+	tree.mu.RLock()
+	defer tree.runlockErr(&err)
+
+	entries := tree.salvage()
+	sort.Slice(entries, func(i, j int) bool {
+		return tree.compareOrder(entries[i].order, entries[j].order) < 0
+	})
+
+	destOpts := &Options{
+		PageSize:     tree.meta.pageSize,
+		CompareBytes: tree.compare,
+		Tombstones:   tree.tombstones,
+		KeyOnly:      tree.meta.nodeValSize == 0,
+	}
+	if tree.compareKeys != nil {
+		destOpts.Compare = tree.compareKeys
+	}
+	dest, err := Open[K, V](destFileName, destOpts)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to open destination tree")
+	}
+	defer func() {
+		if closeErr := dest.Close(); closeErr != nil && err == nil {
+			err = errors.Wrap(closeErr, "failed to close destination tree")
+		}
+	}()
+
+	if dest.Count() != 0 {
+		return 0, errors.Wrapf(ErrNotEmpty, "destination count:'%v'", dest.Count())
+	}
+
+	for _, e := range entries {
+		if err := dest.InsertMem(e.entry); err != nil {
+			return recovered, errors.Wrap(err, "failed to insert recovered entry")
+		}
+		recovered++
+	}
+	return recovered, nil
+}
+
+type salvagedEntry[K, V EntryItem] struct {
+	order orderKey[K]
+	entry *Entry[K, V]
+}
+
+// salvage walks tree from root collecting live entries with distinct keys,
+// depth is bounded by the number of allocated slots
+func (tree *RBTree[K, V]) salvage() []salvagedEntry[K, V] {
+	type frame struct {
+		ptr   uint32
+		depth int
+	}
+
+	maxDepth := int(tree.pager.Count()) * int(tree.degree)
+	visited := map[uint32]bool{tree.meta.nullPtr: true}
+	seen := map[string]bool{}
+	entries := []salvagedEntry[K, V]{}
+
+	stack := []frame{{tree.meta.rootPtr, 0}}
+	for len(stack) > 0 {
+		f := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if visited[f.ptr] || f.depth > maxDepth || !tree.validPtr(f.ptr) {
+			continue
+		}
+		visited[f.ptr] = true
+
+		n, err := tree.safeFetch(f.ptr)
+		if err != nil {
+			continue
+		}
+		stack = append(stack, frame{n.left, f.depth + 1}, frame{n.right, f.depth + 1})
+
+		if n.isTombstone() || n.entry == nil {
+			continue
+		}
+		key, err := n.entry.Key.MarshalBinary()
+		if err != nil || seen[string(key)] {
+			continue
+		}
+		e := n.entry.Copy()
+		order, err := tree.prepare(e.Key)
+		if err != nil {
+			continue
+		}
+		seen[string(key)] = true
+		entries = append(entries, salvagedEntry[K, V]{order, e})
+	}
+	return entries
+}
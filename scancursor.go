@@ -0,0 +1,124 @@
+package rbtree
+
+import (
+	"github.com/pkg/errors"
+)
+
+// ScanCursor returns at most limit entries in ascending order following the
+// key encoded in token, starting from the smallest entry when token is
+// empty. Returned token continues the scan, it is nil when there are no
+// more entries. Entries are copies and stay valid after the call.
+func (tree *RBTree[K, V]) ScanCursor(token []byte, limit int) ([]*Entry[K, V], []byte, error) {
+	return tree.scanCursor(token, limit, false)
+}
+
+// ScanCursorReverse is ScanCursor in descending order, starting from the
+// greatest entry when token is empty
+func (tree *RBTree[K, V]) ScanCursorReverse(token []byte, limit int) ([]*Entry[K, V], []byte, error) {
+	return tree.scanCursor(token, limit, true)
+}
+
+// Nearest returns up to k entries around key in ascending order, taking
+// entries alternately from both sides of key starting with key itself or
+// its ceiling. Keys have no distance, so sides are balanced by count.
+func (tree *RBTree[K, V]) Nearest(key K, k int) (entries []*Entry[K, V], err error) {
+	if kSize := key.Size(); kSize != int(tree.meta.nodeKeySize) {
+		return nil, errors.Wrapf(
+			ErrInvalidKeySize, "key size missmatch, required:'%v', got:'%v'",
+			tree.meta.nodeKeySize, kSize,
+		)
+	}
+
+	tree.mu.RLock()
+	defer tree.runlockErr(&err)
+
+	up, down := tree.newCursor(), tree.newCursor()
+	defer up.release()
+	defer down.release()
+
+	upOk, err := up.seek(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to find ceiling")
+	}
+	downOk, err := down.seekFloor(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to find floor")
+	}
+	if upOk && downOk && up.ptr() == down.ptr() {
+		downOk = down.prev()
+	}
+
+	// skip moves cursor over tombstones
+	skip := func(c *cursor[K, V], ok, reverse bool) bool {
+		for ok && c.node().isTombstone() {
+			ok = c.step(reverse)
+		}
+		return ok
+	}
+
+	above, below := []*Entry[K, V]{}, []*Entry[K, V]{}
+	for len(above) + len(below) < k {
+		upOk, downOk = skip(up, upOk, false), skip(down, downOk, true)
+		if !upOk && !downOk {
+			break
+		}
+
+		if upOk && (len(above) <= len(below) || !downOk) {
+			above = append(above, up.node().entry.Copy())
+			upOk = up.next()
+		} else {
+			below = append(below, down.node().entry.Copy())
+			downOk = down.prev()
+		}
+	}
+
+	entries = make([]*Entry[K, V], 0, len(above) + len(below))
+	for i := len(below) - 1; i >= 0; i-- {
+		entries = append(entries, below[i])
+	}
+	return append(entries, above...), nil
+}
+
+func (tree *RBTree[K, V]) scanCursor(token []byte, limit int, reverse bool) (entries []*Entry[K, V], next []byte, err error) {
+	if limit <= 0 {
+		return nil, nil, errors.Errorf("invalid limit:'%v'", limit)
+	}
+
+	tree.mu.RLock()
+	defer tree.runlockErr(&err)
+
+	// token key itself was returned by the previous call
+	opts := ScanOpts[K]{Reverse: reverse, Exclusive: true, Limit: limit + 1}
+	if len(token) != 0 {
+		if len(token) != int(tree.meta.nodeKeySize) {
+			return nil, nil, errors.Wrapf(ErrInvalidKeySize, "token size:'%v'", len(token))
+		}
+
+		var k K
+		opts.Start = k.New().(K)
+		if err := opts.Start.UnmarshalBinary(token); err != nil {
+			return nil, nil, errors.Wrap(err, "failed to unmarshal token")
+		}
+	}
+
+	entries = []*Entry[K, V]{}
+	_, err = tree.scan(opts, 0, nil, func(e *Entry[K, V]) (bool, error) {
+		entries = append(entries, e.Copy())
+		return false, nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// one extra entry tells whether there is a next page
+	if len(entries) <= limit {
+		return entries, nil, nil
+	}
+
+	entries = entries[:limit]
+	next, err = entries[limit-1].Key.MarshalBinary()
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to marshal token key")
+	}
+	return entries, next, nil
+}
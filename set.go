@@ -0,0 +1,187 @@
+package rbtree
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+)
+
+// OpenSet opens ordered set of keys stored in tree without values
+func OpenSet[K EntryItem](fileName string, opts *Options) (*Set[K], error) {
+	setOpts := *opts
+	setOpts.KeyOnly = true
+	tree, err := Open[K, *DummyVal](fileName, &setOpts)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open set")
+	}
+	return &Set[K]{tree}, nil
+}
+
+type Set[K EntryItem] struct {
+	tree *RBTree[K, *DummyVal]
+}
+
+// Tree returns underlying tree
+func (s *Set[K]) Tree() *RBTree[K, *DummyVal] {
+	return s.tree
+}
+
+// Add inserts key, adding existing key is no-op
+func (s *Set[K]) Add(key K) error {
+	err := s.tree.Insert(&Entry[K, *DummyVal]{Key: key, Val: &DummyVal{}})
+	if err == ErrKeyAlreadyExists {
+		return nil
+	}
+	return err
+}
+
+// Remove deletes key, removing missing key is no-op
+func (s *Set[K]) Remove(key K) error {
+	err := s.tree.Delete(key)
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	return err
+}
+
+func (s *Set[K]) Contains(key K) (bool, error) {
+	_, err := s.tree.Get(key)
+	if err == ErrNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *Set[K]) Count() int {
+	return s.tree.Count()
+}
+
+// Union adds all keys of other to s
+func (s *Set[K]) Union(other *Set[K]) error {
+	if other == s {
+		return nil
+	}
+
+	add, err := s.collect(other, func(inOwn, inOther bool) bool { return !inOwn })
+	if err != nil {
+		return errors.Wrap(err, "failed to merge sets")
+	}
+	return s.apply(add, nil)
+}
+
+// Intersect removes keys of s which are not in other
+func (s *Set[K]) Intersect(other *Set[K]) error {
+	if other == s {
+		return nil
+	}
+
+	remove, err := s.collect(other, func(inOwn, inOther bool) bool { return !inOther })
+	if err != nil {
+		return errors.Wrap(err, "failed to merge sets")
+	}
+	return s.apply(nil, remove)
+}
+
+// Difference removes keys of s which are in other
+func (s *Set[K]) Difference(other *Set[K]) error {
+	var remove []K
+	var err error
+	if other == s {
+		remove, err = s.collect(nil, func(inOwn, inOther bool) bool { return true })
+	} else {
+		remove, err = s.collect(other, func(inOwn, inOther bool) bool { return inOwn && inOther })
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to merge sets")
+	}
+	return s.apply(nil, remove)
+}
+
+func (s *Set[K]) Close() error {
+	return s.tree.Close()
+}
+
+// collect co-iterates s and other in key order and returns copies of keys
+// for which want returns true. Nil other is iterated as empty set.
+func (s *Set[K]) collect(other *Set[K], want func(inOwn, inOther bool) bool) ([]K, error) {
+	ctx := context.Background()
+	var nilKey K
+
+	own := s.tree.IteratorContext(ctx, nilKey)
+	defer own.Close()
+
+	var theirs *Iterator[K, *DummyVal]
+	if other != nil {
+		theirs = other.tree.IteratorContext(ctx, nilKey)
+		defer theirs.Close()
+	}
+
+	next := func(it *Iterator[K, *DummyVal]) (*orderKey[K], error) {
+		if it == nil || !it.Next() {
+			if it != nil && it.Err() != nil {
+				return nil, it.Err()
+			}
+			return nil, nil
+		}
+		k, err := s.tree.prepare(it.Entry().Key)
+		return &k, err
+	}
+
+	a, err := next(own)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to iterate set")
+	}
+	b, err := next(theirs)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to iterate other set")
+	}
+
+	keys := []K{}
+	for a != nil || b != nil {
+		cmp := 0
+		if a == nil {
+			cmp = 1
+		} else if b == nil {
+			cmp = -1
+		} else {
+			cmp = s.tree.compareOrder(*a, *b)
+		}
+
+		if want(cmp <= 0, cmp >= 0) {
+			if cmp <= 0 {
+				keys = append(keys, own.Entry().Key.Copy().(K))
+			} else {
+				keys = append(keys, theirs.Entry().Key.Copy().(K))
+			}
+		}
+
+		if cmp <= 0 {
+			if a, err = next(own); err != nil {
+				return nil, errors.Wrap(err, "failed to iterate set")
+			}
+		}
+		if cmp >= 0 {
+			if b, err = next(theirs); err != nil {
+				return nil, errors.Wrap(err, "failed to iterate other set")
+			}
+		}
+	}
+
+	return keys, nil
+}
+
+func (s *Set[K]) apply(add, remove []K) error {
+	for _, k := range add {
+		if err := s.tree.InsertMem(&Entry[K, *DummyVal]{Key: k, Val: &DummyVal{}}); err != nil {
+			return errors.Wrap(err, "failed to add key")
+		}
+	}
+
+	for _, k := range remove {
+		if err := s.tree.DeleteMem(k); err != nil {
+			return errors.Wrap(err, "failed to remove key")
+		}
+	}
+
+	return errors.Wrap(s.tree.WriteAll(), "failed to write all")
+}
@@ -0,0 +1,265 @@
+package rbtree
+
+import (
+	"encoding"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Snapshot is immutable view of tree as of Snapshot call. Reading it does
+// not take tree lock, so writers are not blocked. Release must be called
+// once snapshot is not needed, closing tree releases its snapshots.
+type Snapshot[K, V EntryItem] struct {
+	view  *RBTree[K, V] // read-only tree over snapshot pages
+	store *snapshotStore
+	owner *RBTree[K, V]
+}
+
+// Snapshot writes pending changes and returns view of tree as of now. Pages
+// overwritten or truncated later are copied to snapshot first, so it keeps
+// seeing file as it was. Snapshots of in-memory trees copy all pages.
+func (tree *RBTree[K, V]) Snapshot() (s *Snapshot[K, V], err error) {
+	tree.mu.Lock()
+	defer tree.unlock(&err)
+
+	if err := tree.writeAll(); err != nil {
+		return nil, errors.Wrap(err, "failed to write all")
+	}
+
+	store := &snapshotStore{
+		pageSize: tree.pager.PageSize(),
+		count:    tree.pager.Count(),
+		saved:    map[uint64][]byte{},
+	}
+	meta, err := tree.meta.MarshalBinary()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to marshal meta")
+	}
+	store.saved[0] = append(meta, make([]byte, store.pageSize - len(meta))...)
+
+	if _, ok := tree.pager.(memPager); ok {
+		for id := uint64(1); id < store.count; id++ {
+			d := make([]byte, store.pageSize)
+			if err := tree.pager.ReadAt(d, id * uint64(store.pageSize)); err != nil {
+				return nil, errors.Wrapf(err, "failed to read page:'%v'", id)
+			}
+			store.saved[id] = d
+		}
+	} else if store.file, err = os.Open(tree.file); err != nil {
+		return nil, errors.Wrap(err, "failed to open tree file")
+	}
+
+	tree.snapMu.Lock()
+	if tree.snapshots == nil {
+		tree.snapshots = map[*snapshotStore]struct{}{}
+	}
+	tree.snapshots[store] = struct{}{}
+	tree.snapMu.Unlock()
+
+	m := *tree.meta
+	m.dirty = false
+	return &Snapshot[K, V]{
+		view: &RBTree[K, V]{
+			file:        tree.file,
+			mu:          &sync.RWMutex{},
+			pager:       store,
+			pages:       newPageCache[K, V](0, tree.opts.MaxCachedPages),
+			meta:        &m,
+			degree:      tree.degree,
+			nodeSize:    tree.nodeSize,
+			compare:     tree.compare,
+			compareKeys: tree.compareKeys,
+			verifySums:  tree.verifySums,
+			tombstones:  tree.tombstones,
+			allowDups:   tree.allowDups,
+			readOnly:    true,
+			opts:        tree.opts,
+		},
+		store: store,
+		owner: tree,
+	}, nil
+}
+
+// Get returns entry with given key, see RBTree.Get
+func (s *Snapshot[K, V]) Get(key K) (*Entry[K, V], error) {
+	if s.store.isReleased() {
+		return nil, ErrSnapshotReleased
+	}
+	return s.view.Get(key)
+}
+
+// Scan iterates entries starting from key, see RBTree.Scan
+func (s *Snapshot[K, V]) Scan(key K, scanFn func(key K, val V) (bool, error)) error {
+	if s.store.isReleased() {
+		return ErrSnapshotReleased
+	}
+	return s.view.Scan(key, scanFn)
+}
+
+// Count returns number of entries in snapshot
+func (s *Snapshot[K, V]) Count() int {
+	return s.view.Count()
+}
+
+// Release frees pages copied for snapshot and stops tree from copying more.
+// Releasing snapshot twice is no-op.
+func (s *Snapshot[K, V]) Release() {
+	s.owner.snapMu.Lock()
+	delete(s.owner.snapshots, s.store)
+	s.owner.snapMu.Unlock()
+	s.store.release()
+}
+
+// preserve copies current content of pages to live snapshots, it is called
+// before pages are overwritten or truncated
+func (tree *RBTree[K, V]) preserve(ids ...uint64) {
+	tree.snapMu.Lock()
+	defer tree.snapMu.Unlock()
+
+	for s := range tree.snapshots {
+		s.save(ids)
+	}
+}
+
+// releaseSnapshots releases all snapshots, file they read may be changed
+// once tree is closed
+func (tree *RBTree[K, V]) releaseSnapshots() {
+	tree.snapMu.Lock()
+	defer tree.snapMu.Unlock()
+
+	for s := range tree.snapshots {
+		s.release()
+	}
+	tree.snapshots = nil
+}
+
+// snapshotStore is pageStore of snapshot. Pages copied before tree changed
+// them are read from memory, the rest from tree file.
+type snapshotStore struct {
+	mu       sync.RWMutex
+	file     *os.File          // tree file, nil for in-memory trees
+	pageSize int
+	count    uint64            // pages in file when snapshot was taken
+	saved    map[uint64][]byte // pages as of snapshot
+	err      error             // copying some page failed, snapshot is broken
+	released bool
+}
+
+// save copies pages from file unless they are already copied or did not
+// exist when snapshot was taken
+func (s *snapshotStore) save(ids []uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, id := range ids {
+		if _, ok := s.saved[id]; ok || s.released || s.err != nil || id >= s.count {
+			continue
+		}
+
+		d := make([]byte, s.pageSize)
+		if _, err := s.file.ReadAt(d, int64(id) * int64(s.pageSize)); err != nil {
+			s.err = errors.Wrapf(err, "failed to copy page:'%v'", id)
+			return
+		}
+		s.saved[id] = d
+	}
+}
+
+func (s *snapshotStore) read(id uint64) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.released {
+		return nil, ErrSnapshotReleased
+	} else if s.err != nil {
+		return nil, s.err
+	} else if id >= s.count {
+		return nil, errors.Wrapf(ErrInvalidPointer, "page:'%v'", id)
+	} else if d, ok := s.saved[id]; ok {
+		return d, nil
+	}
+
+	d := make([]byte, s.pageSize)
+	_, err := s.file.ReadAt(d, int64(id) * int64(s.pageSize))
+	return d, errors.Wrapf(err, "failed to read page:'%v'", id)
+}
+
+func (s *snapshotStore) isReleased() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.released
+}
+
+func (s *snapshotStore) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.released {
+		return
+	}
+	s.released = true
+	s.saved = nil
+	if s.file != nil {
+		_ = s.file.Close()
+	}
+}
+
+func (s *snapshotStore) ReadAt(dst []byte, offset uint64) error {
+	for len(dst) > 0 {
+		d, err := s.read(offset / uint64(s.pageSize))
+		if err != nil {
+			return err
+		}
+		n := copy(dst, d[offset % uint64(s.pageSize):])
+		dst, offset = dst[n:], offset + uint64(n)
+	}
+	return nil
+}
+
+func (s *snapshotStore) Unmarshal(id uint64, into encoding.BinaryUnmarshaler) error {
+	d, err := s.read(id)
+	if err != nil {
+		return err
+	}
+	return into.UnmarshalBinary(d)
+}
+
+func (s *snapshotStore) Alloc(n int) (uint64, error) {
+	return 0, ErrReadOnly
+}
+
+func (s *snapshotStore) Free(n int) error {
+	return ErrReadOnly
+}
+
+func (s *snapshotStore) Write(id uint64, d []byte) error {
+	return ErrReadOnly
+}
+
+func (s *snapshotStore) Marshal(id uint64, v encoding.BinaryMarshaler) error {
+	return ErrReadOnly
+}
+
+func (s *snapshotStore) PageSize() int {
+	return s.pageSize
+}
+
+func (s *snapshotStore) Count() uint64 {
+	return s.count
+}
+
+func (s *snapshotStore) ReadOnly() bool {
+	return true
+}
+
+func (s *snapshotStore) Remove() {
+	s.release()
+}
+
+func (s *snapshotStore) Close() error {
+	s.release()
+	return nil
+}
@@ -0,0 +1,81 @@
+package rbtree
+
+import (
+	"os"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// TreeStats are counters since tree was opened and its current shape
+type TreeStats struct {
+	CacheHits      uint64
+	CacheMisses    uint64
+	CacheEvictions uint64
+	CachedPages    int
+	PageReads      uint64 // pages unmarshaled from file, meta included
+	PageWrites     uint64 // pages marshaled to file, meta included
+	NodeAllocs     uint64
+	NodeFrees      uint64
+	Count          int    // live entries, tombstones excluded
+	Height         int    // upper bound of root to leaf path length
+}
+
+// ioStats are IO counters of TreeStats, updated under read lock as well
+type ioStats struct {
+	pageReads  atomic.Uint64
+	pageWrites atomic.Uint64
+	nodeAllocs atomic.Uint64
+	nodeFrees  atomic.Uint64
+}
+
+// Stats returns cache and IO counters and tree shape
+func (tree *RBTree[K, V]) Stats() TreeStats {
+	tree.mu.RLock()
+	defer tree.mu.RUnlock()
+
+	cache := tree.pages.stats()
+	return TreeStats{
+		CacheHits:      cache.Hits,
+		CacheMisses:    cache.Misses,
+		CacheEvictions: cache.Evictions,
+		CachedPages:    cache.Pages,
+		PageReads:      tree.io.pageReads.Load(),
+		PageWrites:     tree.io.pageWrites.Load(),
+		NodeAllocs:     tree.io.nodeAllocs.Load(),
+		NodeFrees:      tree.io.nodeFrees.Load(),
+		Count:          int(tree.meta.count - tree.meta.tombstones),
+		Height:         tree.height(),
+	}
+}
+
+// FileSize returns size of tree file in bytes, for in-memory trees size of
+// their pages
+func (tree *RBTree[K, V]) FileSize() (int64, error) {
+	tree.mu.RLock()
+	defer tree.mu.RUnlock()
+
+	if _, ok := tree.pager.(memPager); ok {
+		return int64(tree.pager.Count()) * int64(tree.pager.PageSize()), nil
+	}
+	info, err := os.Stat(tree.file)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to stat tree file")
+	}
+	return info.Size(), nil
+}
+
+// Utilization returns share of allocated pages taken by live nodes, from 0
+// to 1. Low value means deletes left much free space and Compact would
+// shrink the file.
+func (tree *RBTree[K, V]) Utilization() float64 {
+	tree.mu.RLock()
+	defer tree.mu.RUnlock()
+
+	total := tree.pager.Count() * uint64(tree.pager.PageSize())
+	if total == 0 {
+		return 0
+	}
+	live := uint64(tree.meta.count - tree.meta.tombstones) * uint64(tree.nodeSize)
+	return float64(live) / float64(total)
+}
@@ -0,0 +1,74 @@
+package rbtree
+
+import (
+	"encoding"
+	"os"
+
+	"github.com/vahagz/pager"
+)
+
+// pageStore keeps tree pages, it is implemented by pager.Pager
+type pageStore interface {
+	Alloc(n int) (uint64, error)
+	Free(n int) error
+	ReadAt(dst []byte, offset uint64) error
+	Write(id uint64, d []byte) error
+	Marshal(id uint64, v encoding.BinaryMarshaler) error
+	Unmarshal(id uint64, into encoding.BinaryUnmarshaler) error
+	PageSize() int
+	Count() uint64
+	ReadOnly() bool
+	Remove()
+	Close() error
+}
+
+// memPager is in-memory pager, Remove only drops its data
+type memPager struct {
+	*pager.Pager
+}
+
+func (p memPager) Remove() {
+	_ = p.Close()
+}
+
+// readOnlyPager is pager of tree opened with Options.ReadOnly, it refuses
+// every write
+type readOnlyPager struct {
+	*pager.Pager
+}
+
+func (p readOnlyPager) Alloc(n int) (uint64, error) {
+	return 0, ErrReadOnly
+}
+
+func (p readOnlyPager) Free(n int) error {
+	return ErrReadOnly
+}
+
+func (p readOnlyPager) Write(id uint64, d []byte) error {
+	return ErrReadOnly
+}
+
+func (p readOnlyPager) Marshal(id uint64, v encoding.BinaryMarshaler) error {
+	return ErrReadOnly
+}
+
+func (p readOnlyPager) ReadOnly() bool {
+	return true
+}
+
+func (p readOnlyPager) Remove() {
+	_ = p.Close()
+}
+
+// movedPager is pager whose file was renamed after it was opened, Remove
+// deletes file under its new name
+type movedPager struct {
+	*pager.Pager
+	file string
+}
+
+func (p movedPager) Remove() {
+	_ = p.Close()
+	_ = os.Remove(p.file)
+}
@@ -0,0 +1,118 @@
+package rbtree
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ScanTombstones calls scanFn in ascending key order for entries deleted at
+// or after since. Values of tombstones are the ones they had when deleted.
+func (tree *RBTree[K, V]) ScanTombstones(
+	since time.Time,
+	scanFn func(key K, deletedAt time.Time) (bool, error),
+) (err error) {
+	tree.mu.RLock()
+	defer tree.runlockErr(&err)
+
+	if tree.meta.tombstones == 0 {
+		return nil
+	}
+
+	c := tree.newCursor()
+	defer c.release()
+	for ok := c.first(); ok; ok = c.next() {
+		n := c.node()
+		if !n.isTombstone() || n.deletedAt < since.UnixNano() {
+			continue
+		}
+
+		if stop, err := scanFn(n.entry.Key, time.Unix(0, n.deletedAt)); stop || err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PurgeTombstones removes tombstones deleted before given time from tree and
+// returns number of removed tombstones
+func (tree *RBTree[K, V]) PurgeTombstones(before time.Time) (purged int, err error) {
+	if tree.onOp != nil {
+		defer tree.observe(OpDelete, time.Now(), &err)
+	}
+
+	tree.mu.Lock()
+	defer tree.unlock(&err)
+
+	if tree.readOnly {
+		return 0, ErrReadOnly
+	}
+
+	if tree.meta.tombstones == 0 {
+		return 0, nil
+	}
+
+	// nodes are relocated by delete, so collect keys first
+	keys := []K{}
+	c := tree.newCursor()
+	defer c.release()
+	for ok := c.first(); ok; ok = c.next() {
+		if n := c.node(); n.isTombstone() && n.deletedAt < before.UnixNano() {
+			keys = append(keys, n.entry.Key.Copy().(K))
+		}
+	}
+
+	for i, key := range keys {
+		ptr, err := tree.findTombstone(key, before.UnixNano())
+		if err != nil {
+			return i, errors.Wrap(err, "failed to find tombstone")
+		}
+
+		if err := tree.delete(ptr); err != nil {
+			return i, errors.Wrap(err, "failed to delete tombstone")
+		}
+		tree.meta.tombstones--
+	}
+
+	return len(keys), tree.persist()
+}
+
+// findTombstone returns tombstone with given key deleted before given unix
+// nanos. With Options.AllowDuplicates live entries may share its key, so
+// all equal nodes are checked.
+func (tree *RBTree[K, V]) findTombstone(key K, before int64) (uint32, error) {
+	searchingKey, err := tree.prepare(key)
+	if err != nil {
+		return 0, err
+	}
+
+	c := tree.newCursor()
+	defer c.release()
+	ok, err := c.seek(key)
+	for ; ok && err == nil; ok = c.next() {
+		k, err := tree.nodeKey(c.node())
+		if err != nil {
+			return 0, errors.Wrap(err, "failed to prepare entry key")
+		} else if tree.compareOrder(k, searchingKey) != 0 {
+			break
+		}
+		if n := c.node(); n.isTombstone() && n.deletedAt < before {
+			return c.ptr(), nil
+		}
+	}
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to seek key")
+	}
+	return 0, ErrNotFound
+}
+
+// revive replaces tombstone at ptr with entry e
+func (tree *RBTree[K, V]) revive(ptr uint32, e *Entry[K, V]) {
+	n := tree.fetch(ptr)
+	n.clearTombstone()
+	n.setEntry(e.Copy())
+	tree.resizeUp(ptr)
+	tree.meta.dirty = true
+	tree.meta.tombstones--
+	tree.meta.seq++
+}
@@ -0,0 +1,286 @@
+package rbtree
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/pkg/errors"
+)
+
+// maximum number of violations collected by ValidateReport
+const maxViolations = 1024
+
+type Violation struct {
+	Ptr       uint32 // raw pointer of offending node
+	Key       []byte // marshaled key of offending node, nil if unreadable
+	Invariant string // description of broken invariant
+}
+
+func (v Violation) String() string {
+	return fmt.Sprintf("node %d (key %x): %s", v.Ptr, v.Key, v.Invariant)
+}
+
+type ValidationReport struct {
+	Violations []Violation
+	Truncated  bool // true if more violations were found than reported
+}
+
+// Err returns first violation as error or nil if tree is valid
+func (r *ValidationReport) Err() error {
+	if len(r.Violations) == 0 {
+		return nil
+	}
+	return errors.Wrap(ErrCorrupted, r.Violations[0].String())
+}
+
+// Validate checks red-black and binary search tree invariants and returns
+// the first violation found.
+func (tree *RBTree[K, V]) Validate() (err error) {
+	tree.mu.RLock()
+	defer tree.runlockErr(&err)
+
+	return tree.validate(1).Err()
+}
+
+// ValidateReport checks the whole tree and collects every violation found,
+// up to a fixed maximum.
+func (tree *RBTree[K, V]) ValidateReport() (report *ValidationReport, err error) {
+	tree.mu.RLock()
+	defer tree.runlockErr(&err)
+
+	return tree.validate(maxViolations), nil
+}
+
+func (tree *RBTree[K, V]) validate(limit int) *ValidationReport {
+	v := &validator[K, V]{
+		tree:      tree,
+		report:    &ValidationReport{},
+		limit:     limit,
+		visited:   map[uint32]struct{}{},
+		maxHeight: 2*int(math.Ceil(math.Log2(float64(tree.meta.count)+1))) + 1,
+	}
+	v.run()
+	return v.report
+}
+
+type validator[K, V EntryItem] struct {
+	tree      *RBTree[K, V]
+	report    *ValidationReport
+	limit     int
+	visited   map[uint32]struct{}
+	maxHeight int
+	partial   bool // some subtree was not visited
+}
+
+func (v *validator[K, V]) run() {
+	tree := v.tree
+	null := tree.meta.nullPtr
+	if !v.check(tree.validPtr(null), null, nil, "null pointer is out of file bounds") {
+		return
+	}
+
+	nullNode, err := tree.safeFetch(null)
+	if !v.check(err == nil, null, nil, "unreadable null node: %v", err) {
+		return
+	}
+	v.check(nullNode.isBlack(), null, nil, "null node is not black")
+
+	root := tree.meta.rootPtr
+	if root == null {
+		v.check(tree.meta.count == 0, root, nil, "empty tree with count %d", tree.meta.count)
+		return
+	}
+
+	if !v.check(tree.validPtr(root), root, nil, "root pointer is out of file bounds") {
+		return
+	}
+
+	rootNode, err := tree.safeFetch(root)
+	if !v.check(err == nil, root, nil, "unreadable root node: %v", err) {
+		return
+	}
+
+	key := v.key(rootNode)
+	v.check(rootNode.isBlack(), root, key, "root is not black")
+	v.check(rootNode.parent == null, root, key, "root has parent %d", rootNode.parent)
+
+	v.walk(root, nil, nil, 1)
+	if !v.partial {
+		v.check(
+			len(v.visited) == int(tree.meta.count), root, nil,
+			"reachable nodes %d, count %d", len(v.visited), tree.meta.count,
+		)
+	}
+}
+
+// walk validates subtree rooted at ptr with keys in (lo, hi) bounds and
+// returns its black height, or -1 if it is not known because of violation
+// in subtree. Violation in one subtree does not stop checking its siblings,
+// only cycles, unreadable nodes and violations limit cut walk off.
+func (v *validator[K, V]) walk(ptr uint32, lo, hi *orderKey[K], depth int) int {
+	tree := v.tree
+	if ptr == tree.meta.nullPtr {
+		return 1
+	}
+	if v.full() {
+		v.partial = true
+		return -1
+	}
+
+	if _, ok := v.visited[ptr]; ok {
+		v.add(ptr, nil, "node is reachable more than once")
+		v.partial = true
+		return -1
+	}
+	v.visited[ptr] = struct{}{}
+
+	n, err := tree.safeFetch(ptr)
+	if !v.check(err == nil, ptr, nil, "unreadable node: %v", err) {
+		v.partial = true
+		return -1
+	}
+
+	key := v.key(n)
+	if key == nil {
+		v.partial = true
+		return -1
+	}
+
+	if !v.check(depth <= v.maxHeight, ptr, key, "depth %d exceeds red-black bound %d", depth, v.maxHeight) {
+		v.partial = true
+		return -1
+	}
+
+	order, err := tree.nodeKey(n)
+	if !v.check(err == nil, ptr, key, "failed to prepare key: %v", err) {
+		v.partial = true
+		return -1
+	}
+	// equal keys are allowed on both sides of each other with duplicates
+	limit := 0
+	if tree.allowDups {
+		limit = 1
+	}
+	if lo != nil && tree.compareOrder(*lo, order) >= limit {
+		v.add(ptr, key, fmt.Sprintf("key is not greater than left bound %v", lo.key))
+	}
+	if hi != nil && tree.compareOrder(order, *hi) >= limit {
+		v.add(ptr, key, fmt.Sprintf("key is not less than right bound %v", hi.key))
+	}
+
+	blackHeight := [2]int{}
+	for i, child := range [2]uint32{n.left, n.right} {
+		if child == tree.meta.nullPtr {
+			blackHeight[i] = 1
+			continue
+		}
+
+		if !v.check(tree.validPtr(child), ptr, key, "child pointer %d is out of file bounds", child) {
+			v.partial = true
+			blackHeight[i] = -1
+			continue
+		}
+
+		c, err := tree.safeFetch(child)
+		if !v.check(err == nil, child, nil, "unreadable node: %v", err) {
+			v.partial = true
+			blackHeight[i] = -1
+			continue
+		}
+
+		v.check(c.parent == ptr, child, nil, "parent pointer %d, expected %d", c.parent, ptr)
+		v.check(n.isBlack() || c.isBlack(), ptr, key, "red node has red child %d", child)
+
+		if i == 0 {
+			blackHeight[i] = v.walk(child, lo, &order, depth+1)
+		} else {
+			blackHeight[i] = v.walk(child, &order, hi, depth+1)
+		}
+	}
+
+	// mismatch is reported only where it originates
+	if blackHeight[0] == -1 || blackHeight[1] == -1 {
+		return -1
+	}
+
+	if !v.check(
+		blackHeight[0] == blackHeight[1], ptr, key,
+		"black height mismatch, left %d, right %d", blackHeight[0], blackHeight[1],
+	) {
+		return -1
+	}
+
+	if tree.meta.hasFlag(META_SIZES) {
+		size := tree.fetch(n.left).size + tree.fetch(n.right).size
+		if !n.isTombstone() {
+			size++
+		}
+		v.check(n.size == size, ptr, key, "subtree size %d, expected %d", n.size, size)
+	}
+
+	if n.isBlack() {
+		return blackHeight[0] + 1
+	}
+	return blackHeight[0]
+}
+
+func (v *validator[K, V]) key(n *node[K, V]) []byte {
+	key, err := n.entry.Key.MarshalBinary()
+	if err != nil {
+		v.add(n.ptr, nil, fmt.Sprintf("failed to marshal key: %v", err))
+		return nil
+	}
+	return key
+}
+
+// check adds violation if ok is false and returns ok
+func (v *validator[K, V]) check(ok bool, ptr uint32, key []byte, format string, args ...any) bool {
+	if !ok {
+		v.add(ptr, key, fmt.Sprintf(format, args...))
+	}
+	return ok
+}
+
+func (v *validator[K, V]) add(ptr uint32, key []byte, invariant string) {
+	if v.full() {
+		v.report.Truncated = true
+		return
+	}
+
+	v.report.Violations = append(v.report.Violations, Violation{
+		Ptr:       ptr,
+		Key:       key,
+		Invariant: invariant,
+	})
+}
+
+func (v *validator[K, V]) full() bool {
+	return len(v.report.Violations) >= v.limit
+}
+
+// validPtr reports whether rawPtr points to an allocated node slot
+func (tree *RBTree[K, V]) validPtr(rawPtr uint32) bool {
+	if rawPtr < uint32(tree.meta.pageSize) || rawPtr >= tree.meta.top {
+		return false
+	}
+
+	offset := rawPtr % uint32(tree.meta.pageSize)
+	return offset%uint32(tree.nodeSize) == 0 && offset/uint32(tree.nodeSize) < uint32(tree.degree)
+}
+
+// safeFetch is fetch which returns error instead of panicking
+func (tree *RBTree[K, V]) safeFetch(rawPtr uint32) (n *node[K, V], err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			if fe, ok := r.(fetchError); ok {
+				err = fe.error
+			} else if e, ok := r.(error); ok {
+				err = e
+			} else {
+				err = errors.Errorf("%v", r)
+			}
+		}
+	}()
+
+	return tree.fetch(rawPtr), nil
+}
@@ -0,0 +1,145 @@
+package rbtree
+
+import (
+	"hash/crc32"
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// walTrailerSize is size of record count and CRC32 of records which end
+// write-ahead log, log without valid trailer was not completely written
+const walTrailerSize = 8
+
+// walRecordHeaderSize is size of page id and data length preceding record data
+const walRecordHeaderSize = 12
+
+// walRecord is page write logged before it is done
+type walRecord struct {
+	id   uint64
+	data []byte
+}
+
+// wal is write-ahead log of Options.WAL. Every flush first logs pages it
+// writes and fsyncs the log, then writes pages to tree file, fsyncs it and
+// truncates the log. Open replays complete log left by a crash, so the
+// flush is either done completely or not at all.
+type wal struct {
+	file *os.File
+}
+
+func openWAL(fileName string, mode os.FileMode) (*wal, error) {
+	f, err := os.OpenFile(fileName, os.O_RDWR | os.O_CREATE, mode)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open wal")
+	}
+	return &wal{file: f}, nil
+}
+
+// write replaces log content with records and makes it durable
+func (w *wal) write(records []walRecord) error {
+	size := walTrailerSize
+	for _, r := range records {
+		size += walRecordHeaderSize + len(r.data)
+	}
+
+	buf := make([]byte, 0, size)
+	for _, r := range records {
+		buf = bin.AppendUint64(buf, r.id)
+		buf = bin.AppendUint32(buf, uint32(len(r.data)))
+		buf = append(buf, r.data...)
+	}
+	buf = bin.AppendUint32(buf, uint32(len(records)))
+	buf = bin.AppendUint32(buf, crc32.ChecksumIEEE(buf))
+
+	if err := w.file.Truncate(0); err != nil {
+		return errors.Wrap(err, "failed to truncate wal")
+	}
+	if _, err := w.file.WriteAt(buf, 0); err != nil {
+		return errors.Wrap(err, "failed to write wal")
+	}
+	return errors.Wrap(w.file.Sync(), "failed to sync wal")
+}
+
+// reset empties log after its records were applied
+func (w *wal) reset() error {
+	if err := w.file.Truncate(0); err != nil {
+		return errors.Wrap(err, "failed to truncate wal")
+	}
+	return errors.Wrap(w.file.Sync(), "failed to sync wal")
+}
+
+// records returns logged records, nil if log is empty or incomplete
+func (w *wal) records() ([]walRecord, error) {
+	d, err := io.ReadAll(io.NewSectionReader(w.file, 0, 1 << 62))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read wal")
+	}
+	if len(d) < walTrailerSize {
+		return nil, nil
+	}
+
+	body, trailer := d[:len(d)-4], d[len(d)-4:]
+	if crc32.ChecksumIEEE(body) != bin.Uint32(trailer) {
+		return nil, nil
+	}
+
+	count := bin.Uint32(body[len(body)-4:])
+	body = body[:len(body)-4]
+	records := make([]walRecord, 0, count)
+	for len(body) >= walRecordHeaderSize {
+		r := walRecord{id: bin.Uint64(body[0:8])}
+		n := int(bin.Uint32(body[8:12]))
+		if len(body) < walRecordHeaderSize + n {
+			break
+		}
+		r.data = body[walRecordHeaderSize:walRecordHeaderSize+n]
+		records = append(records, r)
+		body = body[walRecordHeaderSize+n:]
+	}
+	if len(records) != int(count) || len(body) != 0 {
+		return nil, errors.Wrap(ErrCorrupted, "wal records do not match its trailer")
+	}
+	return records, nil
+}
+
+// replay writes pages of complete log to tree file and empties the log,
+// incomplete log is discarded as tree file was not touched by its flush
+func (w *wal) replay(indexFile string, pageSize int, mode os.FileMode) error {
+	records, err := w.records()
+	if err != nil {
+		return err
+	}
+
+	if len(records) > 0 {
+		f, err := os.OpenFile(indexFile, os.O_RDWR | os.O_CREATE, mode)
+		if err != nil {
+			return errors.Wrap(err, "failed to open tree file")
+		}
+		for _, r := range records {
+			if _, err = f.WriteAt(r.data, int64(r.id) * int64(pageSize)); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			err = f.Sync()
+		}
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return errors.Wrap(err, "failed to replay wal")
+		}
+	}
+	return w.reset()
+}
+
+func (w *wal) close() error {
+	return errors.Wrap(w.file.Close(), "failed to close wal")
+}
+
+func (w *wal) remove() {
+	_ = w.file.Close()
+	_ = os.Remove(w.file.Name())
+}